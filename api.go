@@ -0,0 +1,593 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrResponseURLRequired = errors.New("hearts and reposts need a response URL")
+)
+
+const maxAPIBodySize = 1 << 20
+
+// APIError is the error object of the JSON API, sent as {"Error": {...}}.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+var apiErrorCodes = map[int]string{
+	400: "invalid_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	409: "conflict",
+	415: "unsupported_media_type",
+	500: "server_error",
+}
+
+// NewAPIError gives an error its status, see ErrorStatus, and code.
+func NewAPIError(err error) *APIError {
+	var e *APIError
+	if errors.As(err, &e) {
+		return e
+	}
+	status := ErrorStatus(err)
+	return &APIError{Status: status, Code: apiErrorCodes[status], Message: err.Error()}
+}
+
+func FailAPI(c *gin.Context, err error) {
+	e := NewAPIError(err)
+	c.JSON(e.Status, M{"Error": e})
+}
+
+// decodeJSON reads a JSON request body. Unknown fields are rejected so typos
+// don't go unnoticed.
+func decodeJSON(c *gin.Context, v interface{}) error {
+	if !strings.HasPrefix(c.ContentType(), "application/json") {
+		return &APIError{Status: 415, Code: apiErrorCodes[415], Message: "the request body must be application/json"}
+	}
+	d := json.NewDecoder(io.LimitReader(c.Request.Body, maxAPIBodySize))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		return &APIError{Status: 400, Code: apiErrorCodes[400], Message: "invalid JSON body: " + err.Error()}
+	}
+	return nil
+}
+
+// PostInput is the body of a post written through the API. Fields left out
+// are kept as they are by PATCH and cleared by PUT.
+type PostInput struct {
+	Title         *string
+	Body          *string
+	Format        *string
+	Snippet       *string
+	URI           *string
+	Date          *time.Time
+	Type          *PostType
+	Visibility    *Visibility
+	Password      *string
+	ResponseToURL *string
+	Tags          *[]string
+
+	// Read-only fields of a post. They are accepted, and ignored, so that a post
+	// read with GET can be sent back with PUT.
+	ID                   json.RawMessage
+	DateCreated          json.RawMessage
+	BodyHTML             json.RawMessage
+	ResponseToURLPreview json.RawMessage
+	Excerpt              json.RawMessage
+}
+
+// Apply sets the given fields on the content piece, and fills in the date and
+// URI the way the editor does when they are missing.
+func (in *PostInput) Apply(c *ContentPiece) error {
+	if in.Title != nil {
+		c.Title = *in.Title
+	}
+	if in.Body != nil {
+		c.Body = *in.Body
+	}
+	if in.Format != nil {
+		c.Format = *in.Format
+	}
+	if in.Snippet != nil {
+		c.Snippet = *in.Snippet
+	}
+	if in.URI != nil {
+		c.URI = *in.URI
+	}
+	if in.Date != nil {
+		c.Date = *in.Date
+	}
+	if in.Type != nil {
+		c.Type = *in.Type
+	}
+	if in.Visibility != nil {
+		c.Visibility = *in.Visibility
+	}
+	if in.ResponseToURL != nil {
+		c.ResponseToURL = *in.ResponseToURL
+	}
+	if in.Tags != nil {
+		c.Tags = nil
+		for _, x := range *in.Tags {
+			if x = strings.TrimSpace(x); x != "" {
+				c.Tags = append(c.Tags, x)
+			}
+		}
+	}
+	if in.Password != nil && *in.Password != "" {
+		if err := c.SetPassword(*in.Password); err != nil {
+			return err
+		}
+	}
+
+	if c.Date.IsZero() {
+		c.Date = time.Now()
+	}
+	if c.URI == "" {
+		if c.Title != "" {
+			c.URI = TitleToURI(c.Title)
+		} else {
+			c.URI = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	}
+	if c.ResponseToURL == "" && (c.Type == TypeHeart || c.Type == TypeRepost) {
+		return ErrResponseURLRequired
+	}
+	return nil
+}
+
+// PostList is a page of posts. NextCursor is empty on the last page.
+type PostList struct {
+	Items      []*ContentPiece
+	NextCursor string
+}
+
+// API is the versioned JSON API under /api/v1. It takes the same logins and
+// access tokens as the rest of the site, see the README for its resources.
+type API struct {
+	DB        *sql.DB
+	Config    Config
+	Sender    *WebmentionSender
+	Scheduler *Scheduler
+	Previews  *PreviewWorker
+	Files     *FileStore
+	Cache     *ImageCache
+}
+
+// Authorize accepts a logged in session or a bearer token with the scope.
+func (a *API) Authorize(c *gin.Context, scope string) bool {
+	if IsAuthorized(c, scope) {
+		return true
+	}
+	if CurrentToken(c) == nil {
+		FailAPI(c, ErrNoAuth)
+	} else {
+		FailAPI(c, &APIError{Status: 403, Code: "insufficient_scope", Message: "the access token needs the " + scope + " scope"})
+	}
+	return false
+}
+
+// isAuthor tells if the request may see drafts, private and scheduled posts.
+func (a *API) isAuthor(c *gin.Context) bool {
+	return IsAuthorized(c, "update")
+}
+
+// getPost finds a post by its ID or, failing that, its URI.
+func (a *API) getPost(tx *sql.Tx, id string) (*ContentPiece, error) {
+	uri, err := GetContentURI(tx, Identifier(id))
+	if err == ErrContentNotFound {
+		uri = id
+	} else if err != nil {
+		return nil, err
+	}
+	return GetContent(tx, uri)
+}
+
+// HandlePosts lists posts, newest first, or by relevance with q. The limit,
+// type, tag and q parameters work as on the index page, cursor continues
+// where NextCursor of the previous page left off.
+func (a *API) HandlePosts(c *gin.Context) {
+	page := PageInfo{
+		Current:      1,
+		ItemLimit:    parseQueryInt(c.Query("limit"), 10, 1),
+		PostType:     TypeAll,
+		Tag:          c.Query("tag"),
+		Query:        strings.TrimSpace(c.Query("q")),
+		DateFilter:   time.Now(),
+		Visibilities: ListedVisibilities,
+	}
+	if page.ItemLimit > 50 {
+		page.ItemLimit = 50
+	}
+	if v := c.Query("type"); v != "" {
+		for _, t := range []PostType{TypeDefault, TypeRepost, TypeHeart, TypeStatus} {
+			if t.QueryName() == v {
+				page.PostType = t
+			}
+		}
+		if page.PostType == TypeAll {
+			FailAPI(c, ErrInvalidType)
+			return
+		}
+	}
+	author := a.isAuthor(c)
+	if author {
+		page.DateFilter = time.Time{}
+		page.Visibilities = nil
+	}
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := ParseCursor(s)
+		if err != nil {
+			FailAPI(c, err)
+			return
+		}
+		page.After = cursor
+	}
+
+	xs, err := GetContents(a.DB, &page)
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	for _, x := range xs {
+		if !author && !CanRead(c, x) {
+			x.Hide()
+		}
+	}
+	list := PostList{Items: xs}
+	if len(xs) > 0 && page.ItemTotal > len(xs) {
+		last := xs[len(xs)-1]
+		next := &Cursor{Date: last.Date, ID: last.ID}
+		if page.Query != "" {
+			// The count of a search isn't narrowed down by the cursor.
+			next = &Cursor{Offset: len(xs)}
+			if page.After != nil {
+				next.Offset += page.After.Offset
+			}
+			if next.Offset >= page.ItemTotal {
+				next = nil
+			}
+		}
+		if next != nil {
+			list.NextCursor = next.String()
+		}
+	}
+	c.JSON(200, list)
+}
+
+func (a *API) HandlePost(c *gin.Context) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	content, err := a.getPost(tx, c.Param("id"))
+	tx.Rollback()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if !a.isAuthor(c) {
+		if !content.IsPublic() {
+			FailAPI(c, ErrContentNotFound)
+			return
+		}
+		if !CanRead(c, content) {
+			FailAPI(c, &APIError{Status: 401, Code: "password_required", Message: ErrPostPasswordRequired.Error()})
+			return
+		}
+	}
+	c.JSON(200, content)
+}
+
+func (a *API) HandleCreatePost(c *gin.Context) {
+	if !a.Authorize(c, "create") {
+		return
+	}
+	var in PostInput
+	if err := decodeJSON(c, &in); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	var content ContentPiece
+	if err := in.Apply(&content); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	err = CreateContent(tx, &content)
+	if err == nil {
+		err = QueueContentWebmentions(tx, GetBaseURL(c, a.Config.BaseURL), &content)
+	}
+	if err != nil {
+		tx.Rollback()
+		FailAPI(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	a.wake()
+	c.Header("Location", "/api/v1/posts/"+string(content.ID))
+	c.JSON(201, content)
+}
+
+// HandleUpdatePost replaces a post with PUT, or changes the fields given with
+// PATCH.
+func (a *API) HandleUpdatePost(c *gin.Context) {
+	if !a.Authorize(c, "update") {
+		return
+	}
+	var in PostInput
+	if err := decodeJSON(c, &in); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	defer tx.Rollback()
+	content, err := a.getPost(tx, c.Param("id"))
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if c.Request.Method == "PUT" {
+		// The password is kept for a post that stays protected, see
+		// CheckVisibility.
+		content = &ContentPiece{ID: content.ID, DateCreated: content.DateCreated}
+	}
+	if err := in.Apply(content); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	err = UpdateContent(tx, content)
+	if err == nil {
+		err = QueueContentWebmentions(tx, GetBaseURL(c, a.Config.BaseURL), content)
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	a.wake()
+	c.JSON(200, content)
+}
+
+func (a *API) HandleDeletePost(c *gin.Context) {
+	if !a.Authorize(c, "delete") {
+		return
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	defer tx.Rollback()
+	content, err := a.getPost(tx, c.Param("id"))
+	if err == nil {
+		err = DeleteContent(tx, content)
+	}
+	if err == nil {
+		err = QueueOutgoingWebmentions(tx, content.ID, "", nil, time.Now())
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	a.Sender.Wake()
+	c.Status(204)
+}
+
+func (a *API) wake() {
+	a.Sender.Wake()
+	a.Scheduler.Wake()
+	a.Previews.Wake()
+}
+
+// HandleTags counts the posts of every tag.
+func (a *API) HandleTags(c *gin.Context) {
+	page := PageInfo{
+		DateFilter:   time.Now(),
+		Visibilities: ListedVisibilities,
+	}
+	if a.isAuthor(c) {
+		page.DateFilter = time.Time{}
+		page.Visibilities = nil
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	defer tx.Rollback()
+	xs, err := GetTags(tx, &page)
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	c.JSON(200, xs)
+}
+
+// HandleFiles lists a directory of the files.
+func (a *API) HandleFiles(c *gin.Context) {
+	if !a.Authorize(c, "media") {
+		return
+	}
+	xs, err := a.Files.List(c.Param("path"))
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if xs == nil {
+		xs = []FileItem{}
+	}
+	for i := range xs {
+		xs[i].URI = "/files" + xs[i].Path
+	}
+	c.JSON(200, xs)
+}
+
+// HandleUpload saves the multipart File field into Directory, like the files
+// page does.
+func (a *API) HandleUpload(c *gin.Context) {
+	if !a.Authorize(c, "media") {
+		return
+	}
+	dir := c.PostForm("Directory")
+	h, err := c.FormFile("File")
+	if err != nil {
+		FailAPI(c, &APIError{Status: 400, Code: apiErrorCodes[400], Message: "missing File"})
+		return
+	}
+	if err := CheckUpload(c, h.Filename); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	p, err := a.Files.Save(dir, h)
+	if err := LogFileOperation(a.DB, c, "upload", path.Join("/", dir, h.Filename), err); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if full, err := a.Files.Resolve(p); err == nil {
+		a.Cache.Invalidate(full)
+		if !a.Config.KeepMetadata && isJPEG(full) {
+			if _, err := a.Cache.Stripped(full); err != nil {
+				log.Printf("strip %s: %s", p, err)
+			}
+		}
+	}
+	if err := AddMedia(a.DB, a.Files, p, c.PostForm("Alt")); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	c.Header("Location", "/files"+p)
+	c.JSON(201, FileItem{
+		Filename: path.Base(p),
+		Path:     p,
+		URI:      "/files" + p,
+	})
+}
+
+func (a *API) HandleDeleteFile(c *gin.Context) {
+	if !a.Authorize(c, "media") {
+		return
+	}
+	p := path.Join("/", c.Param("path"))
+	if full, err := a.Files.Resolve(p); err == nil {
+		a.Cache.Invalidate(full)
+	}
+	err := a.Files.Delete(p)
+	if err := LogFileOperation(a.DB, c, "delete", p, err); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if err := RemoveMedia(a.DB, p); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	c.Status(204)
+}
+
+// HandlePreview shows the preview of the url parameter and where scraping it
+// is at.
+func (a *API) HandlePreview(c *gin.Context) {
+	if !a.Authorize(c, "update") {
+		return
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	defer tx.Rollback()
+	p, err := GetURLPreview(tx, c.Query("url"))
+	if err == sql.ErrNoRows {
+		err = ErrPreviewNotFound
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	c.JSON(200, p)
+}
+
+// HandleRescrape queues the preview of {"URL": ...} to be scraped again.
+func (a *API) HandleRescrape(c *gin.Context) {
+	if !a.Authorize(c, "update") {
+		return
+	}
+	var in struct {
+		URL string
+	}
+	if err := decodeJSON(c, &in); err != nil {
+		FailAPI(c, err)
+		return
+	}
+	if u, err := url.Parse(in.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		FailAPI(c, ErrUnsupportedScheme)
+		return
+	}
+	tx, err := a.DB.Begin()
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	defer tx.Rollback()
+	err = QueueURLPreview(tx, in.URL, true)
+	var p *URLPreview
+	if err == nil {
+		p, err = GetURLPreview(tx, in.URL)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		FailAPI(c, err)
+		return
+	}
+	a.Previews.Wake()
+	c.Header("Location", "/api/v1/previews?url="+url.QueryEscape(in.URL))
+	c.JSON(202, p)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIPutWhatWasRead(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	a := &API{
+		DB:        db,
+		Config:    Config{BaseURL: testBaseURL},
+		Sender:    NewWebmentionSender(db, testFetcher()),
+		Scheduler: NewScheduler(db, NewEvents()),
+		Previews:  NewPreviewWorker(db, NewScraper(testFetcher(), nil), nil, time.Hour),
+	}
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	r.Use(func(c *gin.Context) {
+		c.Set("token", &AccessToken{Scope: "update"})
+	})
+	r.GET("/posts/:id", a.HandlePost)
+	r.PUT("/posts/:id", a.HandleUpdatePost)
+	do := func(method, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/posts/hello", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	testCreate(t, db, &ContentPiece{Title: "Hello", Body: "<p>Hi</p>", Type: TypeDefault, URI: "hello", Date: time.Now(), Tags: []string{"go"}, ResponseToURL: "https://a.example/"})
+
+	w := do("GET", "")
+	if w.Code != 200 {
+		t.Fatalf("get: %d %s", w.Code, w.Body)
+	}
+	var post map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &post); err != nil {
+		t.Fatal(err)
+	}
+	post["Title"] = "Hello again"
+	post["ID"] = "something else"
+	post["Excerpt"] = "<b>ignored</b>"
+	body, _ := json.Marshal(post)
+	if w := do("PUT", string(body)); w.Code != 200 {
+		t.Fatalf("put: %d %s", w.Code, w.Body)
+	}
+	c := testGet(t, db, "hello")
+	if c.Title != "Hello again" || c.Body != "<p>Hi</p>" || c.ResponseToURL != "https://a.example/" || len(c.Tags) != 1 {
+		t.Errorf("after PUT: %+v", c)
+	}
+	if string(c.ID) == "something else" {
+		t.Error("ID changed")
+	}
+
+	if w := do("PUT", `{"Title": "Hi", "Titel": "Typo"}`); w.Code != 400 {
+		t.Errorf("unknown field: %d", w.Code)
+	}
+}
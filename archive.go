@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrArchiveNotFound = errors.New("no archived copy of that page")
+)
+
+const (
+	// Directory of the files that thumbnails of previews are kept in.
+	ArchiveDir = "archive"
+
+	maxThumbnailSize = 10 << 20
+	maxSnapshotSize  = 256 << 10
+)
+
+var thumbnailTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// ArchiveThumbnail downloads the thumbnail of a preview into the archive
+// directory, named after its URL, and returns its path in the files.
+func ArchiveThumbnail(f *Fetcher, files *FileStore, s string) (string, error) {
+	resp, err := f.Fetch(s, "image/*", maxThumbnailSize+1)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", errors.New(fmt.Sprintf("%s responded with %d", resp.Request.URL.Host, resp.StatusCode))
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxThumbnailSize {
+		return "", ErrFileTooLarge
+	}
+	ext, ok := thumbnailTypes[http.DetectContentType(b)]
+	if !ok {
+		return "", ErrFileType
+	}
+	sum := sha256.Sum256([]byte(s))
+	return files.Write(ArchiveDir, hex.EncodeToString(sum[:16])+ext, bytes.NewReader(b))
+}
+
+// Text in these isn't part of what the page has to say.
+var snapshotSkip = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "nav": true, "header": true, "footer": true, "aside": true,
+	"form": true, "button": true, "select": true, "iframe": true,
+}
+
+var snapshotBlocks = map[string]bool{
+	"p": true, "div": true, "section": true, "li": true, "dt": true, "dd": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "figcaption": true, "tr": true, "br": true,
+	"hr": true, "table": true, "ul": true, "ol": true,
+}
+
+// ReadableText keeps the text of a page, one paragraph per block separated by
+// blank lines. Menus, headers, footers and scripts are left out, and when the
+// page has an <article> or <main> only its text is kept.
+func ReadableText(doc []byte) string {
+	var all, main []string
+	var cur strings.Builder
+	skip, inMain := 0, 0
+	flush := func() {
+		text := strings.Join(strings.Fields(cur.String()), " ")
+		cur.Reset()
+		if text == "" {
+			return
+		}
+		all = append(all, text)
+		if inMain > 0 {
+			main = append(main, text)
+		}
+	}
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	for {
+		tt := z.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			flush()
+			xs := all
+			if len(main) > 0 {
+				xs = main
+			}
+			return joinSnapshot(xs)
+		case xhtml.StartTagToken, xhtml.EndTagToken, xhtml.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch {
+			case snapshotSkip[tag]:
+				if tt == xhtml.StartTagToken {
+					skip++
+				} else if tt == xhtml.EndTagToken && skip > 0 {
+					skip--
+				}
+			case tag == "article" || tag == "main":
+				flush()
+				if tt == xhtml.StartTagToken {
+					inMain++
+				} else if tt == xhtml.EndTagToken && inMain > 0 {
+					inMain--
+				}
+			case snapshotBlocks[tag]:
+				flush()
+			}
+		case xhtml.TextToken:
+			if skip == 0 {
+				cur.Write(z.Text())
+			}
+		}
+	}
+}
+
+func joinSnapshot(xs []string) string {
+	var b strings.Builder
+	for _, x := range xs {
+		if b.Len()+len(x) > maxSnapshotSize {
+			break
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(x)
+	}
+	return b.String()
+}
+
+// ThumbnailHTML shows the archived thumbnail, through the image pipeline when
+// used with pictures, or the original one.
+func (p *URLPreview) ThumbnailHTML() template.HTML {
+	src := p.ThumbnailURL
+	if p.ArchivedThumbnail != "" {
+		src = "/files" + p.ArchivedThumbnail
+	}
+	if src == "" {
+		return ""
+	}
+	return template.HTML(`<img src="` + html.EscapeString(src) + `" alt=""/>`)
+}
+
+func (p *URLPreview) SnapshotParagraphs() []string {
+	return strings.Split(p.Snapshot, "\n\n")
+}
+
+// ArchiveURL is the page showing the archived copy.
+func (p *URLPreview) ArchiveURL() string {
+	return "/archive?url=" + url.QueryEscape(p.URL)
+}
+
+// GetArchive returns the preview of a URL a post responds to, with its
+// snapshot. Check CanReadArchive before showing it.
+func GetArchive(tx *sql.Tx, s string) (*URLPreview, error) {
+	var p URLPreview
+	var crawled sql.NullTime
+	err := tx.QueryRow(`SELECT
+	url,
+	title,
+	date_crawled,
+	archived_thumbnail,
+	snapshot
+FROM url_preview
+WHERE url = ? AND snapshot != '' AND url IN (SELECT response_to FROM content)`, s).Scan(
+		&p.URL, &p.Title, &crawled, &p.ArchivedThumbnail, &p.Snapshot)
+	if err == sql.ErrNoRows {
+		return nil, ErrArchiveNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	p.DateCrawled = crawled.Time
+	return &p, nil
+}
+
+// CanReadArchive tells if the visitor can read one of the posts responding to
+// the URL, the archived copy is shown to the same people.
+func CanReadArchive(c *gin.Context, tx *sql.Tx, s string) (bool, error) {
+	if IsAuthorized(c) {
+		return true, nil
+	}
+	rows, err := tx.Query(`SELECT uri FROM content WHERE response_to = ?`, s)
+	if err != nil {
+		return false, err
+	}
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			rows.Close()
+			return false, err
+		}
+		uris = append(uris, uri)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, uri := range uris {
+		content, err := GetContent(tx, uri)
+		if err != nil {
+			return false, err
+		}
+		if CanRead(c, content) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (p *URLPreview) DateCrawledString() string {
+	return p.DateCrawled.Format("January 2006 2 at 03:04PM")
+}
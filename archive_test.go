@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCanReadArchive(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	posts := []struct {
+		url        string
+		visibility Visibility
+		date       time.Time
+	}{
+		{"https://published.example/", VisibilityPublished, time.Now()},
+		{"https://unlisted.example/", VisibilityUnlisted, time.Now()},
+		{"https://draft.example/", VisibilityDraft, time.Now()},
+		{"https://private.example/", VisibilityPrivate, time.Now()},
+		{"https://protected.example/", VisibilityProtected, time.Now()},
+		{"https://scheduled.example/", VisibilityPublished, time.Now().Add(time.Hour)},
+		// One readable post is enough.
+		{"https://both.example/", VisibilityPrivate, time.Now()},
+		{"https://both.example/", VisibilityPublished, time.Now()},
+	}
+	for i, p := range posts {
+		c := &ContentPiece{Title: "Reply", Body: "<p>Hi</p>", Type: TypeDefault, URI: TitleToURI(p.url) + string(rune('a'+i)), Date: p.date, Visibility: p.visibility, ResponseToURL: p.url}
+		if p.visibility == VisibilityProtected {
+			if err := c.SetPassword("hunter2"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		testCreate(t, db, c)
+	}
+
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	got := map[string]bool{}
+	r.GET("/", func(c *gin.Context) {
+		if c.Query("session") != "" {
+			sessions.Default(c).Set("authed", true)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		urls := []string{"https://unknown.example/"}
+		for _, p := range posts {
+			urls = append(urls, p.url)
+		}
+		for _, url := range urls {
+			ok, err := CanReadArchive(c, tx, url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[url] = ok
+		}
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	want := map[string]bool{
+		"https://published.example/": true,
+		"https://unlisted.example/":  true,
+		"https://both.example/":      true,
+	}
+	for url, ok := range got {
+		if ok != want[url] {
+			t.Errorf("visitor: %s readable = %v", url, ok)
+		}
+	}
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?session=1", nil))
+	for url, ok := range got {
+		if !ok {
+			t.Errorf("author: %s not readable", url)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
+)
+
+var (
+	ErrCSRF = errors.New("the form has expired or was sent from another site, reload the page and try again")
+)
+
+// CSRFToken is the token of the session, created on first use. Forms posted
+// with the logged in session have to send it back.
+func CSRFToken(c *gin.Context) string {
+	s := sessions.Default(c)
+	if token, ok := s.Get("csrf").(string); ok && token != "" {
+		return token
+	}
+	token, err := randomToken()
+	if err != nil {
+		panic(err)
+	}
+	s.Set("csrf", token)
+	s.Save()
+	return token
+}
+
+// CSRF rejects state changing requests made by the logged in author that do
+// not carry the session's token in the csrf_token field or X-CSRF-Token
+// header. Requests authorized with a bearer token aren't sent by browsers on
+// their own, so they don't need one.
+func CSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case "GET", "HEAD", "OPTIONS":
+			c.Next()
+			return
+		}
+		if !IsAuthorized(c) || c.GetHeader("Authorization") != "" {
+			c.Next()
+			return
+		}
+		got := c.GetHeader("X-CSRF-Token")
+		if got == "" {
+			got = c.PostForm("csrf_token")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(CSRFToken(c))) != 1 {
+			HandleError(c, ErrCSRF)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Placeholders so templates parse; Renderer binds them to the request.
+var csrfFuncs = template.FuncMap{
+	"csrfToken": func() string { return "" },
+	"csrfField": func() template.HTML { return "" },
+}
+
+// Renderer executes templates with csrfToken and csrfField bound to the
+// session of the request. html/template can't be cloned once executed, so the
+// templates are parsed once and requests borrow clones of them from a pool,
+// binding the funcs to themselves for as long as they render.
+type Renderer struct {
+	Glob  string
+	Funcs template.FuncMap
+
+	mu  sync.Mutex
+	set *templateSet
+}
+
+type templateSet struct {
+	templates *template.Template
+	// The number of files and the newest of them, to tell when they changed.
+	files    int
+	modified time.Time
+	pool     sync.Pool
+}
+
+func NewRenderer(glob string, funcs template.FuncMap) (*Renderer, error) {
+	r := &Renderer{Glob: glob, Funcs: funcs}
+	return r, r.load()
+}
+
+// templateFiles describes the files of a glob the way templateSet does.
+func templateFiles(glob string) (int, time.Time, error) {
+	names, err := filepath.Glob(glob)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var modified time.Time
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return len(names), modified, nil
+}
+
+func (r *Renderer) load() error {
+	files, modified, err := templateFiles(r.Glob)
+	if err != nil {
+		return err
+	}
+	t, err := template.New("").Funcs(csrfFuncs).Funcs(r.Funcs).ParseGlob(r.Glob)
+	if err != nil {
+		return err
+	}
+	set := &templateSet{templates: t, files: files, modified: modified}
+	set.pool.New = func() interface{} {
+		// The parsed templates are never executed, so this can't fail.
+		return template.Must(t.Clone())
+	}
+	r.set = set
+	return nil
+}
+
+// templates returns the current templates, parsed again while developing when
+// the files changed, like gin does.
+func (r *Renderer) templates() (*templateSet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if gin.IsDebugging() {
+		files, modified, err := templateFiles(r.Glob)
+		if err != nil {
+			return nil, err
+		}
+		if files != r.set.files || !modified.Equal(r.set.modified) {
+			if err := r.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r.set, nil
+}
+
+// Attach makes the renderer available to HTML for the request.
+func (r *Renderer) Attach(c *gin.Context) {
+	c.Set("renderer", r)
+	c.Next()
+}
+
+func (r *Renderer) HTML(c *gin.Context, code int, name string, data interface{}) {
+	set, err := r.templates()
+	if err != nil {
+		c.String(500, err.Error())
+		return
+	}
+	// Only the author's forms are checked. Visitors and crawlers get no token
+	// so they aren't given a session cookie just for viewing a page.
+	var token string
+	if IsAuthorized(c) {
+		token = CSRFToken(c)
+	}
+	t := set.pool.Get().(*template.Template)
+	defer set.pool.Put(t)
+	t.Funcs(template.FuncMap{
+		"csrfToken": func() string { return token },
+		"csrfField": func() template.HTML {
+			return template.HTML(`<input type="hidden" name="csrf_token" value="` + template.HTMLEscapeString(token) + `"/>`)
+		},
+	})
+	c.Render(code, render.HTML{Template: t, Name: name, Data: data})
+}
+
+// HTML renders a template with the request's Renderer.
+func HTML(c *gin.Context, code int, name string, data interface{}) {
+	if v, ok := c.Get("renderer"); ok {
+		v.(*Renderer).HTML(c, code, name, data)
+		return
+	}
+	c.HTML(code, name, data)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRendererCSRFToken(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := `{{define "form.html"}}<form>{{csrfField}}</form>{{end}}`
+	if err := os.WriteFile(filepath.Join(dir, "form.html"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+	renderer, err := NewRenderer(filepath.Join(dir, "*.html"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	r.Use(renderer.Attach)
+	r.GET("/", func(c *gin.Context) {
+		if c.Query("authed") != "" {
+			s := sessions.Default(c)
+			s.Set("authed", true)
+		}
+		HTML(c, 200, "form.html", nil)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if c := w.Header().Get("Set-Cookie"); c != "" {
+		t.Errorf("visitor got a cookie: %s", c)
+	}
+	if strings.Contains(w.Body.String(), `value="`) && !strings.Contains(w.Body.String(), `value=""`) {
+		t.Errorf("visitor got a token: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/?authed=1", nil))
+	if w.Header().Get("Set-Cookie") == "" || strings.Contains(w.Body.String(), `value=""`) {
+		t.Errorf("author got no token: %s", w.Body)
+	}
+}
+
+func TestRendererConcurrentTokens(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "form.html")
+	if err := os.WriteFile(name, []byte(`{{define "form.html"}}<form>{{csrfField}}</form>{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	renderer, err := NewRenderer(filepath.Join(dir, "*.html"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	r.Use(renderer.Attach)
+	r.GET("/", func(c *gin.Context) {
+		s := sessions.Default(c)
+		s.Set("authed", true)
+		s.Set("csrf", c.Query("token"))
+		HTML(c, 200, "form.html", nil)
+	})
+	render := func(token string) string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/?token="+token, nil))
+		return w.Body.String()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			if body := render(token); !strings.Contains(body, `value="`+token+`"`) {
+				t.Errorf("token %s rendered as %s", token, body)
+			}
+		}(fmt.Sprintf("token%d", i))
+	}
+	wg.Wait()
+
+	// Changed templates are picked up while debugging, only then.
+	set := renderer.set
+	render("a")
+	if renderer.set != set {
+		t.Error("unchanged templates parsed again")
+	}
+	if err := os.WriteFile(name, []byte(`{{define "form.html"}}<form class="new">{{csrfField}}</form>{{end}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if body := render("a"); !strings.Contains(body, `class="new"`) {
+		t.Errorf("changed template not picked up: %s", body)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+type DiffOp int
+
+const (
+	DiffEqual  DiffOp = 0
+	DiffInsert DiffOp = 1
+	DiffDelete DiffOp = 2
+)
+
+type DiffChunk struct {
+	Op   DiffOp
+	Text string
+}
+
+// Past this many edits two texts are considered completely different, which
+// bounds the memory used by the diff.
+const diffMaxEdits = 1000
+
+// Words, runs of whitespace and HTML tags are diffed as single tokens.
+var diffTokenRegexp = regexp.MustCompile(`<[^>]*>|\s+|[^\s<]+`)
+
+// DiffWords returns the word level differences between a and b.
+func DiffWords(a, b string) []DiffChunk {
+	return diffTokens(diffTokenRegexp.FindAllString(a, -1), diffTokenRegexp.FindAllString(b, -1))
+}
+
+// DiffHTML renders chunks with insertions and deletions wrapped in <ins> and
+// <del> elements. The text itself is escaped.
+func DiffHTML(xs []DiffChunk) template.HTML {
+	var b strings.Builder
+	for _, x := range xs {
+		s := html.EscapeString(x.Text)
+		switch x.Op {
+		case DiffInsert:
+			b.WriteString("<ins>" + s + "</ins>")
+		case DiffDelete:
+			b.WriteString("<del>" + s + "</del>")
+		default:
+			b.WriteString(s)
+		}
+	}
+	return template.HTML(b.String())
+}
+
+func diffTokens(a, b []string) []DiffChunk {
+	// Common prefixes and suffixes are cheap to strip and usually make up most
+	// of a revision.
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var xs []DiffChunk
+	xs = appendChunk(xs, DiffEqual, a[:prefix]...)
+	xs = append(xs, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	xs = appendChunk(xs, DiffEqual, a[len(a)-suffix:]...)
+	return mergeChunks(xs)
+}
+
+// myers implements "An O(ND) Difference Algorithm and Its Variations".
+func myers(a, b []string) []DiffChunk {
+	n, m := len(a), len(b)
+	limit := n + m
+	if limit > diffMaxEdits {
+		limit = diffMaxEdits
+	}
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	found := -1
+
+search:
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v...))
+				found = d
+				break search
+			}
+		}
+		trace = append(trace, append([]int(nil), v...))
+	}
+	if found < 0 {
+		var xs []DiffChunk
+		xs = appendChunk(xs, DiffDelete, a...)
+		return appendChunk(xs, DiffInsert, b...)
+	}
+
+	// Walk the trace backwards collecting the edits in reverse.
+	var rev []DiffChunk
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[offset+k-1] < prev[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, DiffChunk{DiffEqual, a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			rev = append(rev, DiffChunk{DiffInsert, b[y-1]})
+			y--
+		} else {
+			rev = append(rev, DiffChunk{DiffDelete, a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		rev = append(rev, DiffChunk{DiffEqual, a[x-1]})
+		x--
+		y--
+	}
+
+	xs := make([]DiffChunk, len(rev))
+	for i, c := range rev {
+		xs[len(rev)-1-i] = c
+	}
+	return xs
+}
+
+func appendChunk(xs []DiffChunk, op DiffOp, tokens ...string) []DiffChunk {
+	if len(tokens) == 0 {
+		return xs
+	}
+	return append(xs, DiffChunk{op, strings.Join(tokens, "")})
+}
+
+func mergeChunks(xs []DiffChunk) []DiffChunk {
+	var ys []DiffChunk
+	for _, x := range xs {
+		if x.Text == "" {
+			continue
+		}
+		if len(ys) > 0 && ys[len(ys)-1].Op == x.Op {
+			ys[len(ys)-1].Text += x.Text
+			continue
+		}
+		ys = append(ys, x)
+	}
+	return ys
+}
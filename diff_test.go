@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []DiffChunk
+	}{
+		{"", "", nil},
+		{"same text", "same text", []DiffChunk{{DiffEqual, "same text"}}},
+		{"", "new", []DiffChunk{{DiffInsert, "new"}}},
+		{"old", "", []DiffChunk{{DiffDelete, "old"}}},
+		{"the quick fox", "the slow fox", []DiffChunk{
+			{DiffEqual, "the "},
+			{DiffDelete, "quick"},
+			{DiffInsert, "slow"},
+			{DiffEqual, " fox"},
+		}},
+		{"a c", "a b c", []DiffChunk{
+			{DiffEqual, "a "},
+			{DiffInsert, "b "},
+			{DiffEqual, "c"},
+		}},
+		// Tags are single tokens.
+		{"<p>Hi</p>", "<p>Hi <b>there</b></p>", []DiffChunk{
+			{DiffEqual, "<p>Hi"},
+			{DiffInsert, " <b>there</b>"},
+			{DiffEqual, "</p>"},
+		}},
+	}
+	for _, tt := range tests {
+		if got := DiffWords(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("DiffWords(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Whatever the chunks, the equal and deleted ones make up the old text and the
+// equal and inserted ones the new text.
+func TestDiffWordsRebuilds(t *testing.T) {
+	words := []string{"a", "b", "c", "<p>", "</p>", " ", "\n"}
+	text := func(r *rand.Rand, n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			b.WriteString(words[r.Intn(len(words))])
+		}
+		return b.String()
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		a, b := text(r, r.Intn(40)), text(r, r.Intn(40))
+		checkDiff(t, a, b, DiffWords(a, b))
+	}
+
+	// Past the edit limit everything is replaced.
+	a, b := strings.Repeat("x ", diffMaxEdits)+"x", strings.Repeat("y ", diffMaxEdits)+"y"
+	xs := DiffWords(a, b)
+	checkDiff(t, a, b, xs)
+	if len(xs) != 2 || xs[0].Op != DiffDelete || xs[1].Op != DiffInsert {
+		t.Errorf("over the limit: %d chunks", len(xs))
+	}
+}
+
+func checkDiff(t *testing.T, a, b string, xs []DiffChunk) {
+	t.Helper()
+	var oldText, newText strings.Builder
+	for i, x := range xs {
+		if x.Text == "" || (i > 0 && xs[i-1].Op == x.Op) {
+			t.Errorf("DiffWords(%q, %q): chunks aren't merged: %v", a, b, xs)
+		}
+		if x.Op != DiffInsert {
+			oldText.WriteString(x.Text)
+		}
+		if x.Op != DiffDelete {
+			newText.WriteString(x.Text)
+		}
+	}
+	if oldText.String() != a || newText.String() != b {
+		t.Errorf("DiffWords(%q, %q) rebuilds %q and %q", a, b, oldText.String(), newText.String())
+	}
+}
+
+func TestDiffHTML(t *testing.T) {
+	got := DiffHTML([]DiffChunk{{DiffEqual, "<p>"}, {DiffDelete, "a & b"}, {DiffInsert, "c"}})
+	if want := "&lt;p&gt;<del>a &amp; b</del><ins>c</ins>"; string(got) != want {
+		t.Errorf("DiffHTML = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+var (
+	ErrNotJPEG = errors.New("not a JPEG image")
+)
+
+// PhotoDetails are the EXIF fields of a photo worth showing next to it.
+type PhotoDetails struct {
+	Camera   string
+	Lens     string
+	Exposure string
+	TakenAt  time.Time
+}
+
+func (d *PhotoDetails) IsEmpty() bool {
+	return d.Camera == "" && d.Lens == "" && d.Exposure == "" && d.TakenAt.IsZero()
+}
+
+func (d *PhotoDetails) TakenAtString() string {
+	return d.TakenAt.Format("January 2006 2 at 03:04PM")
+}
+
+func isJPEG(filename string) bool {
+	return imageFormats[strings.ToLower(filepath.Ext(filename))] == "jpeg"
+}
+
+// Summary puts the details on one line, e.g.
+// "Fujifilm X100V · 1/250s f/2 ISO 160 23mm · taken May 2024 4 at 06:12PM".
+func (d *PhotoDetails) Summary() string {
+	var xs []string
+	for _, x := range []string{d.Camera, d.Lens, d.Exposure} {
+		if x != "" {
+			xs = append(xs, x)
+		}
+	}
+	if !d.TakenAt.IsZero() {
+		xs = append(xs, "taken "+d.TakenAtString())
+	}
+	return strings.Join(xs, " · ")
+}
+
+// ReadExif reads the details and the orientation, 1 to 8 as in EXIF, of an
+// image. Images without EXIF have no details and orientation 1.
+func ReadExif(r io.Reader) (PhotoDetails, int) {
+	var d PhotoDetails
+	x, err := exif.Decode(r)
+	if err != nil {
+		return d, 1
+	}
+	str := func(name exif.FieldName) string {
+		if tag, err := x.Get(name); err == nil {
+			if s, err := tag.StringVal(); err == nil {
+				return strings.TrimSpace(strings.Trim(s, "\x00"))
+			}
+		}
+		return ""
+	}
+	rat := func(name exif.FieldName) float64 {
+		if tag, err := x.Get(name); err == nil {
+			if num, den, err := tag.Rat2(0); err == nil && den != 0 {
+				return float64(num) / float64(den)
+			}
+		}
+		return 0
+	}
+
+	// Models usually repeat the make, as in Canon / Canon EOS R6.
+	maker, model := str(exif.Make), str(exif.Model)
+	if model != "" && strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		d.Camera = model
+	} else {
+		d.Camera = strings.TrimSpace(maker + " " + model)
+	}
+	d.Lens = str(exif.LensModel)
+
+	var exposure []string
+	if t := rat(exif.ExposureTime); t > 0 && t < 1 {
+		exposure = append(exposure, fmt.Sprintf("1/%ds", int(math.Round(1/t))))
+	} else if t >= 1 {
+		exposure = append(exposure, strconv.FormatFloat(t, 'f', -1, 64)+"s")
+	}
+	if f := rat(exif.FNumber); f > 0 {
+		exposure = append(exposure, "f/"+strconv.FormatFloat(f, 'f', -1, 64))
+	}
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil && iso > 0 {
+			exposure = append(exposure, fmt.Sprintf("ISO %d", iso))
+		}
+	}
+	if l := rat(exif.FocalLength); l > 0 {
+		exposure = append(exposure, strconv.FormatFloat(l, 'f', -1, 64)+"mm")
+	}
+	d.Exposure = strings.Join(exposure, " ")
+
+	if t, err := x.DateTime(); err == nil {
+		d.TakenAt = t
+	}
+
+	orientation := 1
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if o, err := tag.Int(0); err == nil && o >= 1 && o <= 8 {
+			orientation = o
+		}
+	}
+	return d, orientation
+}
+
+// StripMetadata writes a copy of a JPEG without the EXIF, XMP and IPTC
+// segments that carry location and device details. Colour profiles are kept.
+// Rotated photos are turned upright and encoded again, as the orientation goes
+// with the EXIF.
+func StripMetadata(filename string, w io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, orientation := ReadExif(f); orientation != 1 {
+		img, err := imaging.Open(filename, imaging.AutoOrientation(true))
+		if err != nil {
+			return err
+		}
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(95))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return stripJPEG(bufio.NewReader(f), w)
+}
+
+func stripJPEG(r *bufio.Reader, w io.Writer) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return ErrNotJPEG
+	}
+	var out bytes.Buffer
+	out.Write(soi[:])
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xFF {
+			return ErrNotJPEG
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case marker == 0xD9:
+			out.Write([]byte{0xFF, marker})
+			_, err := w.Write(out.Bytes())
+			return err
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			out.Write([]byte{0xFF, marker})
+			continue
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := int(size[0])<<8 | int(size[1])
+		if n < 2 {
+			return ErrNotJPEG
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		// APP1 holds EXIF and XMP, APP13 IPTC and COM free text.
+		if marker != 0xE1 && marker != 0xED && marker != 0xFE {
+			out.Write([]byte{0xFF, marker})
+			out.Write(size[:])
+			out.Write(payload)
+		}
+		// The compressed image data follows the start of scan.
+		if marker == 0xDA {
+			if _, err := w.Write(out.Bytes()); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload string) []byte {
+	n := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(n >> 8), byte(n)}, payload...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	body := enc.Bytes()[2:]
+	icc := jpegSegment(0xE2, "ICC_PROFILE\x00profile")
+
+	var in bytes.Buffer
+	in.Write([]byte{0xFF, 0xD8})
+	in.Write(jpegSegment(0xE1, "Exif\x00\x00GPS 52.37N 4.89E"))
+	in.Write(icc)
+	in.Write(jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	in.Write(jpegSegment(0xED, "Photoshop 3.0\x00IPTC"))
+	in.Write(jpegSegment(0xFE, "Taken at home"))
+	in.Write(body)
+
+	var out bytes.Buffer
+	if err := stripJPEG(bufio.NewReader(&in), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte{0xFF, 0xD8}, icc...), body...)
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("stripped %d bytes to %d, want %d", in.Len(), out.Len(), len(want))
+	}
+	for _, x := range []string{"GPS", "xmpmeta", "IPTC", "Taken at home"} {
+		if bytes.Contains(out.Bytes(), []byte(x)) {
+			t.Errorf("%q is left", x)
+		}
+	}
+	if _, err := jpeg.Decode(&out); err != nil {
+		t.Errorf("stripped JPEG: %s", err)
+	}
+}
+
+func TestStripJPEGInvalid(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	inputs := [][]byte{
+		enc.Bytes(),
+		{},
+		{0xFF, 0xD8, 0x00},
+		// A segment shorter than its own length field.
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01},
+		{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x10, 'x'},
+	}
+	for _, x := range inputs {
+		var out bytes.Buffer
+		if err := stripJPEG(bufio.NewReader(bytes.NewReader(x)), &out); err == nil {
+			t.Errorf("% x: no error", x)
+		} else if out.Len() != 0 {
+			t.Errorf("% x: wrote %d bytes", x, out.Len())
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FeedFormat int
+
+const (
+	FeedRSS FeedFormat = iota
+	FeedAtom
+	FeedJSON
+)
+
+// Feed is the format agnostic description of a syndication feed.
+type Feed struct {
+	Title   string
+	BaseURL string
+	// ID names the feed the same whichever page or URL it was fetched from.
+	ID      string
+	SelfURL string
+	HomeURL string
+	Updated time.Time
+	Items   []*ContentPiece
+}
+
+var relativeURLRegexp = regexp.MustCompile(`(src|href)="/([^/])`)
+
+// AbsoluteURL turns a site relative path into an absolute URL.
+func AbsoluteURL(base, p string) string {
+	return strings.TrimRight(base, "/") + p
+}
+
+// AbsoluteHTML rewrites root relative src and href attributes so feed readers
+// can resolve them.
+func AbsoluteHTML(base, s string) string {
+	return relativeURLRegexp.ReplaceAllString(s, `$1="`+strings.TrimRight(base, "/")+`/$2`)
+}
+
+// GetBaseURL returns the configured base URL or falls back to the host the
+// request was made to.
+func GetBaseURL(c *gin.Context, configured string) string {
+	if configured != "" {
+		return strings.TrimRight(configured, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	// Only a trusted reverse proxy knows how the request reached it.
+	if v := c.GetHeader("X-Forwarded-Proto"); v != "" && IsTrustedProxy(c) {
+		scheme = v
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// FeedTitle gives every item a readable title, even hearts and reposts which
+// usually have none.
+func FeedTitle(c *ContentPiece) string {
+	if c.Title != "" {
+		return c.Title
+	}
+	target := c.ResponseToURL
+	if c.ResponseToURLPreview != nil && c.ResponseToURLPreview.Title != "" {
+		target = c.ResponseToURLPreview.Title
+	}
+	switch c.Type {
+	case TypeHeart:
+		return "Liked " + target
+	case TypeRepost:
+		return "Reposted " + target
+	}
+	return c.DateString()
+}
+
+// FeedContent is the full HTML body of an item with any response context.
+func FeedContent(base string, c *ContentPiece) string {
+	s := string(c.HTML())
+	if c.ResponseToURL != "" {
+		title := c.ResponseToURL
+		if c.ResponseToURLPreview != nil && c.ResponseToURLPreview.Title != "" {
+			title = c.ResponseToURLPreview.Title
+		}
+		var b bytes.Buffer
+		b.WriteString(`<p>In response to <a href="`)
+		xml.EscapeText(&b, []byte(c.ResponseToURL))
+		b.WriteString(`">`)
+		xml.EscapeText(&b, []byte(title))
+		b.WriteString(`</a></p>`)
+		s = b.String() + s
+	}
+	return AbsoluteHTML(base, s)
+}
+
+func feedItemURL(base string, c *ContentPiece) string {
+	return AbsoluteURL(base, "/post/"+c.URI)
+}
+
+func feedItemID(c *ContentPiece) string {
+	return "urn:uuid:" + string(c.ID)
+}
+
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Categories  []string `xml:"category"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomDoc struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Links      []atomLink     `xml:"link"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	ExternalURL   string   `json:"external_url,omitempty"`
+	Title         string   `json:"title,omitempty"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func (f *Feed) RSS() ([]byte, error) {
+	doc := rssDoc{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       f.Title,
+			Link:        f.HomeURL,
+			Description: f.Title,
+			AtomLink:    atomLink{Href: f.SelfURL, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !f.Updated.IsZero() {
+		doc.Channel.LastBuildDate = f.Updated.Format(time.RFC1123Z)
+	}
+	for _, c := range f.Items {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title:       FeedTitle(c),
+			Link:        feedItemURL(f.BaseURL, c),
+			Description: FeedContent(f.BaseURL, c),
+			GUID:        rssGUID{IsPermaLink: "false", Value: feedItemID(c)},
+			PubDate:     c.DateCreated.Format(time.RFC1123Z),
+			Categories:  c.Tags,
+		})
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (f *Feed) Atom() ([]byte, error) {
+	doc := atomDoc{
+		Title:   f.Title,
+		ID:      f.ID,
+		Updated: f.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.SelfURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: f.HomeURL, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, c := range f.Items {
+		e := atomEntry{
+			Title:     FeedTitle(c),
+			ID:        feedItemID(c),
+			Links:     []atomLink{{Href: feedItemURL(f.BaseURL, c), Rel: "alternate", Type: "text/html"}},
+			Published: c.DateCreated.Format(time.RFC3339),
+			Updated:   c.Date.Format(time.RFC3339),
+			Content:   atomText{Type: "html", Value: FeedContent(f.BaseURL, c)},
+		}
+		if c.ResponseToURL != "" {
+			e.Links = append(e.Links, atomLink{Href: c.ResponseToURL, Rel: "related"})
+		}
+		if c.Snippet != "" {
+			e.Summary = &atomText{Type: "text", Value: c.Snippet}
+		}
+		for _, tag := range c.Tags {
+			e.Categories = append(e.Categories, atomCategory{Term: tag})
+		}
+		doc.Entries = append(doc.Entries, e)
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (f *Feed) JSON() ([]byte, error) {
+	doc := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.HomeURL,
+		FeedURL:     f.SelfURL,
+		Items:       []jsonFeedItem{},
+	}
+	for _, c := range f.Items {
+		doc.Items = append(doc.Items, jsonFeedItem{
+			ID:            feedItemID(c),
+			URL:           feedItemURL(f.BaseURL, c),
+			ExternalURL:   c.ResponseToURL,
+			Title:         FeedTitle(c),
+			ContentHTML:   FeedContent(f.BaseURL, c),
+			Summary:       c.Snippet,
+			DatePublished: c.DateCreated.Format(time.RFC3339),
+			DateModified:  c.Date.Format(time.RFC3339),
+			Tags:          c.Tags,
+		})
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// ServeFeed renders the posts matching the request's page filters as a feed
+// and answers conditional requests with 304 when nothing changed.
+func ServeFeed(c *gin.Context, db *sql.DB, cfg Config, format FeedFormat) {
+	page := GetPage(c)
+	// Feeds never include scheduled or hidden posts, even for the author.
+	page.DateFilter = time.Now()
+	page.Visibilities = []Visibility{VisibilityPublished}
+	xs, err := GetContents(db, &page)
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+
+	base := GetBaseURL(c, cfg.BaseURL)
+	home := base + "/"
+	id := AbsoluteURL(base, c.Request.URL.Path)
+	if q := page.FilterQuery(); q != "" {
+		home += "?" + q
+		id += "?" + q
+	}
+	f := Feed{
+		Title:   cfg.Title,
+		BaseURL: base,
+		ID:      id,
+		SelfURL: AbsoluteURL(base, c.Request.URL.RequestURI()),
+		HomeURL: home,
+		Items:   xs,
+	}
+	for _, x := range xs {
+		if x.Date.After(f.Updated) {
+			f.Updated = x.Date
+		}
+	}
+	// Edits and deletions change the feed too.
+	tx, err := db.Begin()
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+	changed, err := LastChanged(tx)
+	tx.Rollback()
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+	if changed.After(f.Updated) {
+		f.Updated = changed
+	}
+	if f.Updated.IsZero() {
+		f.Updated = time.Now()
+	}
+
+	var b []byte
+	var contentType string
+	switch format {
+	case FeedAtom:
+		b, err = f.Atom()
+		contentType = "application/atom+xml; charset=utf-8"
+	case FeedJSON:
+		b, err = f.JSON()
+		contentType = "application/feed+json; charset=utf-8"
+	default:
+		b, err = f.RSS()
+		contentType = "application/rss+xml; charset=utf-8"
+	}
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+
+	sum := sha1.Sum(b)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	lastModified := f.Updated.UTC().Format(http.TimeFormat)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", lastModified)
+	c.Header("Cache-Control", "public, max-age=300")
+	if IsNotModified(c, etag, f.Updated) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(200, contentType, b)
+}
+
+// IsNotModified evaluates If-None-Match, then If-Modified-Since, as described
+// by RFC 7232.
+func IsNotModified(c *gin.Context, etag string, modified time.Time) bool {
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapDoc struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// Sitemap lists the home page and every published post for search engines.
+func Sitemap(db *sql.DB, base string) ([]byte, error) {
+	rows, err := db.Query(`
+SELECT
+	uri,
+	date
+FROM content
+WHERE visibility = ? AND date <= ?
+ORDER BY date DESC`, VisibilityPublished, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	doc := sitemapDoc{
+		XMLNS: "http://www.sitemaps.org/schemas/sitemap/0.9",
+		URLs:  []sitemapURL{{Loc: base + "/"}},
+	}
+	for rows.Next() {
+		var uri string
+		var date time.Time
+		if err := rows.Scan(&uri, &date); err != nil {
+			return nil, err
+		}
+		doc.URLs = append(doc.URLs, sitemapURL{
+			Loc:     base + "/post/" + uri,
+			LastMod: date.Format("2006-01-02"),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func testContext(header map[string]string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/feed.xml", nil)
+	for k, v := range header {
+		c.Request.Header.Set(k, v)
+	}
+	return c
+}
+
+func TestIsNotModified(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 500, time.UTC)
+	etag := `"abc"`
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   bool
+	}{
+		{"no condition", nil, false},
+		{"same etag", map[string]string{"If-None-Match": `"abc"`}, true},
+		{"weak etag", map[string]string{"If-None-Match": `W/"abc"`}, true},
+		{"one of several", map[string]string{"If-None-Match": `"x", "abc"`}, true},
+		{"any", map[string]string{"If-None-Match": "*"}, true},
+		{"other etag", map[string]string{"If-None-Match": `"x"`}, false},
+		// If-None-Match wins over If-Modified-Since.
+		{"other etag, not modified since", map[string]string{
+			"If-None-Match":     `"x"`,
+			"If-Modified-Since": modified.Add(time.Hour).Format(http.TimeFormat),
+		}, false},
+		{"modified at", map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, true},
+		{"modified after", map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, false},
+		{"invalid date", map[string]string{"If-Modified-Since": "yesterday"}, false},
+	}
+	for _, tt := range tests {
+		if got := IsNotModified(testContext(tt.header), etag, modified); got != tt.want {
+			t.Errorf("%s: IsNotModified = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetBaseURLForwardedProto(t *testing.T) {
+	defer func() { trustedProxies = nil }()
+	header := map[string]string{"X-Forwarded-Proto": "https"}
+
+	c := testContext(header)
+	c.Request.RemoteAddr = "203.0.113.7:1234"
+	if got := GetBaseURL(c, ""); got != "http://example.com" {
+		t.Errorf("untrusted client: GetBaseURL = %q", got)
+	}
+
+	trustedProxies, _ = ParseTrustedProxies("127.0.0.1,10.0.0.0/8")
+	c = testContext(header)
+	c.Request.RemoteAddr = "10.1.2.3:1234"
+	if got := GetBaseURL(c, ""); got != "https://example.com" {
+		t.Errorf("trusted proxy: GetBaseURL = %q", got)
+	}
+	if got := GetBaseURL(c, "https://blog.example/"); got != "https://blog.example" {
+		t.Errorf("configured: GetBaseURL = %q", got)
+	}
+}
+
+func TestAtomFeedID(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	r.GET("/feed.atom", func(c *gin.Context) {
+		ServeFeed(c, db, Config{BaseURL: testBaseURL, Title: "Blog"}, FeedAtom)
+	})
+	for _, q := range []string{"tag=go", "tag=go&page=2&limit=5", "utm_source=reader&tag=go"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/feed.atom?"+q, nil))
+		if want := "<id>" + testBaseURL + "/feed.atom?tag=go</id>"; !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: no %s in\n%s", q, want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrForbiddenAddress   = errors.New("URL points to a local or private address")
+	ErrUnsupportedScheme  = errors.New("only http and https URLs can be fetched")
+	ErrTooManyRedirects   = errors.New("too many redirects")
+	ErrDisallowedByRobots = errors.New("disallowed by robots.txt")
+)
+
+const (
+	// The token matched against the User-agent lines of robots.txt.
+	robotsAgent = "weblog"
+	// Sites see this as who is asking for their pages.
+	fetchUserAgent = "Mozilla/5.0 (compatible; weblog)"
+
+	maxFetchSize      = 2 << 20
+	maxRobotsSize     = 512 << 10
+	maxFetchRedirects = 5
+	robotsTTL         = time.Hour
+)
+
+// Addresses that are not on the public internet but aren't covered by the
+// net.IP methods.
+var forbiddenNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// IsForbiddenIP tells if an address is loopback, private, link-local or
+// otherwise not one weblog should fetch from on behalf of a URL it was given.
+func IsForbiddenIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range forbiddenNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The check is made on the address being dialed, after resolving, so a host
+// name can't resolve to a public address when validated and a private one
+// when connecting.
+func (f *Fetcher) dialControl(network, address string, c syscall.RawConn) error {
+	if f.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || IsForbiddenIP(ip) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// Fetcher gets pages from other sites for weblog's own use, such as URL
+// previews. It only connects to public addresses, bounds how long a request
+// takes and how much is read, and honours robots.txt.
+type Fetcher struct {
+	Client      *http.Client
+	UserAgent   string
+	MaxBodySize int64
+	// Lets it fetch from local and private addresses, e.g. test servers.
+	AllowPrivate bool
+
+	mu     sync.Mutex
+	robots map[string]*robotsRules
+}
+
+func NewFetcher() *Fetcher {
+	f := &Fetcher{
+		UserAgent:   fetchUserAgent,
+		MaxBodySize: maxFetchSize,
+		robots:      map[string]*robotsRules{},
+	}
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   f.dialControl,
+	}
+	f.Client = &http.Client{
+		Transport: &http.Transport{
+			// A proxy would dial for us, past the address check.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		// Includes reading the body.
+		Timeout: 20 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return ErrTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrUnsupportedScheme
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// Get fetches a page unless its robots.txt disallows it. At most MaxBodySize
+// bytes of the body can be read, the rest is cut off.
+func (f *Fetcher) Get(s string) (*http.Response, error) {
+	return f.Fetch(s, "text/html, */*;q=0.5", f.MaxBodySize)
+}
+
+// Fetch is Get for any kind of content, reading at most limit bytes.
+func (f *Fetcher) Fetch(s, accept string, limit int64) (*http.Response, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+	if ok, err := f.Allowed(u); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrDisallowedByRobots
+	}
+	return f.get(u.String(), accept, limit)
+}
+
+func (f *Fetcher) get(s, accept string, limit int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", s, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	return f.Do(req, limit)
+}
+
+// Do sends a request robots.txt has no say over, such as verifying the source
+// of a webmention or delivering one. The address and redirect checks still
+// apply and at most limit bytes of the body can be read.
+func (f *Fetcher) Do(req *http.Request, limit int64) (*http.Response, error) {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, ErrUnsupportedScheme
+	}
+	req.Header.Set("User-Agent", f.UserAgent)
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		// Let callers compare our own errors.
+		for _, x := range []error{ErrForbiddenAddress, ErrUnsupportedScheme, ErrTooManyRedirects} {
+			if errors.Is(err, x) {
+				return nil, x
+			}
+		}
+		return nil, err
+	}
+	resp.Body = limitedBody{io.LimitReader(resp.Body, limit), resp.Body}
+	return resp, nil
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Allowed tells if robots.txt lets us fetch the URL. The rules of a site are
+// kept for an hour. A site without a robots.txt, or one that can't be read,
+// allows everything.
+func (f *Fetcher) Allowed(u *url.URL) (bool, error) {
+	site := u.Scheme + "://" + u.Host
+	f.mu.Lock()
+	rules, ok := f.robots[site]
+	f.mu.Unlock()
+	if !ok || time.Since(rules.fetched) > robotsTTL {
+		var err error
+		if rules, err = f.fetchRobots(site); err != nil {
+			return false, err
+		}
+		f.mu.Lock()
+		for k, x := range f.robots {
+			if time.Since(x.fetched) > robotsTTL {
+				delete(f.robots, k)
+			}
+		}
+		f.robots[site] = rules
+		f.mu.Unlock()
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return rules.Allowed(path), nil
+}
+
+func (f *Fetcher) fetchRobots(site string) (*robotsRules, error) {
+	resp, err := f.get(site+"/robots.txt", "text/plain", maxRobotsSize)
+	if err == ErrForbiddenAddress {
+		return nil, err
+	} else if err != nil {
+		return &robotsRules{fetched: time.Now()}, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &robotsRules{fetched: time.Now()}, nil
+	}
+	return ParseRobots(resp.Body, robotsAgent), nil
+}
+
+type robotsRule struct {
+	Allow   bool
+	Pattern string
+}
+
+type robotsRules struct {
+	Rules   []robotsRule
+	fetched time.Time
+}
+
+// ParseRobots reads the rules of a robots.txt for the agent, or those for
+// every agent (*) when there are none specific to it.
+func ParseRobots(r io.Reader, agent string) *robotsRules {
+	type group struct {
+		agents []string
+		rules  []robotsRule
+	}
+	var groups []*group
+	var cur *group
+	inAgents := false
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			// Consecutive User-agent lines share their rules.
+			if !inAgents {
+				cur = &group{}
+				groups = append(groups, cur)
+			}
+			cur.agents = append(cur.agents, strings.ToLower(value))
+			inAgents = true
+		case "allow", "disallow":
+			inAgents = false
+			// An empty Disallow allows everything.
+			if cur != nil && value != "" {
+				cur.rules = append(cur.rules, robotsRule{Allow: key == "allow", Pattern: value})
+			}
+		default:
+			inAgents = false
+		}
+	}
+
+	var mine, all []robotsRule
+	found := false
+	for _, g := range groups {
+		for _, a := range g.agents {
+			if a == strings.ToLower(agent) {
+				mine = append(mine, g.rules...)
+				found = true
+			} else if a == "*" {
+				all = append(all, g.rules...)
+			}
+		}
+	}
+	if !found {
+		mine = all
+	}
+	return &robotsRules{Rules: mine, fetched: time.Now()}
+}
+
+// Allowed applies the most specific rule matching the path, allowing on ties.
+func (r *robotsRules) Allowed(path string) bool {
+	allowed, longest := true, -1
+	for _, x := range r.Rules {
+		if !robotsMatch(x.Pattern, path) {
+			continue
+		}
+		if n := len(x.Pattern); n > longest || (n == longest && x.Allow) {
+			allowed, longest = x.Allow, n
+		}
+	}
+	return allowed
+}
+
+// Patterns match by prefix, * matches anything and a trailing $ anchors the
+// end.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	for i, x := range parts {
+		parts[i] = regexp.QuoteMeta(x)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	re, err := regexp.Compile(expr)
+	return err == nil && re.MatchString(path)
+}
+
+// IsNoIndex tells if the directives of a robots meta tag or X-Robots-Tag
+// header ask not to index the page.
+func IsNoIndex(directives string) bool {
+	for _, x := range strings.Split(strings.ToLower(directives), ",") {
+		// The header may name the bot a directive is for, as in "bot: noindex".
+		if i := strings.LastIndex(x, ":"); i >= 0 {
+			x = x[i+1:]
+		}
+		if x = strings.TrimSpace(x); x == "noindex" || x == "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// HasNoIndexMeta looks for <meta name="robots" content="noindex"> in a page.
+func HasNoIndexMeta(doc []byte) bool {
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return false
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			t := z.Token()
+			if t.Data == "body" {
+				return false
+			}
+			if t.Data != "meta" {
+				continue
+			}
+			var name, content string
+			for _, attr := range t.Attr {
+				switch attr.Key {
+				case "name":
+					name = strings.ToLower(attr.Val)
+				case "content":
+					content = attr.Val
+				}
+			}
+			if (name == "robots" || name == robotsAgent) && IsNoIndex(content) {
+				return true
+			}
+		}
+	}
+}
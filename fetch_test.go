@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsForbiddenIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"100.64.0.1", true},
+		{"224.0.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"64:ff9b::a00:1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::", false},
+	}
+	for _, tt := range tests {
+		if got := IsForbiddenIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("IsForbiddenIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// localFetcher fetches from a test server, which the address check of the
+// fetcher's own transport would refuse.
+func localFetcher(srv *httptest.Server) *Fetcher {
+	f := NewFetcher()
+	f.Client.Transport = srv.Client().Transport
+	return f
+}
+
+func TestFetcherGuards(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nDisallow: /private\n")
+		case "/big":
+			fmt.Fprint(w, strings.Repeat("a", 100))
+		case "/file":
+			http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+		default:
+			// /loop/1 redirects to /loop/2 and so on.
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/loop/"))
+			http.Redirect(w, r, fmt.Sprintf("/loop/%d", n+1), http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+
+	// The address is checked when dialing, not when parsing the URL.
+	if _, err := NewFetcher().Get(srv.URL + "/big"); err != ErrForbiddenAddress {
+		t.Errorf("loopback: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+	if _, err := NewFetcher().Get(fmt.Sprintf("http://localhost:%d/big", port)); err != ErrForbiddenAddress {
+		t.Errorf("localhost: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+
+	f := localFetcher(srv)
+	for _, s := range []string{"file:///etc/passwd", "gopher://a.example/"} {
+		if _, err := f.Get(s); err != ErrUnsupportedScheme {
+			t.Errorf("%s: err = %v, want %v", s, err, ErrUnsupportedScheme)
+		}
+	}
+	if _, err := f.Get(srv.URL + "/file"); err != ErrUnsupportedScheme {
+		t.Errorf("redirect to file: err = %v, want %v", err, ErrUnsupportedScheme)
+	}
+	if _, err := f.Get(srv.URL + "/loop/1"); err != ErrTooManyRedirects {
+		t.Errorf("redirect loop: err = %v, want %v", err, ErrTooManyRedirects)
+	}
+	if _, err := f.Get(srv.URL + "/private/page"); err != ErrDisallowedByRobots {
+		t.Errorf("disallowed: err = %v, want %v", err, ErrDisallowedByRobots)
+	}
+
+	f.MaxBodySize = 10
+	resp, err := f.Get(srv.URL + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); len(b) != 10 {
+		t.Errorf("read %d bytes, want 10", len(b))
+	}
+}
+
+func TestParseRobots(t *testing.T) {
+	robots := `# Comment
+User-agent: *
+Disallow: /
+
+User-agent: Googlebot
+User-agent: weblog
+Disallow: /private # inline comment
+Allow: /private/public
+Disallow: /*.pdf$
+Disallow:
+
+User-agent: other
+Allow: /
+`
+	tests := []struct {
+		agent string
+		path  string
+		want  bool
+	}{
+		{"weblog", "/", true},
+		{"weblog", "/private", false},
+		{"weblog", "/private/page", false},
+		{"weblog", "/private/public/page", true},
+		{"weblog", "/doc.pdf", false},
+		{"weblog", "/doc.pdf?x=1", true},
+		{"WEBLOG", "/private", false},
+		{"unknown", "/", false},
+		{"unknown", "/anything", false},
+	}
+	for _, tt := range tests {
+		r := ParseRobots(strings.NewReader(robots), tt.agent)
+		if got := r.Allowed(tt.path); got != tt.want {
+			t.Errorf("%s %s: allowed = %v, want %v", tt.agent, tt.path, got, tt.want)
+		}
+	}
+	if !ParseRobots(strings.NewReader(""), "weblog").Allowed("/") {
+		t.Error("empty robots.txt disallows")
+	}
+}
+
+func TestIsNoIndex(t *testing.T) {
+	tests := []struct {
+		directives string
+		want       bool
+	}{
+		{"", false},
+		{"noindex", true},
+		{"NoIndex, nofollow", true},
+		{"none", true},
+		{"googlebot: noindex", true},
+		{"index, follow", false},
+		{"noarchive", false},
+	}
+	for _, tt := range tests {
+		if got := IsNoIndex(tt.directives); got != tt.want {
+			t.Errorf("IsNoIndex(%q) = %v, want %v", tt.directives, got, tt.want)
+		}
+	}
+	if !HasNoIndexMeta([]byte(`<head><meta name="robots" content="noindex"></head>`)) {
+		t.Error("robots meta tag missed")
+	}
+	if HasNoIndexMeta([]byte(`<body><meta name="robots" content="noindex"></body>`)) {
+		t.Error("meta tag in the body used")
+	}
+}
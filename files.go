@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+)
+
+var (
+	ErrPathEscapes     = errors.New("path is outside the files directory")
+	ErrInvalidFilename = errors.New("invalid file name")
+	ErrFileType        = errors.New("file type is not allowed")
+	ErrFileTooLarge    = errors.New("file is too large")
+	ErrDeleteRoot      = errors.New("refusing to delete the files directory")
+	ErrActiveFile      = errors.New("HTML, SVG and script files can only be uploaded from a logged in session")
+)
+
+// DefaultExtensions are the file types that may be uploaded unless
+// configured otherwise.
+const DefaultExtensions = ".jpg,.jpeg,.png,.gif,.webp,.ico,.pdf,.txt,.mp3,.mp4,.webm,.css,.woff,.woff2,.zip"
+
+// Files a browser runs scripts from when opened. They would run on the blog's
+// own origin, next to the author's session.
+var activeExtensions = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true, ".svg": true, ".js": true, ".mjs": true,
+}
+
+func IsActiveFile(name string) bool {
+	return activeExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// CheckUpload refuses active files unless they come from the author's own
+// session rather than an app holding a media token.
+func CheckUpload(c *gin.Context, name string) error {
+	if IsActiveFile(name) && !IsAuthorized(c) {
+		return ErrActiveFile
+	}
+	return nil
+}
+
+// Media uploads from Micropub clients are limited to these.
+var mediaExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".webm": true,
+}
+
+type FileItem struct {
+	Filename    string
+	Path        string
+	URI         string
+	IsDirectory bool
+}
+
+// FileStore is the assets directory. Every path given to it is resolved
+// inside the directory, after following symlinks, or rejected.
+type FileStore struct {
+	Root       string
+	MaxSize    int64
+	Extensions map[string]bool
+}
+
+func NewFileStore(root string, maxSize int64, extensions string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return nil, err
+	}
+	s := &FileStore{Root: abs, MaxSize: maxSize, Extensions: map[string]bool{}}
+	for _, x := range strings.Split(extensions, ",") {
+		if x = strings.ToLower(strings.TrimSpace(x)); x != "" {
+			if !strings.HasPrefix(x, ".") {
+				x = "." + x
+			}
+			s.Extensions[x] = true
+		}
+	}
+	return s, nil
+}
+
+// evalExisting follows the symlinks in the part of the path that exists.
+func evalExisting(p string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+func (s *FileStore) within(p string) bool {
+	return p == s.Root || strings.HasPrefix(p, s.Root+string(filepath.Separator))
+}
+
+func hasDotDot(p string) bool {
+	for _, x := range strings.Split(strings.ReplaceAll(p, "\\", "/"), "/") {
+		if x == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve turns a slash separated path relative to the files directory into a
+// file system path. ".." is never allowed, and neither is a symlink that leads
+// outside the directory.
+func (s *FileStore) Resolve(p string) (string, error) {
+	if hasDotDot(p) {
+		return "", ErrPathEscapes
+	}
+	full := filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+p)))
+	real, err := evalExisting(full)
+	if err != nil {
+		return "", err
+	}
+	if !s.within(real) {
+		return "", ErrPathEscapes
+	}
+	return full, nil
+}
+
+// resolveEntry resolves the directory holding a path but not the path itself,
+// so a symlink can be removed without touching what it points to.
+func (s *FileStore) resolveEntry(p string) (string, error) {
+	if hasDotDot(p) {
+		return "", ErrPathEscapes
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", ErrDeleteRoot
+	}
+	dir, err := s.Resolve(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, path.Base(p)), nil
+}
+
+// Rel is the public path of a resolved file, as served under /files.
+func (s *FileStore) Rel(full string) string {
+	rel, err := filepath.Rel(s.Root, full)
+	if err != nil || rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._ -]+`)
+
+// SanitizeFilename keeps the base name of an uploaded file and replaces
+// anything unusual in it.
+func SanitizeFilename(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = unsafeFilenameChars.ReplaceAllString(name, "-")
+	name = strings.TrimLeft(strings.TrimSpace(name), ".-")
+	if len(name) > 200 {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = name[:200-len(ext)] + ext
+	}
+	if name == "" || name == "." {
+		return "", ErrInvalidFilename
+	}
+	return name, nil
+}
+
+func (s *FileStore) allowed(name string) bool {
+	return s.Extensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// Save writes an upload into a directory, replacing any file of the same
+// name, and returns its public path.
+func (s *FileStore) Save(dir string, h *multipart.FileHeader) (string, error) {
+	name, err := SanitizeFilename(h.Filename)
+	if err != nil {
+		return "", err
+	}
+	return s.save(dir, name, h)
+}
+
+// SaveMedia stores a Micropub upload in media/YYYY/MM under a generated name.
+func (s *FileStore) SaveMedia(h *multipart.FileHeader) (string, error) {
+	ext := strings.ToLower(filepath.Ext(h.Filename))
+	if !mediaExtensions[ext] {
+		return "", ErrFileType
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return s.save(path.Join("media", time.Now().Format("2006/01")), id.String()+ext, h)
+}
+
+func (s *FileStore) save(dir, name string, h *multipart.FileHeader) (string, error) {
+	if s.MaxSize > 0 && h.Size > s.MaxSize {
+		return "", ErrFileTooLarge
+	}
+	src, err := h.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	return s.Write(dir, name, src)
+}
+
+// Write stores a file in a directory, replacing any file of the same name,
+// and returns its public path.
+func (s *FileStore) Write(dir, name string, src io.Reader) (string, error) {
+	if !s.allowed(name) {
+		return "", ErrFileType
+	}
+	d, err := s.Resolve(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return "", err
+	}
+
+	// Write next to the destination and move it in place once complete.
+	tmp, err := os.CreateTemp(d, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Chmod(0644); err != nil {
+		return "", err
+	}
+	var r io.Reader = src
+	if s.MaxSize > 0 {
+		r = io.LimitReader(src, s.MaxSize+1)
+	}
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return "", err
+	}
+	if s.MaxSize > 0 && n > s.MaxSize {
+		return "", ErrFileTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(d, name)
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return "", err
+	}
+	return s.Rel(dst), nil
+}
+
+func (s *FileStore) Delete(p string) error {
+	full, err := s.resolveEntry(p)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(full); err != nil {
+		return err
+	}
+	return os.RemoveAll(full)
+}
+
+// List walks a directory. Symlinked directories are listed but not entered.
+func (s *FileStore) List(p string) ([]FileItem, error) {
+	dir, err := s.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	var files []FileItem
+	err = filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if name == dir || err != nil {
+			return nil
+		}
+		files = append(files, FileItem{
+			Path:        s.Rel(name),
+			Filename:    info.Name(),
+			IsDirectory: info.IsDir(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// LogFileOperation records who changed which file, and whether it worked.
+func LogFileOperation(db *sql.DB, c *gin.Context, action, p string, opErr error) error {
+	actor := "author"
+	if t := CurrentToken(c); t != nil {
+		actor = "token " + t.ClientID
+	}
+	var msg string
+	if opErr != nil {
+		msg = opErr.Error()
+	}
+	_, err := db.Exec(`
+INSERT INTO file_audit (
+	date,
+	action,
+	path,
+	actor,
+	ip,
+	error
+) VALUES (?, ?, ?, ?, ?, ?)`, time.Now(), action, p, actor, c.ClientIP(), msg)
+	return err
+}
+
+type FileOperation struct {
+	Date   time.Time
+	Action string
+	Path   string
+	Actor  string
+	IP     string
+	Error  string
+}
+
+func (o *FileOperation) DateString() string {
+	return o.Date.Format("January 2006 2 at 03:04:05PM")
+}
+
+// GetFileOperations lists the latest entries of the file audit log.
+func GetFileOperations(db *sql.DB, limit int) ([]*FileOperation, error) {
+	rows, err := db.Query(`
+SELECT
+	date,
+	action,
+	path,
+	actor,
+	ip,
+	error
+FROM file_audit
+ORDER BY id DESC
+LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*FileOperation, 0)
+	for rows.Next() {
+		var o FileOperation
+		if err := rows.Scan(&o.Date, &o.Action, &o.Path, &o.Actor, &o.IP, &o.Error); err != nil {
+			return nil, err
+		}
+		xs = append(xs, &o)
+	}
+	return xs, rows.Err()
+}
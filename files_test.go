@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestFileStoreResolve(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	s, err := NewFileStore(root, 1<<20, DefaultExtensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(s.Root, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(s.Root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(s.Root, "img"), filepath.Join(s.Root, "pictures")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{"/", s.Root, nil},
+		{"img/a.png", filepath.Join(s.Root, "img", "a.png"), nil},
+		{"/img//a.png", filepath.Join(s.Root, "img", "a.png"), nil},
+		{"new/dir/a.png", filepath.Join(s.Root, "new", "dir", "a.png"), nil},
+		// Symlinks are fine as long as they stay inside.
+		{"pictures/a.png", filepath.Join(s.Root, "pictures", "a.png"), nil},
+		{"../etc/passwd", "", ErrPathEscapes},
+		{"img/../../etc/passwd", "", ErrPathEscapes},
+		{`img\..\..\etc\passwd`, "", ErrPathEscapes},
+		{"out", "", ErrPathEscapes},
+		{"out/secret.txt", "", ErrPathEscapes},
+	}
+	for _, tt := range tests {
+		got, err := s.Resolve(tt.path)
+		if err != tt.err || got != tt.want {
+			t.Errorf("Resolve(%q) = %q, %v, want %q, %v", tt.path, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{"photo.jpg", "photo.jpg", nil},
+		{"My Photo (1).jpg", "My Photo -1-.jpg", nil},
+		{"../../etc/passwd", "passwd", nil},
+		{`C:\Users\me\cv.pdf`, "cv.pdf", nil},
+		{".htaccess", "htaccess", nil},
+		{"résumé.pdf", "r-sum-.pdf", nil},
+		{"..", "", ErrInvalidFilename},
+		{"/", "", ErrInvalidFilename},
+		{"", "", ErrInvalidFilename},
+	}
+	for _, tt := range tests {
+		got, err := SanitizeFilename(tt.name)
+		if err != tt.err || got != tt.want {
+			t.Errorf("SanitizeFilename(%q) = %q, %v, want %q, %v", tt.name, got, err, tt.want, tt.err)
+		}
+	}
+	long := ""
+	for i := 0; i < 300; i++ {
+		long += "a"
+	}
+	if got, _ := SanitizeFilename(long + ".png"); len(got) != 200 || filepath.Ext(got) != ".png" {
+		t.Errorf("long name cut to %d characters: %q", len(got), got)
+	}
+}
+
+func TestCheckUpload(t *testing.T) {
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	var errs []error
+	r.GET("/", func(c *gin.Context) {
+		if c.Query("session") != "" {
+			sessions.Default(c).Set("authed", true)
+		} else {
+			c.Set("token", &AccessToken{Scope: "media"})
+		}
+		for _, name := range []string{"photo.JPG", "page.html", "icon.SVG", "app.js"} {
+			errs = append(errs, CheckUpload(c, name))
+		}
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	want := []error{nil, ErrActiveFile, ErrActiveFile, ErrActiveFile}
+	for i, err := range errs {
+		if err != want[i] {
+			t.Errorf("token upload %d: err = %v, want %v", i, err, want[i])
+		}
+	}
+
+	errs = nil
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?session=1", nil))
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("session upload %d: %s", i, err)
+		}
+	}
+}
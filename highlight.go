@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrUnknownTheme = errors.New("unknown code theme")
+)
+
+const DefaultCodeTheme = "github"
+
+// A code block's language comes from its language-xxx class, which may carry
+// options in braces: linenos for line numbers and line ranges to highlight,
+// as in language-go{linenos,3-5,8}. In Markdown that's ```go{linenos,3-5,8}.
+var languageClass = regexp.MustCompile(`^language-([A-Za-z0-9_+#.-]+)(?:\{([^}]*)\})?$`)
+
+type codeBlock struct {
+	Language string
+	LineNos  bool
+	Lines    [][2]int
+}
+
+func parseCodeClass(class string) (*codeBlock, bool) {
+	for _, x := range strings.Fields(class) {
+		m := languageClass.FindStringSubmatch(x)
+		if m == nil {
+			continue
+		}
+		b := codeBlock{Language: m[1]}
+		for _, opt := range strings.Split(m[2], ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "linenos" {
+				b.LineNos = true
+				continue
+			}
+			from, to, isRange := strings.Cut(opt, "-")
+			if !isRange {
+				to = from
+			}
+			i, err1 := strconv.Atoi(from)
+			j, err2 := strconv.Atoi(to)
+			if err1 == nil && err2 == nil && i > 0 && j >= i {
+				b.Lines = append(b.Lines, [2]int{i, j})
+			}
+		}
+		return &b, true
+	}
+	return nil, false
+}
+
+func (b *codeBlock) highlight(code string) (string, error) {
+	lexer := lexers.Get(b.Language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return "", err
+	}
+	f := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.WithLineNumbers(b.LineNos),
+		chromahtml.HighlightLines(b.Lines),
+	)
+	var out bytes.Buffer
+	// With classes the style only matters for the stylesheet, see CodeCSS.
+	if err := f.Format(&out, styles.Fallback, it); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// HighlightCode replaces the <pre><code class="language-xxx"> blocks of a
+// body with highlighted ones, marked up with CSS classes only. Blocks without
+// a language are left as they are.
+func HighlightCode(body string) (string, error) {
+	var out, raw, code strings.Builder
+	var block *codeBlock
+	// 0 outside a block, 1 after <pre>, 2 in <code>, 3 after </code>.
+	state := 0
+	flush := func() {
+		out.WriteString(raw.String())
+		raw.Reset()
+		code.Reset()
+		state = 0
+	}
+	z := xhtml.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			flush()
+			return out.String(), nil
+		}
+		text := string(z.Raw())
+		name, hasAttr := z.TagName()
+		blank := tt == xhtml.TextToken && strings.TrimSpace(text) == ""
+		switch {
+		case state == 0 && tt == xhtml.StartTagToken && string(name) == "pre":
+			raw.WriteString(text)
+			state = 1
+			continue
+		case state == 1 && blank:
+			raw.WriteString(text)
+			continue
+		case state == 1 && tt == xhtml.StartTagToken && string(name) == "code":
+			raw.WriteString(text)
+			// TagName was read already, so Token would miss the attributes.
+			var class string
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) == "class" {
+					class = string(val)
+				}
+			}
+			var ok bool
+			if block, ok = parseCodeClass(class); ok {
+				state = 2
+			} else {
+				flush()
+			}
+			continue
+		case state == 2 && tt == xhtml.EndTagToken && string(name) == "code":
+			raw.WriteString(text)
+			state = 3
+			continue
+		case state == 2:
+			raw.WriteString(text)
+			if tt == xhtml.TextToken {
+				code.Write(z.Text())
+			}
+			continue
+		case state == 3 && blank:
+			raw.WriteString(text)
+			continue
+		case state == 3 && tt == xhtml.EndTagToken && string(name) == "pre":
+			s, err := block.highlight(code.String())
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(s)
+			raw.Reset()
+			code.Reset()
+			state = 0
+			continue
+		case state != 0:
+			flush()
+		}
+		out.WriteString(text)
+	}
+}
+
+// CodeCSS is the stylesheet of a theme for highlighted code.
+func CodeCSS(theme string) ([]byte, error) {
+	style, ok := styles.Registry[theme]
+	if !ok {
+		return nil, ErrUnknownTheme
+	}
+	var b bytes.Buffer
+	if err := chromahtml.New(chromahtml.WithClasses(true)).WriteCSS(&b, style); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCodeClass(t *testing.T) {
+	tests := []struct {
+		class string
+		want  *codeBlock
+	}{
+		{"", nil},
+		{"go", nil},
+		{"lang-go", nil},
+		{"language-go", &codeBlock{Language: "go"}},
+		{"block language-c++ wide", &codeBlock{Language: "c++"}},
+		{"language-go{linenos}", &codeBlock{Language: "go", LineNos: true}},
+		{"language-go{linenos,3-5,8}", &codeBlock{Language: "go", LineNos: true, Lines: [][2]int{{3, 5}, {8, 8}}}},
+		// Invalid ranges are dropped.
+		{"language-go{5-3,0,x,-2,4-}", &codeBlock{Language: "go"}},
+		{"language-go{3-5", nil},
+		{`language-go"onclick`, nil},
+	}
+	for _, tt := range tests {
+		got, ok := parseCodeClass(tt.class)
+		if ok != (tt.want != nil) || (ok && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("parseCodeClass(%q) = %+v, %v, want %+v", tt.class, got, ok, tt.want)
+		}
+	}
+}
+
+func TestHighlightCode(t *testing.T) {
+	plain := `<p>Hi</p><pre><code>x := 1</code></pre><pre>no code</pre><code class="language-go">inline</code>`
+	got, err := HighlightCode(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != plain {
+		t.Errorf("blocks without a language changed: %s", got)
+	}
+
+	got, err = HighlightCode("<p>Hi</p>\n<pre>\n<code class=\"language-go\">x := &quot;&lt;b&gt;&quot;\n</code>\n</pre><p>Bye</p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "<p>Hi</p>\n<pre") || !strings.HasSuffix(got, "</pre><p>Bye</p>") {
+		t.Errorf("surroundings changed: %s", got)
+	}
+	if !strings.Contains(got, `class="chroma"`) || !strings.Contains(got, "&lt;b&gt;") || strings.Contains(got, "<b>") {
+		t.Errorf("not highlighted or not escaped: %s", got)
+	}
+}
+
+func TestCodeCSS(t *testing.T) {
+	if css, err := CodeCSS(DefaultCodeTheme); err != nil || !strings.Contains(string(css), ".chroma") {
+		t.Errorf("%s: %s", DefaultCodeTheme, err)
+	}
+	if _, err := CodeCSS("nope"); err != ErrUnknownTheme {
+		t.Errorf("unknown theme: err = %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	ErrUnknownCacheAction = errors.New("cache action must be purge or prewarm")
+	ErrCacheBusy          = errors.New("the image cache is too small for the images being served")
+)
+
+// ImageCache keeps resized images in their own directory, named after the
+// checksum of the original and the options, so replacing an original never
+// serves a stale variant. The least recently used variants are removed once
+// the cache grows past MaxSize.
+type ImageCache struct {
+	Dir     string
+	MaxSize int64
+
+	group singleflight.Group
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *cacheEntry, most recently used first
+	items map[string]*list.Element
+	sums  map[string]sourceSum
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+// sourceSum remembers the checksum of an original until it changes.
+type sourceSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func NewImageCache(dir string, maxSize int64) (*ImageCache, error) {
+	ic := &ImageCache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+		sums:    make(map[string]sourceSum),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return ic, ic.load()
+}
+
+// load rebuilds the LRU order from the modification times, which are bumped
+// whenever a variant is served.
+func (ic *ImageCache) load() error {
+	type file struct {
+		name string
+		info os.FileInfo
+	}
+	var xs []file
+	err := filepath.Walk(ic.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			os.Remove(name)
+			return nil
+		}
+		xs = append(xs, file{name, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		return xs[i].info.ModTime().After(xs[j].info.ModTime())
+	})
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	for _, x := range xs {
+		ic.items[x.name] = ic.lru.PushBack(&cacheEntry{x.name, x.info.Size()})
+		ic.size += x.info.Size()
+	}
+	ic.evict()
+	return nil
+}
+
+func (ic *ImageCache) checksum(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	ic.mu.Lock()
+	s, ok := ic.sums[filename]
+	ic.mu.Unlock()
+	if ok && s.size == info.Size() && s.modTime.Equal(info.ModTime()) {
+		return s.sum, nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	ic.mu.Lock()
+	ic.sums[filename] = sourceSum{info.Size(), info.ModTime(), sum}
+	ic.mu.Unlock()
+	return sum, nil
+}
+
+func (ic *ImageCache) path(sum, variant string) string {
+	return filepath.Join(ic.Dir, sum[:2], sum+"-"+variant)
+}
+
+// touch marks a variant as used, reporting whether it's cached.
+func (ic *ImageCache) touch(name string) bool {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	e, ok := ic.items[name]
+	if !ok {
+		return false
+	}
+	ic.lru.MoveToFront(e)
+	now := time.Now()
+	os.Chtimes(name, now, now)
+	return true
+}
+
+func (ic *ImageCache) add(name string, size int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if e, ok := ic.items[name]; ok {
+		ic.size -= e.Value.(*cacheEntry).size
+		ic.lru.Remove(e)
+	}
+	ic.items[name] = ic.lru.PushFront(&cacheEntry{name, size})
+	ic.size += size
+	ic.evict()
+}
+
+func (ic *ImageCache) remove(e *list.Element) {
+	x := e.Value.(*cacheEntry)
+	os.Remove(x.name)
+	ic.lru.Remove(e)
+	delete(ic.items, x.name)
+	ic.size -= x.size
+}
+
+// evict drops the least recently used variants until the cache fits, always
+// keeping the newest one. The lock must be held.
+func (ic *ImageCache) evict() {
+	for ic.MaxSize > 0 && ic.size > ic.MaxSize && ic.lru.Len() > 1 {
+		ic.remove(ic.lru.Back())
+	}
+}
+
+// Get returns the file of a variant, generating it if needed. Concurrent
+// requests for the same variant wait for a single generation.
+func (ic *ImageCache) Get(filename string, o *ImageOptions) (string, error) {
+	return ic.get(filename, o.Key()+o.Ext(), func(w io.Writer) error {
+		img, err := imaging.Open(filename, imaging.AutoOrientation(true))
+		if err != nil {
+			return err
+		}
+		return o.Encode(w, o.Apply(img))
+	})
+}
+
+// Stripped returns a copy of a JPEG without its metadata, see StripMetadata.
+func (ic *ImageCache) Stripped(filename string) (string, error) {
+	return ic.get(filename, "stripped.jpg", func(w io.Writer) error {
+		return StripMetadata(filename, w)
+	})
+}
+
+// Open is Get with the variant opened for reading. It is opened under the
+// lock, so eviction can't remove it between being found and being served.
+func (ic *ImageCache) Open(filename string, o *ImageOptions) (*os.File, error) {
+	return ic.open(func() (string, error) { return ic.Get(filename, o) })
+}
+
+// OpenStripped is Stripped with the copy opened for reading, see Open.
+func (ic *ImageCache) OpenStripped(filename string) (*os.File, error) {
+	return ic.open(func() (string, error) { return ic.Stripped(filename) })
+}
+
+func (ic *ImageCache) open(get func() (string, error)) (*os.File, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		name, err := get()
+		if err != nil {
+			return nil, err
+		}
+		ic.mu.Lock()
+		_, ok := ic.items[name]
+		var f *os.File
+		if ok {
+			f, err = os.Open(name)
+		}
+		ic.mu.Unlock()
+		if ok {
+			return f, err
+		}
+		// Evicted right away by a busy cache, generate it once more.
+	}
+	return nil, ErrCacheBusy
+}
+
+// ServeFile sends an open file, answering range and conditional requests, and
+// closes it.
+func ServeFile(c *gin.Context, f *os.File) {
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+	http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+}
+
+func (ic *ImageCache) get(filename, variant string, generate func(w io.Writer) error) (string, error) {
+	sum, err := ic.checksum(filename)
+	if err != nil {
+		return "", err
+	}
+	name := ic.path(sum, variant)
+	if ic.touch(name) {
+		return name, nil
+	}
+	_, err, _ = ic.group.Do(name, func() (interface{}, error) {
+		if ic.touch(name) {
+			return nil, nil
+		}
+		return nil, ic.write(name, generate)
+	})
+	return name, err
+}
+
+func (ic *ImageCache) write(name string, generate func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := generate(&buf); err != nil {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	ic.add(name, int64(buf.Len()))
+	return nil
+}
+
+// Invalidate drops the variants of an original, or of every original below a
+// directory, after it was replaced or deleted.
+func (ic *ImageCache) Invalidate(filename string) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	for source, s := range ic.sums {
+		if source != filename && !strings.HasPrefix(source, filename+string(filepath.Separator)) {
+			continue
+		}
+		prefix := filepath.Join(ic.Dir, s.sum[:2], s.sum+"-")
+		for name, e := range ic.items {
+			if strings.HasPrefix(name, prefix) {
+				ic.remove(e)
+			}
+		}
+		delete(ic.sums, source)
+	}
+}
+
+// Purge empties the cache.
+func (ic *ImageCache) Purge() error {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	entries, err := os.ReadDir(ic.Dir)
+	if err != nil {
+		return err
+	}
+	for _, x := range entries {
+		if err := os.RemoveAll(filepath.Join(ic.Dir, x.Name())); err != nil {
+			return err
+		}
+	}
+	ic.lru.Init()
+	ic.items = make(map[string]*list.Element)
+	ic.size = 0
+	return nil
+}
+
+// Size is the number of variants and the bytes they take.
+func (ic *ImageCache) Size() (int, int64) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.lru.Len(), ic.size
+}
+
+// Prewarm generates the variants posts ask for, see Pictures, for every image
+// in the media library.
+func (ic *ImageCache) Prewarm(db *sql.DB, files *FileStore) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	media, err := GetMedia(tx, false)
+	tx.Rollback()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range media {
+		format := imageFormats[strings.ToLower(filepath.Ext(m.Path))]
+		if format == "" || format == "gif" {
+			continue
+		}
+		filename, err := files.Resolve(m.Path)
+		if err != nil {
+			continue
+		}
+		for _, w := range SrcsetWidths {
+			for _, f := range []string{format, "webp"} {
+				o := &ImageOptions{Width: w, Mode: "fit", Anchor: "center", Quality: DefaultImageQuality, Format: f}
+				if _, err := ic.Get(filename, o); err != nil {
+					log.Printf("prewarm %s: %s", m.Path, err)
+					continue
+				}
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Resized images used to be written next to their originals, as
+// name_SIZE_.ext for name.ext.
+var legacyThumbnail = regexp.MustCompile(`^(.+)_\d+_(\.(?i:jpe?g|png))$`)
+
+// isLegacyThumbnail only matches files whose original is still next to them,
+// so an upload that happens to look like one is left alone.
+func isLegacyThumbnail(name string) bool {
+	m := legacyThumbnail.FindStringSubmatch(filepath.Base(name))
+	if m == nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(filepath.Dir(name), m[1]+m[2]))
+	return err == nil && !info.IsDir()
+}
+
+// PurgeLegacyThumbnails removes resized images left in the files directory by
+// older versions.
+func PurgeLegacyThumbnails(files *FileStore) (int, error) {
+	n := 0
+	err := filepath.Walk(files.Root, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isLegacyThumbnail(name) {
+			return nil
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPurgeLegacyThumbnails(t *testing.T) {
+	files, err := NewFileStore(t.TempDir(), 1<<20, DefaultExtensions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{
+		"photo.jpg",
+		"photo_300_.jpg",
+		"sub/cat.PNG",
+		"sub/cat_1024_.PNG",
+		// No original next to them, these are uploads.
+		"IMG_2023_.jpg",
+		"scan_1_.png",
+		".photo.w300-h200-fit.jpg",
+		"notes_2_.txt",
+	}
+	for _, x := range names {
+		name := filepath.Join(files.Root, filepath.FromSlash(x))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := PurgeLegacyThumbnails(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("purged %d files, want 2", n)
+	}
+	for _, x := range names {
+		_, err := os.Stat(filepath.Join(files.Root, filepath.FromSlash(x)))
+		gone := os.IsNotExist(err)
+		if want := x == "photo_300_.jpg" || x == "sub/cat_1024_.PNG"; gone != want {
+			t.Errorf("%s: removed = %v, want %v", x, gone, want)
+		}
+	}
+}
+
+func TestImageCacheOpen(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, "a.png")
+	f, err := os.Create(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Room for a single variant, each one evicts the one before.
+	cache, err := NewImageCache(filepath.Join(dir, "cache"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := &ImageOptions{Width: 16, Mode: "fit", Anchor: "center", Quality: DefaultImageQuality, Format: "png"}
+	f, err = cache.Open(original, small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	large := &ImageOptions{Width: 32, Mode: "fit", Anchor: "center", Quality: DefaultImageQuality, Format: "png"}
+	if _, err := cache.Get(original, large); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Fatalf("small variant wasn't evicted: %v", err)
+	}
+	// The open file can still be served.
+	img, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := img.Bounds().Dx(); w != 16 {
+		t.Errorf("served a %dpx wide variant", w)
+	}
+}
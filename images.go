@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrImageSize    = errors.New("image size is not one of the allowed sizes")
+	ErrImageMode    = errors.New("image mode must be fit or fill")
+	ErrImageAnchor  = errors.New("unknown image anchor")
+	ErrImageQuality = errors.New("image quality is not one of the allowed qualities")
+	ErrImageFormat  = errors.New("image format must be jpeg, png, webp or gif")
+)
+
+// Only these widths and heights are generated, so that the cache can't be
+// filled with every size imaginable.
+var ImageSizes = []int{32, 64, 128, 256, 320, 480, 640, 800, 1024, 1280, 1600, 1920}
+
+var ImageQualities = []int{50, 60, 70, 75, 80, 85, 90, 95}
+
+const DefaultImageQuality = 85
+
+// Widths offered in srcset for images in posts.
+var SrcsetWidths = []int{320, 640, 1024, 1600}
+
+var imageAnchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
+var imageFormats = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".webp": "webp",
+}
+
+func IsImage(info os.FileInfo) bool {
+	_, ok := imageFormats[strings.ToLower(filepath.Ext(info.Name()))]
+	return ok
+}
+
+// ImageOptions describe how to resize and encode an image:
+//
+//	w, h     width and height, one of ImageSizes (size=N sets both)
+//	mode     fit (default) keeps the whole image, fill crops to w×h
+//	anchor   which part to keep when filling, e.g. center, top, bottomright
+//	q        JPEG and WebP quality, one of ImageQualities
+//	format   jpeg, png, webp or gif, the original's format by default
+type ImageOptions struct {
+	Width   int
+	Height  int
+	Mode    string
+	Anchor  string
+	Quality int
+	Format  string
+}
+
+// HasImageOptions tells if a request for an image asks for a variant of it.
+func HasImageOptions(q url.Values) bool {
+	for _, k := range []string{"size", "w", "h", "mode", "anchor", "q", "format"} {
+		if _, ok := q[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isAllowed(xs []int, x int) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+func ParseImageOptions(q url.Values, filename string) (*ImageOptions, error) {
+	o := ImageOptions{
+		Mode:    "fit",
+		Anchor:  "center",
+		Quality: DefaultImageQuality,
+		Format:  imageFormats[strings.ToLower(filepath.Ext(filename))],
+	}
+	atoi := func(k string) (int, error) {
+		if s := q.Get(k); s != "" {
+			return strconv.Atoi(s)
+		}
+		return 0, nil
+	}
+	var err error
+	if o.Width, err = atoi("size"); err != nil {
+		return nil, ErrImageSize
+	}
+	o.Height = o.Width
+	if w, err := atoi("w"); err != nil {
+		return nil, ErrImageSize
+	} else if w != 0 {
+		o.Width = w
+	}
+	if h, err := atoi("h"); err != nil {
+		return nil, ErrImageSize
+	} else if h != 0 {
+		o.Height = h
+	}
+	if (o.Width != 0 && !isAllowed(ImageSizes, o.Width)) || (o.Height != 0 && !isAllowed(ImageSizes, o.Height)) {
+		return nil, ErrImageSize
+	}
+	if s := q.Get("mode"); s != "" {
+		o.Mode = s
+	}
+	if o.Mode != "fit" && o.Mode != "fill" {
+		return nil, ErrImageMode
+	}
+	if o.Mode == "fill" && (o.Width == 0 || o.Height == 0) {
+		return nil, ErrImageSize
+	}
+	if s := q.Get("anchor"); s != "" {
+		o.Anchor = s
+	}
+	if _, ok := imageAnchors[o.Anchor]; !ok {
+		return nil, ErrImageAnchor
+	}
+	if q.Get("q") != "" {
+		if o.Quality, err = atoi("q"); err != nil || !isAllowed(ImageQualities, o.Quality) {
+			return nil, ErrImageQuality
+		}
+	}
+	if s := q.Get("format"); s != "" {
+		o.Format = s
+	}
+	switch o.Format {
+	case "jpeg", "png", "webp", "gif":
+	default:
+		return nil, ErrImageFormat
+	}
+	return &o, nil
+}
+
+// Key names the variant in the cache.
+func (o *ImageOptions) Key() string {
+	key := fmt.Sprintf("w%d-h%d-%s", o.Width, o.Height, o.Mode)
+	if o.Mode == "fill" {
+		key += "-" + o.Anchor
+	}
+	if o.Format == "jpeg" || o.Format == "webp" {
+		key += fmt.Sprintf("-q%d", o.Quality)
+	}
+	return key
+}
+
+func (o *ImageOptions) Ext() string {
+	if o.Format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + o.Format
+}
+
+func (o *ImageOptions) Apply(img image.Image) image.Image {
+	switch {
+	case o.Mode == "fill":
+		return imaging.Fill(img, o.Width, o.Height, imageAnchors[o.Anchor], imaging.Lanczos)
+	case o.Width != 0 && o.Height != 0:
+		return imaging.Fit(img, o.Width, o.Height, imaging.Lanczos)
+	case o.Width != 0 && img.Bounds().Dx() > o.Width:
+		return imaging.Resize(img, o.Width, 0, imaging.Lanczos)
+	case o.Height != 0 && img.Bounds().Dy() > o.Height:
+		return imaging.Resize(img, 0, o.Height, imaging.Lanczos)
+	}
+	return img
+}
+
+func (o *ImageOptions) Encode(w io.Writer, img image.Image) error {
+	switch o.Format {
+	case "jpeg":
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(o.Quality))
+	case "png":
+		return imaging.Encode(w, img, imaging.PNG)
+	case "gif":
+		return imaging.Encode(w, img, imaging.GIF)
+	case "webp":
+		return webp.Encode(w, img, &webp.Options{Quality: float32(o.Quality)})
+	}
+	return ErrImageFormat
+}
+
+// Srcset lists the widths of an image in /files for a srcset attribute,
+// optionally converted to a format.
+func Srcset(src string, format ...string) template.Srcset {
+	var xs []string
+	for _, w := range SrcsetWidths {
+		s := fmt.Sprintf("%s?w=%d", src, w)
+		if len(format) > 0 && format[0] != "" {
+			s += "&format=" + url.QueryEscape(format[0])
+		}
+		xs = append(xs, fmt.Sprintf("%s %dw", s, w))
+	}
+	return template.Srcset(strings.Join(xs, ", "))
+}
+
+// srcsetSizes assumes images span the content column, see main.css.
+const srcsetSizes = "(max-width: 8in) 100vw, 8in"
+
+// Pictures rewrites the images of a post body that are stored in /files into
+// <picture> elements offering WebP and several widths. Other markup is left
+// as it is.
+func Pictures(body template.HTML) template.HTML {
+	var out strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(string(body)))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		if tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+			out.WriteString(raw)
+			continue
+		}
+		t := z.Token()
+		if t.Data != "img" {
+			out.WriteString(raw)
+			continue
+		}
+		var src string
+		skip := false
+		for _, attr := range t.Attr {
+			switch attr.Key {
+			case "src":
+				src = attr.Val
+			case "srcset":
+				skip = true
+			}
+		}
+		u, err := url.Parse(src)
+		ext := ""
+		if err == nil {
+			ext = strings.ToLower(filepath.Ext(u.Path))
+		}
+		// GIFs may be animated, which resizing would lose.
+		if skip || err != nil || u.Host != "" || u.RawQuery != "" || !strings.HasPrefix(u.Path, "/files/") || imageFormats[ext] == "" || ext == ".gif" {
+			out.WriteString(raw)
+			continue
+		}
+		out.WriteString(`<picture><source type="image/webp" srcset="`)
+		out.WriteString(xhtml.EscapeString(string(Srcset(u.Path, "webp"))))
+		out.WriteString(`" sizes="` + srcsetSizes + `"><img`)
+		for _, attr := range t.Attr {
+			fmt.Fprintf(&out, ` %s="%s"`, attr.Key, xhtml.EscapeString(attr.Val))
+		}
+		out.WriteString(` srcset="`)
+		out.WriteString(xhtml.EscapeString(string(Srcset(u.Path))))
+		out.WriteString(`" sizes="` + srcsetSizes + `"></picture>`)
+	}
+	return template.HTML(out.String())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseImageOptions(t *testing.T) {
+	tests := []struct {
+		query    string
+		filename string
+		want     ImageOptions
+		err      error
+	}{
+		{"size=320", "a.JPG", ImageOptions{320, 320, "fit", "center", DefaultImageQuality, "jpeg"}, nil},
+		{"w=640", "a.png", ImageOptions{640, 0, "fit", "center", DefaultImageQuality, "png"}, nil},
+		{"size=320&h=640", "a.png", ImageOptions{320, 640, "fit", "center", DefaultImageQuality, "png"}, nil},
+		{"w=256&h=128&mode=fill&anchor=topleft&q=60&format=webp", "a.png", ImageOptions{256, 128, "fill", "topleft", 60, "webp"}, nil},
+		// Converting is the only way to get a variant of a format that can't be
+		// resized.
+		{"format=png", "a.bmp", ImageOptions{0, 0, "fit", "center", DefaultImageQuality, "png"}, nil},
+		{"format=jpeg", "", ImageOptions{0, 0, "fit", "center", DefaultImageQuality, "jpeg"}, nil},
+		{"size=321", "a.png", ImageOptions{}, ErrImageSize},
+		{"w=abc", "a.png", ImageOptions{}, ErrImageSize},
+		{"h=-64", "a.png", ImageOptions{}, ErrImageSize},
+		{"size=100000", "a.png", ImageOptions{}, ErrImageSize},
+		{"w=320&mode=fill", "a.png", ImageOptions{}, ErrImageSize},
+		{"mode=stretch", "a.png", ImageOptions{}, ErrImageMode},
+		{"size=64&mode=fill&anchor=middle", "a.png", ImageOptions{}, ErrImageAnchor},
+		{"q=101", "a.jpg", ImageOptions{}, ErrImageQuality},
+		{"q=x", "a.jpg", ImageOptions{}, ErrImageQuality},
+		{"format=bmp", "a.png", ImageOptions{}, ErrImageFormat},
+		{"size=64", "a.bmp", ImageOptions{}, ErrImageFormat},
+	}
+	for _, tt := range tests {
+		q, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := ParseImageOptions(q, tt.filename)
+		if err != tt.err {
+			t.Errorf("%s %s: err = %v, want %v", tt.query, tt.filename, err, tt.err)
+		} else if err == nil && *o != tt.want {
+			t.Errorf("%s %s: got %+v, want %+v", tt.query, tt.filename, *o, tt.want)
+		}
+	}
+}
+
+func TestImageOptionsKey(t *testing.T) {
+	tests := []struct {
+		o    ImageOptions
+		want string
+	}{
+		{ImageOptions{320, 0, "fit", "top", 85, "png"}, "w320-h0-fit"},
+		{ImageOptions{320, 320, "fill", "top", 85, "png"}, "w320-h320-fill-top"},
+		{ImageOptions{320, 0, "fit", "center", 60, "jpeg"}, "w320-h0-fit-q60"},
+		{ImageOptions{320, 320, "fill", "center", 70, "webp"}, "w320-h320-fill-center-q70"},
+	}
+	for _, tt := range tests {
+		if got := tt.o.Key(); got != tt.want {
+			t.Errorf("Key of %+v = %s, want %s", tt.o, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidClient      = errors.New("invalid client_id")
+	ErrInvalidRedirect    = errors.New("redirect_uri is not allowed for this client")
+	ErrInvalidAuthRequest = errors.New("invalid authorization request")
+	ErrInvalidGrant       = errors.New("invalid or expired authorization code")
+	ErrTokenNotFound      = errors.New("token not found")
+)
+
+const (
+	// AuthCodeLifetime is how long a client has to redeem an authorization code.
+	AuthCodeLifetime = 10 * time.Minute
+	// Clients have to ask the author again after this, see -tokenLifetime.
+	DefaultTokenLifetime = 90 * 24 * time.Hour
+)
+
+// Scopes a client can ask for, with the description shown when approving.
+var Scopes = []struct {
+	Name        string
+	Description string
+}{
+	{"create", "Create new posts"},
+	{"update", "Edit posts"},
+	{"delete", "Delete posts"},
+	{"undelete", "Restore deleted posts"},
+	{"media", "Upload files"},
+	{"profile", "See your profile"},
+}
+
+func IsValidScope(s string) bool {
+	for _, x := range Scopes {
+		if x.Name == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanScope drops unknown and duplicate scopes.
+func CleanScope(xs []string) string {
+	var res []string
+	seen := map[string]bool{}
+	for _, x := range xs {
+		if IsValidScope(x) && !seen[x] {
+			seen[x] = true
+			res = append(res, x)
+		}
+	}
+	return strings.Join(res, " ")
+}
+
+func hasScope(scope, s string) bool {
+	for _, x := range strings.Fields(scope) {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthRequest is an authorization request from an IndieAuth client, see
+// https://indieauth.spec.indieweb.org/#authorization-request
+type AuthRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Scope               string
+	Me                  string
+}
+
+func AuthRequestFrom(get func(string) string) *AuthRequest {
+	return &AuthRequest{
+		ResponseType:        get("response_type"),
+		ClientID:            get("client_id"),
+		RedirectURI:         get("redirect_uri"),
+		State:               get("state"),
+		CodeChallenge:       get("code_challenge"),
+		CodeChallengeMethod: get("code_challenge_method"),
+		Scope:               get("scope"),
+		Me:                  get("me"),
+	}
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Fragment == ""
+}
+
+func sameOrigin(a, b string) bool {
+	x, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	y, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return x.Scheme == y.Scheme && strings.EqualFold(x.Host, y.Host)
+}
+
+// Validate checks the request can be redirected back to. PKCE with S256 is
+// required.
+func (r *AuthRequest) Validate() error {
+	if !isHTTPURL(r.ClientID) {
+		return ErrInvalidClient
+	}
+	if !isHTTPURL(r.RedirectURI) {
+		return ErrInvalidRedirect
+	}
+	if r.ResponseType != "code" || r.CodeChallenge == "" || r.CodeChallengeMethod != "S256" {
+		return ErrInvalidAuthRequest
+	}
+	return nil
+}
+
+// VerifyRedirectURI allows redirect URIs on the client's own origin, and
+// others only if the client_id page lists them with rel="redirect_uri".
+func VerifyRedirectURI(f *Fetcher, r *AuthRequest) error {
+	if sameOrigin(r.ClientID, r.RedirectURI) {
+		return nil
+	}
+	xs, err := DiscoverLinks(f, r.ClientID, "redirect_uri")
+	if err != nil {
+		return err
+	}
+	for _, x := range xs {
+		if x == r.RedirectURI {
+			return nil
+		}
+	}
+	return ErrInvalidRedirect
+}
+
+// randomToken returns a random URL safe string for codes and tokens. Only its
+// hash is stored.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// AuthCode is an approved authorization request waiting to be redeemed.
+type AuthCode struct {
+	ClientID      string
+	RedirectURI   string
+	Scope         string
+	CodeChallenge string
+	Me            string
+	Expires       time.Time
+}
+
+func CreateAuthCode(tx *sql.Tx, r *AuthRequest, scope, me string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	stmt, err := tx.Prepare(`
+INSERT INTO auth_code (
+	code,
+	client_id,
+	redirect_uri,
+	scope,
+	code_challenge,
+	me,
+	expires
+) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return "", err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(hashToken(code), r.ClientID, r.RedirectURI, scope, r.CodeChallenge, me, time.Now().Add(AuthCodeLifetime))
+	return code, err
+}
+
+// RedeemAuthCode uses up an authorization code. The client has to present the
+// same client_id and redirect_uri it was issued for and the PKCE verifier.
+func RedeemAuthCode(tx *sql.Tx, code, clientID, redirectURI, verifier string) (*AuthCode, error) {
+	var a AuthCode
+	err := tx.QueryRow(`
+SELECT
+	client_id,
+	redirect_uri,
+	scope,
+	code_challenge,
+	me,
+	expires
+FROM auth_code
+WHERE code = ?`, hashToken(code)).Scan(&a.ClientID, &a.RedirectURI, &a.Scope, &a.CodeChallenge, &a.Me, &a.Expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidGrant
+	} else if err != nil {
+		return nil, err
+	}
+	// Codes are single use, whether or not this attempt succeeds.
+	if _, err := tx.Exec(`DELETE FROM auth_code WHERE code = ? OR expires < ?`, hashToken(code), time.Now()); err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(h[:])
+	if time.Now().After(a.Expires) ||
+		a.ClientID != clientID ||
+		a.RedirectURI != redirectURI ||
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(a.CodeChallenge)) != 1 {
+		return nil, ErrInvalidGrant
+	}
+	return &a, nil
+}
+
+// AccessToken is a bearer token issued to a client.
+type AccessToken struct {
+	ID         int64
+	ClientID   string
+	Scope      string
+	Me         string
+	DateIssued time.Time
+	Expires    time.Time
+}
+
+func (t *AccessToken) HasScope(scope string) bool {
+	return hasScope(t.Scope, scope)
+}
+
+func CreateAccessToken(tx *sql.Tx, a *AuthCode, lifetime time.Duration) (string, *AccessToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	t := AccessToken{
+		ClientID:   a.ClientID,
+		Scope:      a.Scope,
+		Me:         a.Me,
+		DateIssued: now,
+		Expires:    now.Add(lifetime),
+	}
+	stmt, err := tx.Prepare(`
+INSERT INTO access_token (
+	token,
+	client_id,
+	scope,
+	me,
+	date_issued,
+	expires
+) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return "", nil, err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(hashToken(token), t.ClientID, t.Scope, t.Me, t.DateIssued, t.Expires)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.ID, err = res.LastInsertId(); err != nil {
+		return "", nil, err
+	}
+	return token, &t, nil
+}
+
+func GetAccessToken(db *sql.DB, token string) (*AccessToken, error) {
+	var t AccessToken
+	err := db.QueryRow(`
+SELECT
+	id,
+	client_id,
+	scope,
+	me,
+	date_issued,
+	expires
+FROM access_token
+WHERE token = ? AND revoked = 0 AND expires > ?`, hashToken(token), time.Now()).Scan(&t.ID, &t.ClientID, &t.Scope, &t.Me, &t.DateIssued, &t.Expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrTokenNotFound
+	}
+	return &t, err
+}
+
+func RevokeAccessToken(tx *sql.Tx, token string) error {
+	_, err := tx.Exec(`UPDATE access_token SET revoked = 1 WHERE token = ?`, hashToken(token))
+	return err
+}
+
+// RevokeAccessTokens revokes every token, for when the author logs out
+// everywhere.
+func RevokeAccessTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE access_token SET revoked = 1 WHERE revoked = 0`)
+	return err
+}
+
+// BearerToken reads the access token from the Authorization header or the
+// access_token form field.
+func BearerToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return c.PostForm("access_token")
+}
+
+// TokenAuth looks up the bearer token of a request, if it has one, so that
+// IsAuthorized can check its scopes.
+func TokenAuth(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token := BearerToken(c); token != "" {
+			if t, err := GetAccessToken(db, token); err == nil {
+				c.Set("token", t)
+			}
+		}
+		c.Next()
+	}
+}
+
+// CurrentToken is the valid access token the request was made with, if any.
+func CurrentToken(c *gin.Context) *AccessToken {
+	if v, ok := c.Get("token"); ok {
+		return v.(*AccessToken)
+	}
+	return nil
+}
+
+// IndieAuth is the authorization server, see https://indieauth.spec.indieweb.org/
+type IndieAuth struct {
+	DB     *sql.DB
+	Config Config
+	// Fetches client_id pages, only from public addresses.
+	Fetcher *Fetcher
+}
+
+// Me is the profile URL tokens are issued for.
+func (a *IndieAuth) Me(c *gin.Context) string {
+	if a.Config.Me != "" {
+		return a.Config.Me
+	}
+	return GetBaseURL(c, a.Config.BaseURL) + "/"
+}
+
+func (a *IndieAuth) fail(c *gin.Context, status int, code string, err error) {
+	c.JSON(status, &OAuthError{Code: code, Description: err.Error()})
+}
+
+// HandleMetadata serves the authorization server metadata.
+func (a *IndieAuth) HandleMetadata(c *gin.Context) {
+	base := GetBaseURL(c, a.Config.BaseURL)
+	var scopes []string
+	for _, x := range Scopes {
+		scopes = append(scopes, x.Name)
+	}
+	c.JSON(200, gin.H{
+		"issuer":                                         base + "/",
+		"authorization_endpoint":                         base + "/auth",
+		"token_endpoint":                                 base + "/token",
+		"introspection_endpoint":                         base + "/token/introspect",
+		"revocation_endpoint":                            base + "/token/revoke",
+		"scopes_supported":                               scopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// HandleAuthorize shows the author what a client is asking for.
+func (a *IndieAuth) HandleAuthorize(c *gin.Context) {
+	if !IsAuthorized(c) {
+		c.Redirect(302, "/login?next="+url.QueryEscape(c.Request.URL.RequestURI()))
+		return
+	}
+	r := AuthRequestFrom(c.Query)
+	if err := r.Validate(); err != nil {
+		HandleError(c, err)
+		return
+	}
+	if err := VerifyRedirectURI(a.Fetcher, r); err != nil {
+		HandleError(c, err)
+		return
+	}
+	type scopeOption struct {
+		Name        string
+		Description string
+		Checked     bool
+	}
+	var scopes []scopeOption
+	for _, x := range Scopes {
+		scopes = append(scopes, scopeOption{x.Name, x.Description, hasScope(r.Scope, x.Name)})
+	}
+	HTML(c, 200, "authorize.html", M{
+		"Request": r,
+		"Scopes":  scopes,
+		"Me":      a.Me(c),
+	})
+}
+
+// HandleApprove handles both the author's answer to an authorization request
+// and clients redeeming a code for the profile URL only.
+func (a *IndieAuth) HandleApprove(c *gin.Context) {
+	if c.PostForm("grant_type") == "authorization_code" {
+		code, err := a.redeem(c)
+		if err != nil {
+			a.fail(c, 400, "invalid_grant", err)
+			return
+		}
+		c.JSON(200, gin.H{"me": code.Me})
+		return
+	}
+
+	if !IsAuthorized(c) {
+		HandleError(c, ErrNoAuth)
+		return
+	}
+	r := AuthRequestFrom(c.PostForm)
+	if err := r.Validate(); err != nil {
+		HandleError(c, err)
+		return
+	}
+	if err := VerifyRedirectURI(a.Fetcher, r); err != nil {
+		HandleError(c, err)
+		return
+	}
+	redirect, err := url.Parse(r.RedirectURI)
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+	q := redirect.Query()
+	q.Set("state", r.State)
+	q.Set("iss", GetBaseURL(c, a.Config.BaseURL)+"/")
+	if c.PostForm("Action") != "approve" {
+		q.Set("error", "access_denied")
+		redirect.RawQuery = q.Encode()
+		c.Redirect(302, redirect.String())
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		HandleError(c, err)
+		return
+	}
+	code, err := CreateAuthCode(tx, r, CleanScope(c.PostFormArray("scope")), a.Me(c))
+	if err != nil {
+		tx.Rollback()
+		HandleError(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		HandleError(c, err)
+		return
+	}
+	q.Set("code", code)
+	redirect.RawQuery = q.Encode()
+	c.Redirect(302, redirect.String())
+}
+
+func (a *IndieAuth) redeem(c *gin.Context) (*AuthCode, error) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	code, err := RedeemAuthCode(tx, c.PostForm("code"), c.PostForm("client_id"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	if err != nil {
+		// Commit anyway so a failed attempt still uses up the code.
+		tx.Commit()
+		return nil, err
+	}
+	return code, tx.Commit()
+}
+
+// HandleToken exchanges authorization codes for access tokens. A GET with a
+// bearer token returns what the token is for, as older clients expect.
+func (a *IndieAuth) HandleToken(c *gin.Context) {
+	if c.Request.Method == "GET" {
+		t := CurrentToken(c)
+		if t == nil {
+			a.fail(c, 401, "unauthorized", ErrTokenNotFound)
+			return
+		}
+		c.JSON(200, gin.H{"me": t.Me, "client_id": t.ClientID, "scope": t.Scope})
+		return
+	}
+	if c.PostForm("action") == "revoke" {
+		a.HandleRevoke(c)
+		return
+	}
+	if c.PostForm("grant_type") != "authorization_code" {
+		a.fail(c, 400, "unsupported_grant_type", errors.New("only authorization_code is supported"))
+		return
+	}
+	code, err := a.redeem(c)
+	if err != nil {
+		a.fail(c, 400, "invalid_grant", err)
+		return
+	}
+	if code.Scope == "" {
+		a.fail(c, 400, "invalid_scope", errors.New("no scope was approved, redeem the code at the authorization endpoint"))
+		return
+	}
+
+	tx, err := a.DB.Begin()
+	if err != nil {
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	token, t, err := CreateAccessToken(tx, code, a.Config.TokenLifetime)
+	if err != nil {
+		tx.Rollback()
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(200, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"scope":        t.Scope,
+		"me":           t.Me,
+		"expires_in":   int64(time.Until(t.Expires).Seconds()),
+	})
+}
+
+// HandleIntrospect reports whether a token is active, see RFC 7662. Only the
+// author or a client holding a valid token may ask.
+func (a *IndieAuth) HandleIntrospect(c *gin.Context) {
+	if !IsAuthorized(c) && CurrentToken(c) == nil {
+		a.fail(c, 401, "unauthorized", ErrNoAuth)
+		return
+	}
+	t, err := GetAccessToken(a.DB, c.PostForm("token"))
+	if err == ErrTokenNotFound {
+		c.JSON(200, gin.H{"active": false})
+		return
+	} else if err != nil {
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"active":    true,
+		"me":        t.Me,
+		"client_id": t.ClientID,
+		"scope":     t.Scope,
+		"iat":       t.DateIssued.Unix(),
+		"exp":       t.Expires.Unix(),
+	})
+}
+
+// HandleRevoke revokes a token, see RFC 7009. Unknown tokens are not an error.
+func (a *IndieAuth) HandleRevoke(c *gin.Context) {
+	tx, err := a.DB.Begin()
+	if err != nil {
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	if err := RevokeAccessToken(tx, c.PostForm("token")); err != nil {
+		tx.Rollback()
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		a.fail(c, 500, "server_error", err)
+		return
+	}
+	c.Status(200)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testToken(t *testing.T, db *sql.DB, lifetime time.Duration) string {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	token, _, err := CreateAccessToken(tx, &AuthCode{ClientID: "https://app.example/", Scope: "create", Me: testBaseURL + "/"}, lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	valid := testToken(t, db, time.Hour)
+	expired := testToken(t, db, -time.Second)
+	if tok, err := GetAccessToken(db, valid); err != nil {
+		t.Errorf("valid token: %s", err)
+	} else if tok.Expires.Before(time.Now()) {
+		t.Errorf("valid token expires %s", tok.Expires)
+	}
+	if _, err := GetAccessToken(db, expired); err != ErrTokenNotFound {
+		t.Errorf("expired token: err = %v, want %v", err, ErrTokenNotFound)
+	}
+}
+
+func TestLogoutEverywhereRevokesTokens(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, db, time.Hour)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := LogoutEverywhere(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAccessToken(db, token); err != ErrTokenNotFound {
+		t.Errorf("token after logging out everywhere: err = %v", err)
+	}
+}
+
+func TestVerifyRedirectURI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<link rel="redirect_uri" href="https://callback.example/done">`)
+	}))
+	defer srv.Close()
+
+	f := testFetcher()
+	tests := []struct {
+		redirect string
+		want     error
+	}{
+		{srv.URL + "/callback", nil},
+		{"https://callback.example/done", nil},
+		{"https://evil.example/done", ErrInvalidRedirect},
+	}
+	for _, tt := range tests {
+		r := &AuthRequest{ClientID: srv.URL + "/", RedirectURI: tt.redirect}
+		if err := VerifyRedirectURI(f, r); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.redirect, err, tt.want)
+		}
+	}
+
+	// client_id pages on private addresses aren't fetched.
+	r := &AuthRequest{ClientID: srv.URL + "/", RedirectURI: "https://callback.example/done"}
+	if err := VerifyRedirectURI(NewFetcher(), r); err != ErrForbiddenAddress {
+		t.Errorf("private client_id: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+}
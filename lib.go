@@ -2,17 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"fmt"
 	"html/template"
 	"math"
-	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/dyatlov/go-htmlinfo/htmlinfo"
 	"github.com/gofrs/uuid"
 	"github.com/gosimple/slug"
 )
@@ -29,15 +28,34 @@ const (
 	TypeStatus  PostType = 4
 )
 
+// QueryName is the name used for the type in the "type" query parameter.
+func (t PostType) QueryName() string {
+	switch t {
+	case TypeDefault:
+		return "post"
+	case TypeRepost:
+		return "repost"
+	case TypeHeart:
+		return "heart"
+	case TypeStatus:
+		return "status"
+	}
+	return ""
+}
+
 var (
 	ErrURIUsed         = errors.New("URI in use")
 	ErrContentNotFound = errors.New("content not found")
 	ErrInvalidID       = errors.New("invalid id")
 	ErrInvalidType     = errors.New("invalid type")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrInvalidDate     = errors.New("invalid date, use YYYY-MM-DD and HH:MM")
 )
 
 type ContentPiece struct {
 	Body                 string
+	Format               string
+	BodyHTML             string
 	Snippet              string
 	DateCreated          time.Time
 	Date                 time.Time
@@ -45,13 +63,20 @@ type ContentPiece struct {
 	ResponseToURL        string
 	Title                string
 	Type                 PostType
+	Visibility           Visibility
+	PasswordHash         string `json:"-"`
 	URI                  string
 	ResponseToURLPreview *URLPreview
 	Tags                 []string
+	Excerpt              template.HTML `json:",omitempty"`
 }
 
+// HTML is the rendered body, see RenderContent.
 func (c *ContentPiece) HTML() template.HTML {
-	return template.HTML(c.Body)
+	if c.BodyHTML == "" && c.Format != FormatMarkdown {
+		return template.HTML(sanitizer.Body(c.Body))
+	}
+	return template.HTML(c.BodyHTML)
 }
 
 func (c *ContentPiece) DateString() string {
@@ -77,6 +102,19 @@ type URLPreview struct {
 	Title        string
 	URL          string
 	DateCrawled  time.Time
+	// Where the preview worker is at, see PreviewWorker.
+	Status    PreviewStatus
+	Attempts  int
+	LastError string
+	// The copies kept in case the page goes away, see ArchiveThumbnail and
+	// ReadableText. Snapshot is only loaded by GetArchive.
+	ArchivedThumbnail string
+	Snapshot          string `json:",omitempty"`
+	HasSnapshot       bool
+	// The link checker found the page gone.
+	Dead bool
+	// How the preview was scraped.
+	Strategy PreviewStrategy
 }
 
 func (p *URLPreview) IsFulfilled() bool {
@@ -102,7 +140,59 @@ type PageInfo struct {
 	ItemLimit  int
 	PostType   PostType
 	Tag        string
-	DateFilter time.Time `json:"-"`
+	Query      string
+	// Only content dated before DateFilter, unless zero, and with one of
+	// Visibilities, unless empty, is listed.
+	DateFilter   time.Time    `json:"-"`
+	Visibilities []Visibility `json:"-"`
+	// Continue after the item a cursor points to rather than at Current.
+	After *Cursor `json:"-"`
+}
+
+// Cursor points to the last item of a page. Listings continue with the items
+// older than it, or, when ordered by relevance, after Offset items.
+type Cursor struct {
+	Date   time.Time  `json:"d,omitempty"`
+	ID     Identifier `json:"i,omitempty"`
+	Offset int        `json:"o,omitempty"`
+}
+
+// String encodes the cursor for a URL.
+func (c *Cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (p *PageInfo) filter() (string, []interface{}) {
+	where := []string{"1 = 1"}
+	var args []interface{}
+	if !p.DateFilter.IsZero() {
+		where = append(where, "t1.date <= ?")
+		args = append(args, p.DateFilter)
+	}
+	if len(p.Visibilities) > 0 {
+		where = append(where, "t1.visibility IN (?"+strings.Repeat(", ?", len(p.Visibilities)-1)+")")
+		for _, v := range p.Visibilities {
+			args = append(args, v)
+		}
+	}
+	if p.After != nil && p.Query == "" {
+		where = append(where, "(t1.date < ? OR (t1.date = ? AND t1.id < ?))")
+		args = append(args, p.After.Date, p.After.Date, p.After.ID)
+	}
+	return strings.Join(where, " AND "), args
 }
 
 func (p *PageInfo) HasPrevious() bool {
@@ -119,6 +209,22 @@ func (p *PageInfo) CalculateTotal() {
 	p.Next = p.Current + 1
 }
 
+// FilterQuery encodes the type, tag and search filters of the page, without
+// paging.
+func (p *PageInfo) FilterQuery() string {
+	v := url.Values{}
+	if name := p.PostType.QueryName(); name != "" {
+		v.Set("type", name)
+	}
+	if p.Tag != "" {
+		v.Set("tag", p.Tag)
+	}
+	if p.Query != "" {
+		v.Set("q", p.Query)
+	}
+	return v.Encode()
+}
+
 func (p *PageInfo) QueryString(offset int) template.URL {
 	v := url.Values{}
 	v.Set("page", strconv.Itoa(p.Current + offset))
@@ -126,6 +232,9 @@ func (p *PageInfo) QueryString(offset int) template.URL {
 	if p.Tag != "" {
 		v.Set("tag", p.Tag)
 	}
+	if p.Query != "" {
+		v.Set("q", p.Query)
+	}
 	return template.URL(v.Encode())
 }
 
@@ -145,12 +254,16 @@ func CreateSample(tx *sql.Tx) error {
 }
 
 func GetContents(db *sql.DB, page *PageInfo) ([]*ContentPiece, error) {
-	args := []interface{}{time.Now()}
+	filter, filterArgs := page.filter()
+	args := append([]interface{}{}, filterArgs...)
 	sql := `SELECT COUNT(t1.id) AS count FROM content AS t1 `
 	if page.Tag != "" {
 		sql += `INNER JOIN tag AS t2 ON (t1.id = t2.id)`
 	}
-	sql += ` WHERE t1.date <= ?`
+	if page.Query != "" {
+		sql += ` INNER JOIN content_search ON (content_search.id = t1.id)`
+	}
+	sql += ` WHERE ` + filter
 	if page.PostType != TypeAll {
 		sql += ` AND t1.type = ?`
 		args = append(args, page.PostType)
@@ -159,6 +272,10 @@ func GetContents(db *sql.DB, page *PageInfo) ([]*ContentPiece, error) {
 		sql += ` AND t2.value = ?`
 		args = append(args, page.Tag)
 	}
+	if page.Query != "" {
+		sql += ` AND content_search MATCH ?`
+		args = append(args, SearchQuery(page.Query))
+	}
 	stmt, err := db.Prepare(sql)
 	if err != nil {
 		return nil, err
@@ -174,18 +291,37 @@ SELECT
 	t1.id,
 	t1.title,
 	t1.body,
+	t1.format,
+	t1.body_html,
 	t1.snippet,
 	t1.uri,
 	t1.date,
 	t1.date_created,
 	t1.type,
+	t1.visibility,
+	t1.password_hash,
 	t1.response_to,
 	IFNULL(t2.url, ""),
 	IFNULL(t2.title, ""),
 	IFNULL(t2.snippet, ""),
 	IFNULL(t2.thumbnail_url, ""),
 	IFNULL(t2.oembed_html, ""),
-	(SELECT IFNULL(GROUP_CONCAT(value, ","), "") FROM tag WHERE id = t1.id) AS tags
+	IFNULL(t2.status, ""),
+	IFNULL(t2.attempts, 0),
+	IFNULL(t2.last_error, ""),
+	IFNULL(t2.archived_thumbnail, ""),
+	IFNULL(t2.strategy, ""),
+	IFNULL(t2.snapshot != '', 0),
+	IFNULL((SELECT status FROM link_check WHERE url = t1.response_to), "") = 'dead',
+	(SELECT IFNULL(GROUP_CONCAT(value, ","), "") FROM tag WHERE id = t1.id) AS tags,`
+	if page.Query != "" {
+		sql += `
+	snippet(content_search, -1, char(2), char(3), '…', 24) AS excerpt`
+	} else {
+		sql += `
+	"" AS excerpt`
+	}
+	sql += `
 FROM
 	content AS t1
 	LEFT JOIN url_preview AS t2 ON (t1.response_to = t2.url)`
@@ -193,11 +329,14 @@ FROM
 	if page.Tag != "" {
 		sql += `INNER JOIN tag AS t3 ON (t1.id = t3.id) `
 	}
+	if page.Query != "" {
+		sql += `INNER JOIN content_search ON (content_search.id = t1.id) `
+	}
 	sql += `
 WHERE
-	date <= ?`
+	` + filter
 
-	args = []interface{}{page.DateFilter}
+	args = append([]interface{}{}, filterArgs...)
 	if page.PostType != TypeAll {
 		sql += ` AND t1.type = ?`
 		args = append(args, page.PostType)
@@ -206,12 +345,29 @@ WHERE
 		sql += ` AND t3.value = ?`
 		args = append(args, page.Tag)
 	}
-	sql += `
+	if page.Query != "" {
+		// Weights follow the column order: id, title, body, snippet, tags,
+		// preview_title, preview_snippet.
+		sql += ` AND content_search MATCH ?
 ORDER BY
-	date DESC
+	bm25(content_search, 0, 10.0, 1.0, 2.0, 5.0, 1.0, 1.0),
+	date DESC,
+	t1.id DESC`
+		args = append(args, SearchQuery(page.Query))
+	} else {
+		sql += `
+ORDER BY
+	date DESC,
+	t1.id DESC`
+	}
+	sql += `
 LIMIT ?
 OFFSET ?`
-	args = append(args, page.ItemLimit, (page.Current-1)*page.ItemLimit)
+	offset := (page.Current - 1) * page.ItemLimit
+	if page.After != nil && page.Query != "" {
+		offset = page.After.Offset
+	}
+	args = append(args, page.ItemLimit, offset)
 
 	stmt, err = db.Prepare(sql)
 	if err != nil {
@@ -228,14 +384,19 @@ OFFSET ?`
 		var a ContentPiece
 		var b URLPreview
 		var tags string
+		var excerpt string
 		if err := rows.Scan(&a.ID,
 			&a.Title,
 			&a.Body,
+			&a.Format,
+			&a.BodyHTML,
 			&a.Snippet,
 			&a.URI,
 			&a.Date,
 			&a.DateCreated,
 			&a.Type,
+			&a.Visibility,
+			&a.PasswordHash,
 			&a.ResponseToURL,
 			&b.URL,
 			&b.Title,
@@ -243,13 +404,25 @@ OFFSET ?`
 			//&b.DateCrawled,
 			&b.ThumbnailURL,
 			&b.OembedHTML,
-			&tags); err != nil {
+			&b.Status,
+			&b.Attempts,
+			&b.LastError,
+			&b.ArchivedThumbnail,
+			&b.Strategy,
+			&b.HasSnapshot,
+			&b.Dead,
+			&tags,
+			&excerpt); err != nil {
 			return nil, err
 		}
 		if tags != "" {
 			a.Tags = strings.Split(tags, ",")
 		}
+		if excerpt != "" {
+			a.Excerpt = SearchExcerpt(excerpt)
+		}
 		if a.ResponseToURL != "" {
+			b.OembedHTML = sanitizer.Embed(b.OembedHTML)
 			a.ResponseToURLPreview = &b
 		}
 		xs = append(xs, &a)
@@ -265,17 +438,28 @@ SELECT
 	t1.id,
 	t1.title,
 	t1.body,
+	t1.format,
+	t1.body_html,
 	t1.snippet,
 	t1.uri,
 	t1.date,
 	t1.date_created,
 	t1.type,
+	t1.visibility,
+	t1.password_hash,
 	t1.response_to,
 	IFNULL(t2.url, ""),
 	IFNULL(t2.title, ""),
 	IFNULL(t2.snippet, ""),
 	IFNULL(t2.thumbnail_url, ""),
 	IFNULL(t2.oembed_html, ""),
+	IFNULL(t2.status, ""),
+	IFNULL(t2.attempts, 0),
+	IFNULL(t2.last_error, ""),
+	IFNULL(t2.archived_thumbnail, ""),
+	IFNULL(t2.strategy, ""),
+	IFNULL(t2.snapshot != '', 0),
+	IFNULL((SELECT status FROM link_check WHERE url = t1.response_to), "") = 'dead',
 	(SELECT IFNULL(GROUP_CONCAT(value, ","), "") FROM tag WHERE id = t1.id) AS tags
 FROM
 	content AS t1
@@ -292,11 +476,15 @@ WHERE
 	err = stmt.QueryRow(uri).Scan(&a.ID,
 		&a.Title,
 		&a.Body,
+		&a.Format,
+		&a.BodyHTML,
 		&a.Snippet,
 		&a.URI,
 		&a.Date,
 		&a.DateCreated,
 		&a.Type,
+		&a.Visibility,
+		&a.PasswordHash,
 		&a.ResponseToURL,
 		&b.URL,
 		&b.Title,
@@ -304,6 +492,13 @@ WHERE
 		//&b.DateCrawled,
 		&b.ThumbnailURL,
 		&b.OembedHTML,
+		&b.Status,
+		&b.Attempts,
+		&b.LastError,
+		&b.ArchivedThumbnail,
+		&b.Strategy,
+		&b.HasSnapshot,
+		&b.Dead,
 		&tags)
 	if err == sql.ErrNoRows {
 		return nil, ErrContentNotFound
@@ -314,11 +509,22 @@ WHERE
 		a.Tags = strings.Split(tags, ",")
 	}
 	if a.ResponseToURL != "" {
+		b.OembedHTML = sanitizer.Embed(b.OembedHTML)
 		a.ResponseToURLPreview = &b
 	}
 	return &a, nil
 }
 
+// GetContentURI returns the current URI of a content piece.
+func GetContentURI(tx *sql.Tx, id Identifier) (string, error) {
+	var uri string
+	err := tx.QueryRow(`SELECT uri FROM content WHERE id = ?`, id).Scan(&uri)
+	if err == sql.ErrNoRows {
+		return "", ErrContentNotFound
+	}
+	return uri, err
+}
+
 func CreateContent(tx *sql.Tx, c *ContentPiece) error {
 	ok, err := IsAvailableURI(tx, c.URI)
 	if err != nil {
@@ -330,43 +536,43 @@ func CreateContent(tx *sql.Tx, c *ContentPiece) error {
 	if !IsValidType(c.Type) {
 		return ErrInvalidType
 	}
-
-	id, err := uuid.NewV4()
-	if err != nil {
+	if err := CheckVisibility(tx, c); err != nil {
+		return err
+	}
+	if err := RenderContent(c); err != nil {
 		return err
 	}
-	c.ID = Identifier(id.String())
-
-	// Fetch url info if it exists
-	if c.ResponseToURL != "" {
-		if _, err := GetURLPreview(tx, c.ResponseToURL); err == sql.ErrNoRows {
-			p, err := ScrapURLPreview(c.ResponseToURL)
-			if err != nil {
-				return err
-			}
-			if err := PutURLPreview(tx, *p); err != nil {
-				return err
-			}
+
+	// Undeleted content keeps the ID it had.
+	if c.ID == "" {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return err
 		}
+		c.ID = Identifier(id.String())
 	}
 
 	stmt, err := tx.Prepare(`
 INSERT INTO content (
 	title,
 	body,
+	format,
+	body_html,
 	snippet,
 	date,
 	date_created,
 	id,
 	response_to,
 	type,
+	visibility,
+	password_hash,
 	uri
-) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`)
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	if _, err := stmt.Exec(c.Title, c.Body, c.Snippet, c.Date, time.Now(), c.ID, c.ResponseToURL, c.Type, c.URI); err != nil {
+	if _, err := stmt.Exec(c.Title, c.Body, c.Format, c.BodyHTML, c.Snippet, c.Date, time.Now(), c.ID, c.ResponseToURL, c.Type, c.Visibility, c.PasswordHash, c.URI); err != nil {
 		return err
 	}
 
@@ -375,7 +581,16 @@ INSERT INTO content (
 			return err
 		}
 	}
-	return nil
+	if err := InsertRevision(tx, c); err != nil {
+		return err
+	}
+	if err := IndexContent(tx, c); err != nil {
+		return err
+	}
+	if err := QueueURLPreview(tx, c.ResponseToURL, false); err != nil {
+		return err
+	}
+	return UpdateMediaUsage(tx, c)
 }
 
 func InsertTag(tx *sql.Tx, id Identifier, tag string) error {
@@ -400,7 +615,37 @@ func DeleteTags(tx *sql.Tx, id Identifier) error {
 	return err
 }
 
-func UpdateContent(tx *sql.Tx, c *ContentPiece, rescrape bool) error {
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// GetTags counts the content of each tag among what the page lists, the most
+// used first.
+func GetTags(tx *sql.Tx, page *PageInfo) ([]*TagCount, error) {
+	filter, args := page.filter()
+	rows, err := tx.Query(`SELECT t2.value, COUNT(t1.id)
+FROM tag AS t2
+	INNER JOIN content AS t1 ON (t1.id = t2.id)
+WHERE t2.value != '' AND `+filter+`
+GROUP BY t2.value
+ORDER BY COUNT(t1.id) DESC, t2.value`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*TagCount, 0)
+	for rows.Next() {
+		var t TagCount
+		if err := rows.Scan(&t.Name, &t.Count); err != nil {
+			return nil, err
+		}
+		xs = append(xs, &t)
+	}
+	return xs, rows.Err()
+}
+
+func UpdateContent(tx *sql.Tx, c *ContentPiece) error {
 	if c.ID == "" {
 		return ErrInvalidID
 	}
@@ -414,43 +659,33 @@ func UpdateContent(tx *sql.Tx, c *ContentPiece, rescrape bool) error {
 	if !IsValidType(c.Type) {
 		return ErrInvalidType
 	}
-
-	// It changed!
-	if c.ResponseToURL != "" && ((x != nil && c.ResponseToURL != x.ResponseToURL) || rescrape) {
-		if p, err := GetURLPreview(tx, c.ResponseToURL); err == sql.ErrNoRows || rescrape {
-			fmt.Println("Scrapping")
-			p, err := ScrapURLPreview(c.ResponseToURL)
-			if err != nil {
-				return err
-			}
-			if err := PutURLPreview(tx, *p); err != nil {
-				return err
-			}
-			fmt.Println("Scraped it")
-			fmt.Println(p)
-		} else if err != nil {
-			fmt.Println(2)
-			return err
-		} else {
-			fmt.Println("already has preview")
-			fmt.Println(p)
-		}
+	if err := CheckVisibility(tx, c); err != nil {
+		return err
+	}
+	if err := RenderContent(c); err != nil {
+		return err
 	}
 
 	stmt, err := tx.Prepare(`UPDATE content SET
 	title = ?,
 	body = ?,
+	format = ?,
+	body_html = ?,
 	snippet = ?,
 	date = ?,
 	response_to = ?,
 	uri = ?,
-	type = ?
+	type = ?,
+	visibility = ?,
+	password_hash = ?,
+	-- Taken down or moved to the future, it's published again later.
+	date_published = CASE WHEN ? THEN date_published END
 	WHERE id = ?;`)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
-	res, err := stmt.Exec(c.Title, c.Body, c.Snippet, c.Date, c.ResponseToURL, c.URI, c.Type, c.ID)
+	res, err := stmt.Exec(c.Title, c.Body, c.Format, c.BodyHTML, c.Snippet, c.Date, c.ResponseToURL, c.URI, c.Type, c.Visibility, c.PasswordHash, c.IsPublic(), c.ID)
 	if err != nil {
 		return err
 	}
@@ -467,7 +702,16 @@ func UpdateContent(tx *sql.Tx, c *ContentPiece, rescrape bool) error {
 			return err
 		}
 	}
-	return nil
+	if err := InsertRevision(tx, c); err != nil {
+		return err
+	}
+	if err := IndexContent(tx, c); err != nil {
+		return err
+	}
+	if err := QueueURLPreview(tx, c.ResponseToURL, false); err != nil {
+		return err
+	}
+	return UpdateMediaUsage(tx, c)
 }
 
 func DeleteContent(tx *sql.Tx, c *ContentPiece) error {
@@ -485,7 +729,16 @@ func DeleteContent(tx *sql.Tx, c *ContentPiece) error {
 	} else if count == 0 {
 		return ErrContentNotFound
 	}
-	return DeleteTags(tx, c.ID)
+	if err := DeleteTags(tx, c.ID); err != nil {
+		return err
+	}
+	if err := DeleteMediaUsage(tx, c.ID); err != nil {
+		return err
+	}
+	if err := MarkRevisionDeleted(tx, c.ID); err != nil {
+		return err
+	}
+	return UnindexContent(tx, c.ID)
 }
 
 func TitleToURI(s string) string {
@@ -516,81 +769,66 @@ func GetURLPreview(tx *sql.Tx, s string) (*URLPreview, error) {
 		snippet,
 		date_crawled,
 		oembed_html,
-		thumbnail_url
+		thumbnail_url,
+		status,
+		attempts,
+		last_error,
+		strategy
 	FROM url_preview WHERE url = ? LIMIT 1`)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	err = stmt.QueryRow(s).Scan(&p.URL, &p.Title, &p.Snippet, &p.DateCrawled, &p.OembedHTML, &p.ThumbnailURL)
+	// Queued previews weren't crawled yet.
+	var crawled sql.NullTime
+	err = stmt.QueryRow(s).Scan(&p.URL, &p.Title, &p.Snippet, &crawled, &p.OembedHTML, &p.ThumbnailURL, &p.Status, &p.Attempts, &p.LastError, &p.Strategy)
 	if err != nil {
 		return nil, err
 	}
+	p.DateCrawled = crawled.Time
+	p.OembedHTML = sanitizer.Embed(p.OembedHTML)
 	return &p, nil
 }
 
+// PutURLPreview stores a scraped preview.
 func PutURLPreview(tx *sql.Tx, p URLPreview) error {
-	stmt, err := tx.Prepare(`DELETE FROM url_preview WHERE url = ?`)
-	if err != nil {
-		return err
-	}
-	if _, err := stmt.Exec(p.URL); err != nil {
-		return err
-	}
-	stmt.Close()
-	stmt, err = tx.Prepare(`INSERT INTO url_preview (
+	stmt, err := tx.Prepare(`INSERT INTO url_preview (
 		url,
 		title,
 		snippet,
 		date_crawled,
 		oembed_html,
-		thumbnail_url
-	) VALUES (?, ?, ?, ?, ?, ?)`)
+		thumbnail_url,
+		status,
+		attempts,
+		next_attempt,
+		last_error,
+		archived_thumbnail,
+		snapshot,
+		strategy
+	) VALUES (?, ?, ?, ?, ?, ?, ?, 0, NULL, '', ?, ?, ?)
+	ON CONFLICT (url) DO UPDATE SET
+		title = excluded.title,
+		snippet = excluded.snippet,
+		date_crawled = excluded.date_crawled,
+		oembed_html = excluded.oembed_html,
+		thumbnail_url = excluded.thumbnail_url,
+		status = excluded.status,
+		attempts = 0,
+		next_attempt = NULL,
+		last_error = '',
+		strategy = excluded.strategy,
+		-- Keep the copies made before when none could be made this time.
+		archived_thumbnail = COALESCE(NULLIF(excluded.archived_thumbnail, ''), archived_thumbnail),
+		snapshot = COALESCE(NULLIF(excluded.snapshot, ''), snapshot)`)
 	if err != nil {
 		return err
 	}
-	if _, err := stmt.Exec(p.URL, p.Title, p.Snippet, p.DateCrawled, string(p.OembedHTML), p.ThumbnailURL); err != nil {
+	defer stmt.Close()
+	if _, err := stmt.Exec(p.URL, p.Title, p.Snippet, p.DateCrawled, string(p.OembedHTML), p.ThumbnailURL, PreviewOK, p.ArchivedThumbnail, p.Snapshot, p.Strategy); err != nil {
 		return err
 	}
-	stmt.Close()
-	return nil
-}
-
-func ScrapURLPreview(s string) (*URLPreview, error) {
-	resp, err := http.Get(s)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	info := htmlinfo.NewHTMLInfo()
-	if err := info.Parse(resp.Body, &s, nil); err != nil {
-		return nil, err
-	}
-
-	og := info.OGInfo
-	p := URLPreview{
-		URL:         s,
-		Title:       info.Title,
-		Snippet:     info.Description,
-		DateCrawled: time.Now(),
-	}
-	if info.OembedInfo != nil {
-		if info.OembedInfo.HTML != "" {
-			p.OembedHTML = template.HTML(info.OembedInfo.HTML)
-		}
-		if info.OembedInfo.ThumbnailURL != "" {
-			p.ThumbnailURL = info.OembedInfo.ThumbnailURL
-		}
-	} else if og != nil && len(og.Images) > 0 {
-		p.ThumbnailURL = og.Images[0].URL
-	}
-	if og != nil {
-		p.URL = og.URL
-		p.Title = og.Title
-		p.Snippet = og.Description
-	}
-	return &p, nil
+	return IndexURLPreview(tx, p)
 }
 
 // Validates that the PostType is consumable into the database
@@ -608,32 +846,3 @@ func IsValidType(t PostType) bool {
 	}
 	return false
 }
-
-func PrepareDb(db *sql.DB) error {
-	_, err := db.Exec(`
-	PRAGMA foreign_keys= ON;
-	CREATE TABLE IF NOT EXISTS content (
-		title STRING,
-		body  STRING,
-		snippet STRING,
-		date DATETIME,
-		date_created DATETIME,
-		id STRING PRIMARY KEY,
-		response_to STRING,
-		type STRING,
-		uri STRING
-	);
-	CREATE TABLE IF NOT EXISTS tag (
-		id STRING,
-		value STRING
-	);
-	CREATE TABLE IF NOT EXISTS url_preview (
-		url STRING PRIMARY KEY,
-		title STRING,
-		snippet STRING,
-		date_crawled DATETIME,
-		oembed_html STRING,
-		thumbnail_url STRING
-	);`)
-	return err
-}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// LinkStatus is the outcome of checking a link, see LinkChecker.
+type LinkStatus string
+
+const (
+	LinkOK LinkStatus = "ok"
+	// Failed linkDeadAfter checks in a row, or is gone for good.
+	LinkDead LinkStatus = "dead"
+)
+
+const (
+	linkDeadAfter = 3
+	// Links checked per round, to spread the requests over time.
+	linkCheckBatch = 20
+	// How often to look for links due for a check.
+	linkCheckRound = 10 * time.Minute
+	// How often a link is checked, see -linkCheckInterval.
+	DefaultLinkCheckInterval = 24 * time.Hour
+)
+
+// Links are the URLs posts respond to and the links in their bodies, as
+// recorded for webmentions.
+const linkSources = `
+	SELECT response_to FROM content WHERE response_to != ''
+	UNION
+	SELECT target FROM webmention_outgoing WHERE removed = 0`
+
+// LinkChecker looks for link rot: it checks every link of the posts every
+// Interval and flags those that failed linkDeadAfter checks in a row as dead.
+type LinkChecker struct {
+	DB       *sql.DB
+	Fetcher  *Fetcher
+	Interval time.Duration
+}
+
+func NewLinkChecker(db *sql.DB, f *Fetcher, interval time.Duration) *LinkChecker {
+	return &LinkChecker{DB: db, Fetcher: f, Interval: interval}
+}
+
+// Start checks links in the background, unless Interval is zero.
+func (l *LinkChecker) Start() {
+	if l.Interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := l.CheckDue(); err != nil {
+				log.Printf("link checker: %s", err)
+			}
+			time.Sleep(linkCheckRound)
+		}
+	}()
+}
+
+// CheckDue picks up new links, forgets those no longer linked, and checks a
+// batch of those not checked within the interval.
+func (l *LinkChecker) CheckDue() error {
+	if _, err := l.DB.Exec(`INSERT OR IGNORE INTO link_check (url) ` + linkSources); err != nil {
+		return err
+	}
+	if _, err := l.DB.Exec(`DELETE FROM link_check WHERE url NOT IN (` + linkSources + `)`); err != nil {
+		return err
+	}
+	rows, err := l.DB.Query(`SELECT url, failures FROM link_check
+WHERE date_checked IS NULL OR date_checked <= ?
+ORDER BY date_checked
+LIMIT ?`, time.Now().Add(-l.Interval), linkCheckBatch)
+	if err != nil {
+		return err
+	}
+	type due struct {
+		url      string
+		failures int
+	}
+	var xs []due
+	for rows.Next() {
+		var x due
+		if err := rows.Scan(&x.url, &x.failures); err != nil {
+			rows.Close()
+			return err
+		}
+		xs = append(xs, x)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, x := range xs {
+		if err := l.Check(x.url, x.failures); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check requests a link once and records the outcome. Links we may not
+// request, because of robots.txt or their address, are left as they were.
+func (l *LinkChecker) Check(s string, failures int) error {
+	code := 0
+	lastError := ""
+	resp, err := l.Fetcher.Get(s)
+	switch {
+	case err == ErrDisallowedByRobots || err == ErrForbiddenAddress || err == ErrUnsupportedScheme:
+		_, dbErr := l.DB.Exec(`UPDATE link_check SET last_error = ?, date_checked = ? WHERE url = ?`, err.Error(), time.Now(), s)
+		return dbErr
+	case err != nil:
+		failures++
+		lastError = err.Error()
+	default:
+		resp.Body.Close()
+		code = resp.StatusCode
+		switch {
+		case code == http.StatusGone:
+			failures = linkDeadAfter
+			lastError = fmt.Sprintf("responded with %d", code)
+		case code == http.StatusNotFound || code >= 500:
+			failures++
+			lastError = fmt.Sprintf("responded with %d", code)
+		default:
+			// Anything else, including sites refusing bots, means it's there.
+			failures = 0
+		}
+	}
+	status := LinkOK
+	if failures >= linkDeadAfter {
+		status = LinkDead
+	}
+	_, err = l.DB.Exec(`UPDATE link_check SET
+	status = ?,
+	status_code = ?,
+	failures = ?,
+	last_error = ?,
+	date_checked = ?
+	WHERE url = ?`, status, code, failures, lastError, time.Now(), s)
+	return err
+}
+
+// BrokenLink is a link of a post that failed its last check.
+type BrokenLink struct {
+	URL         string
+	Status      LinkStatus
+	StatusCode  int
+	Failures    int
+	LastError   string
+	DateChecked time.Time
+	ContentID   Identifier
+	URI         string
+	Title       string
+}
+
+func (b *BrokenLink) DateCheckedString() string {
+	return b.DateChecked.Format("January 2006 2 at 03:04PM")
+}
+
+// GetBrokenLinks lists the links that failed their last check with the posts
+// linking to them, dead ones first.
+func GetBrokenLinks(tx *sql.Tx) ([]*BrokenLink, error) {
+	rows, err := tx.Query(`
+SELECT
+	link_check.url,
+	link_check.status,
+	link_check.status_code,
+	link_check.failures,
+	link_check.last_error,
+	link_check.date_checked,
+	content.id,
+	content.uri,
+	content.title
+FROM link_check
+JOIN content ON content.response_to = link_check.url OR content.id IN (
+	SELECT content_id FROM webmention_outgoing WHERE target = link_check.url AND removed = 0)
+WHERE link_check.failures > 0
+ORDER BY link_check.status = ? DESC, link_check.url, content.date DESC`, LinkDead)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*BrokenLink, 0)
+	for rows.Next() {
+		var b BrokenLink
+		if err := rows.Scan(&b.URL, &b.Status, &b.StatusCode, &b.Failures, &b.LastError, &b.DateChecked,
+			&b.ContentID, &b.URI, &b.Title); err != nil {
+			return nil, err
+		}
+		xs = append(xs, &b)
+	}
+	return xs, rows.Err()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNoPassword      = errors.New("no password has been set, run weblog passwd")
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+// GetSetting reads a value from the settings table, empty when unset.
+func GetSetting(tx *sql.Tx, key string) (string, error) {
+	var value string
+	err := tx.QueryRow(`SELECT value FROM setting WHERE key = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func PutSetting(tx *sql.Tx, key, value string) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO setting (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func HasPassword(tx *sql.Tx) (bool, error) {
+	hash, err := GetSetting(tx, "password_hash")
+	return hash != "", err
+}
+
+// SetPassword stores the bcrypt hash of a new password and logs out every
+// session made with the old one.
+func SetPassword(tx *sql.Tx, password string) error {
+	if password == "" {
+		return ErrNoPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := PutSetting(tx, "password_hash", string(hash)); err != nil {
+		return err
+	}
+	return LogoutEverywhere(tx)
+}
+
+func CheckPassword(tx *sql.Tx, password string) error {
+	hash, err := GetSetting(tx, "password_hash")
+	if err != nil {
+		return err
+	}
+	if hash == "" {
+		return ErrNoPassword
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// SessionSecret is the key session cookies are signed with. It is generated
+// the first time it's needed and kept in the database.
+func SessionSecret(db *sql.DB) ([]byte, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	secret, err := GetSetting(tx, "session_secret")
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+		if err := PutSetting(tx, "session_secret", secret); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+	return hex.DecodeString(secret)
+}
+
+// SessionGeneration is bumped to log out every session at once; sessions
+// remember the generation they logged in at.
+func SessionGeneration(tx *sql.Tx) (int64, error) {
+	s, err := GetSetting(tx, "session_generation")
+	if err != nil || s == "" {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func LogoutEverywhere(tx *sql.Tx) error {
+	gen, err := SessionGeneration(tx)
+	if err != nil {
+		return err
+	}
+	if err := PutSetting(tx, "session_generation", strconv.FormatInt(gen+1, 10)); err != nil {
+		return err
+	}
+	// Apps signed in with IndieAuth are logged out too.
+	return RevokeAccessTokens(tx)
+}
+
+// Login marks the session as the author's.
+func Login(c *gin.Context, generation int64) error {
+	s := sessions.Default(c)
+	s.Set("authed", true)
+	s.Set("login", time.Now().Unix())
+	s.Set("generation", generation)
+	return s.Save()
+}
+
+// SessionAuth logs out sessions that are older than the lifetime or were
+// made before the last "log out everywhere".
+func SessionAuth(db *sql.DB, lifetime time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := sessions.Default(c)
+		if authed, _ := s.Get("authed").(bool); authed {
+			login, _ := s.Get("login").(int64)
+			gen, _ := s.Get("generation").(int64)
+			var current int64
+			tx, err := db.Begin()
+			if err == nil {
+				current, err = SessionGeneration(tx)
+				tx.Rollback()
+			}
+			if err != nil || gen != current || time.Since(time.Unix(login, 0)) > lifetime {
+				s.Clear()
+				s.Save()
+			}
+		}
+		c.Next()
+	}
+}
+
+const (
+	// Failed logins allowed from an address before it is locked out.
+	loginFreeAttempts = 3
+	loginBaseLockout  = 5 * time.Second
+	loginMaxLockout   = time.Hour
+	// Addresses remembered at most, the longest idle is forgotten first.
+	maxLoginAddresses = 10000
+)
+
+type loginAttempts struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+// LoginLimiter locks out addresses after failed logins, doubling the lockout
+// with every further failure.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+func NewLoginLimiter() *LoginLimiter {
+	return &LoginLimiter{attempts: make(map[string]*loginAttempts)}
+}
+
+// Wait is how long the address is still locked out for.
+func (l *LoginLimiter) Wait(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if a, ok := l.attempts[ip]; ok {
+		if d := time.Until(a.until); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func (l *LoginLimiter) Fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, a := range l.attempts {
+		if now.Sub(a.last) > 24*time.Hour {
+			delete(l.attempts, k)
+		}
+	}
+	a, ok := l.attempts[ip]
+	if !ok {
+		if len(l.attempts) >= maxLoginAddresses {
+			l.forgetOldest()
+		}
+		a = &loginAttempts{}
+		l.attempts[ip] = a
+	}
+	a.failures++
+	a.last = now
+	if n := a.failures - loginFreeAttempts; n > 0 {
+		lockout := loginMaxLockout
+		if n < 20 {
+			if d := loginBaseLockout << uint(n-1); d < lockout {
+				lockout = d
+			}
+		}
+		a.until = now.Add(lockout)
+	}
+}
+
+func (l *LoginLimiter) forgetOldest() {
+	var oldest string
+	var last time.Time
+	for k, a := range l.attempts {
+		if oldest == "" || a.last.Before(last) {
+			oldest, last = k, a.last
+		}
+	}
+	delete(l.attempts, oldest)
+}
+
+func (l *LoginLimiter) Succeed(ip string) {
+	l.mu.Lock()
+	delete(l.attempts, ip)
+	l.mu.Unlock()
+}
@@ -1,30 +1,59 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/term"
 )
 
 func main() {
-	var password string
+	var cfg Config
 	var dbfile string
 	var sampleme bool
-	var templateGlob string
-	var assetsDir string
-	var key string
-	var cert string
-	var port int
-
-	flag.IntVar(&port, "port", 8080, "Network port to occupy.")
-	flag.StringVar(&password, "password", "password", "The password to validate editing.")
+	var migrateOnly bool
+	var dryRun bool
+	var password string
+
+	flag.IntVar(&cfg.Port, "port", 8080, "Network port to occupy.")
+	flag.StringVar(&password, "password", "", "Deprecated, use the passwd command. Sets the password if none is stored yet.")
 	flag.StringVar(&dbfile, "dbfile", "./a.db", "The database file to use for SQLite3.")
-	flag.StringVar(&templateGlob, "templates", "./templates/*.html", "The template glob to use.")
-	flag.StringVar(&assetsDir, "files", "./files", "Assets directory to serve.")
+	flag.StringVar(&cfg.TemplateGlob, "templates", "./templates/*.html", "The template glob to use.")
+	flag.StringVar(&cfg.AssetsDir, "files", "./files", "Assets directory to serve.")
+	flag.Int64Var(&cfg.MaxUploadSize, "maxUploadSize", 32<<20, "Largest file that can be uploaded, in bytes.")
+	flag.StringVar(&cfg.Extensions, "extensions", DefaultExtensions, "Comma separated file extensions that can be uploaded.")
 	flag.BoolVar(&sampleme, "sample", false, "Create the sample post on start up?")
-	flag.StringVar(&key, "sslKey", "", "SSL private key file")
-	flag.StringVar(&cert, "sslCert", "", "SSL certificate file")
+	flag.StringVar(&cfg.Key, "sslKey", "", "SSL private key file")
+	flag.StringVar(&cfg.Cert, "sslCert", "", "SSL certificate file")
+	flag.StringVar(&cfg.Title, "title", "Tom's Blog", "Title of the blog used in feeds.")
+	flag.StringVar(&cfg.BaseURL, "url", "", "Public base URL used for absolute links, e.g. https://example.com (defaults to the request host).")
+	flag.StringVar(&cfg.Me, "me", "", "Your profile URL that IndieAuth signs you in as (defaults to the base URL).")
+	flag.DurationVar(&cfg.SessionLifetime, "sessionLifetime", 30*24*time.Hour, "How long a login lasts.")
+	flag.DurationVar(&cfg.TokenLifetime, "tokenLifetime", DefaultTokenLifetime, "How long an access token issued to an IndieAuth client lasts.")
+	flag.StringVar(&cfg.CacheDir, "cacheDir", "./cache", "Directory for resized images.")
+	flag.Int64Var(&cfg.CacheSize, "cacheSize", 512<<20, "Size the image cache is kept under, in bytes (0 for no limit).")
+	flag.BoolVar(&cfg.KeepMetadata, "keepMetadata", false, "Serve JPEG files with their EXIF metadata, such as location, instead of a stripped copy.")
+	flag.BoolVar(&cfg.SanitizeBodies, "sanitizeBodies", false, "Clean the HTML of post bodies, as is always done for embeds from other sites.")
+	flag.StringVar(&cfg.EmbedProviders, "embedProviders", "", "Comma separated iframe sources to allow besides the known video and music players, e.g. example.com/embed/.")
+	flag.StringVar(&cfg.CodeTheme, "codeTheme", DefaultCodeTheme, "Theme for highlighted code, e.g. github, monokai or dracula.")
+	flag.DurationVar(&cfg.PreviewMaxAge, "previewMaxAge", DefaultPreviewMaxAge, "How old a URL preview gets before it is scraped again (0 to never refresh).")
+	flag.DurationVar(&cfg.LinkCheckInterval, "linkCheckInterval", DefaultLinkCheckInterval, "How often every link of the posts is checked for link rot (0 to never check).")
+	flag.BoolVar(&cfg.ArchiveFallback, "archiveFallback", false, "Link to the archived copy of a page a post responds to once it is gone.")
+	flag.StringVar(&cfg.OembedProviders, "oembedProviders", "", "JSON file of oEmbed providers to ask for URL previews besides the built-in ones, in the format of https://oembed.com/providers.json.")
+	flag.StringVar(&cfg.TrustedProxies, "trustedProxies", "", "Comma separated addresses or CIDR ranges of reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are trusted, e.g. 127.0.0.1 (none by default).")
+	flag.BoolVar(&migrateOnly, "migrate-only", false, "Apply database migrations and exit.")
+	flag.BoolVar(&dryRun, "dry-run", false, "List the database migrations that would be applied and exit.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [passwd | cache purge | cache prewarm]\n\nThe passwd command sets the login password. The cache commands empty the\nimage cache or generate the images posts use ahead of time.\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	db, err := sql.Open("sqlite3", dbfile)
@@ -33,15 +62,60 @@ func main() {
 	}
 	db.SetMaxOpenConns(1)
 
-	if err := PrepareDb(db); err != nil {
+	applied, err := Migrate(db, dryRun)
+	if err != nil {
 		panic(err)
 	}
+	for _, m := range applied {
+		if dryRun {
+			fmt.Printf("Would apply migration %d: %s\n", m.Version, m.Description)
+		} else {
+			fmt.Printf("Applied migration %d: %s\n", m.Version, m.Description)
+		}
+	}
+	if dryRun || migrateOnly {
+		return
+	}
+
+	if flag.Arg(0) == "passwd" {
+		if err := passwd(db); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Password changed.")
+		return
+	}
+
+	if flag.Arg(0) == "cache" {
+		if err := cacheCommand(db, cfg, flag.Arg(1)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	// Preparation
 	tx, err := db.Begin()
 	if err != nil {
 		panic(err)
 	}
+	hasPassword, err := HasPassword(tx)
+	if err != nil {
+		panic(err)
+	}
+	if password != "" {
+		if hasPassword {
+			fmt.Println("Ignoring -password, a password is already stored. Use the passwd command to change it.")
+		} else if err := SetPassword(tx, password); err != nil {
+			panic(err)
+		} else {
+			fmt.Println("Stored -password hashed. The flag is deprecated, use the passwd command from now on.")
+			hasPassword = true
+		}
+	}
+	if !hasPassword {
+		fmt.Println("No password is set so nobody can log in. Run the passwd command to set one.")
+	}
 	if c, err := GetContent(tx, ""); err == nil {
 		DeleteContent(tx, c)
 	}
@@ -54,5 +128,79 @@ func main() {
 		panic(err)
 	}
 
-	StartServer(db, port, templateGlob, assetsDir, password, key, cert)
+	StartServer(db, cfg)
+}
+
+func cacheCommand(db *sql.DB, cfg Config, action string) error {
+	files, err := NewFileStore(cfg.AssetsDir, cfg.MaxUploadSize, cfg.Extensions)
+	if err != nil {
+		return err
+	}
+	cache, err := NewImageCache(cfg.CacheDir, cfg.CacheSize)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "purge":
+		if err := cache.Purge(); err != nil {
+			return err
+		}
+		n, err := PurgeLegacyThumbnails(files)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Emptied the image cache and removed %d old thumbnails.\n", n)
+	case "prewarm":
+		n, err := cache.Prewarm(db, files)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d images ready.\n", n)
+	default:
+		return ErrUnknownCacheAction
+	}
+	return nil
+}
+
+// passwd asks for a new password on the terminal and stores its hash.
+func passwd(db *sql.DB) error {
+	password, err := readPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	confirm, err := readPassword("Repeat password: ")
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return errors.New("passwords do not match")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := SetPassword(tx, password); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword reads a line without echoing it when stdin is a terminal, so
+// it can also be piped in.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Print(prompt)
+	b, err := term.ReadPassword(fd)
+	fmt.Println()
+	return string(b), err
 }
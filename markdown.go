@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrInvalidFormat = errors.New("format must be html or markdown")
+)
+
+// Formats a body can be written in.
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+)
+
+// GitHub flavoured Markdown: tables, strikethrough, autolinks and task lists,
+// plus footnotes. HTML in the source is kept, it's the author's own.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.GFM, extension.Footnote),
+	goldmark.WithRendererOptions(html.WithUnsafe()),
+)
+
+// RenderContent fills BodyHTML from the body in its format, highlights code,
+// sanitizes it if configured and derives the snippet from the first paragraph
+// when there is none.
+func RenderContent(c *ContentPiece) error {
+	if c.Format == "" {
+		c.Format = FormatHTML
+	}
+	var err error
+	if c.BodyHTML, err = renderBody(c.Body, c.Format); err != nil {
+		return err
+	}
+	if strings.TrimSpace(c.Snippet) == "" {
+		c.Snippet = truncate(FirstParagraph(c.BodyHTML), 280)
+	}
+	return nil
+}
+
+func renderBody(body, format string) (string, error) {
+	switch format {
+	case FormatHTML:
+	case FormatMarkdown:
+		var b bytes.Buffer
+		if err := markdown.Convert([]byte(body), &b); err != nil {
+			return "", err
+		}
+		body = b.String()
+	default:
+		return "", ErrInvalidFormat
+	}
+	body, err := HighlightCode(body)
+	if err != nil {
+		return "", err
+	}
+	return sanitizer.Body(body), nil
+}
+
+// RenderBodies renders every body again when they were saved under another
+// sanitizer policy, such as before -sanitizeBodies was given.
+func RenderBodies(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	policy, err := GetSetting(tx, "body_policy")
+	if err != nil || policy == sanitizer.Policy() {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`SELECT id, body, format FROM content`)
+	if err != nil {
+		return 0, err
+	}
+	var contents []*ContentPiece
+	for rows.Next() {
+		var c ContentPiece
+		if err := rows.Scan(&c.ID, &c.Body, &c.Format); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		contents = append(contents, &c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, c := range contents {
+		if c.BodyHTML, err = renderBody(c.Body, c.Format); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE content SET body_html = ? WHERE id = ?`, c.BodyHTML, c.ID); err != nil {
+			return 0, err
+		}
+	}
+	if err := PutSetting(tx, "body_policy", sanitizer.Policy()); err != nil {
+		return 0, err
+	}
+	return len(contents), tx.Commit()
+}
+
+// FirstParagraph returns the text of the first non-empty paragraph of an HTML
+// fragment.
+func FirstParagraph(s string) string {
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	var b strings.Builder
+	depth := 0
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return ""
+		case xhtml.StartTagToken:
+			if name, _ := z.TagName(); string(name) == "p" {
+				depth++
+			}
+		case xhtml.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "p" && depth > 0 {
+				depth--
+				if depth == 0 {
+					if text := strings.Join(strings.Fields(b.String()), " "); text != "" {
+						return text
+					}
+					b.Reset()
+				}
+			}
+		case xhtml.TextToken:
+			if depth > 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
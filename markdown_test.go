@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderContentMarkdown(t *testing.T) {
+	c := &ContentPiece{Format: FormatMarkdown, Body: "Intro with a note.[^1]\n\n" +
+		"| Name | Size |\n| ---- | ---: |\n| a | 1 |\n\n" +
+		"- [x] done\n- [ ] todo\n\n" +
+		"~~gone~~ https://example.com\n\n" +
+		"```go\nx := 1\n```\n\n" +
+		"[^1]: The note.\n"}
+	if err := RenderContent(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"<table>", "<th>Name</th>", `<td style="text-align:right">1</td>`,
+		`<input checked="" disabled="" type="checkbox"`, `<input disabled="" type="checkbox"`,
+		"<del>gone</del>", `<a href="https://example.com">`,
+		`<sup id="fnref:1"><a href="#fn:1"`, `<li id="fn:1">`,
+		`class="chroma"`,
+	} {
+		if !strings.Contains(c.BodyHTML, want) {
+			t.Errorf("missing %s in:\n%s", want, c.BodyHTML)
+		}
+	}
+	if strings.Contains(c.BodyHTML, "```") {
+		t.Errorf("fenced code left as text:\n%s", c.BodyHTML)
+	}
+	if c.Snippet != "Intro with a note.1" {
+		t.Errorf("snippet %q", c.Snippet)
+	}
+	if c.Body == c.BodyHTML {
+		t.Error("body was changed instead of rendered")
+	}
+}
+
+func TestRenderContentHTML(t *testing.T) {
+	c := &ContentPiece{Body: "<p>Kept *as is*</p>", Snippet: "Mine"}
+	if err := RenderContent(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Format != FormatHTML || c.BodyHTML != c.Body || c.Snippet != "Mine" {
+		t.Errorf("got %q %q %q", c.Format, c.BodyHTML, c.Snippet)
+	}
+
+	c = &ContentPiece{Format: "rst", Body: "x"}
+	if err := RenderContent(c); err != ErrInvalidFormat {
+		t.Errorf("unknown format: %v", err)
+	}
+}
+
+func TestRenderContentLongSnippet(t *testing.T) {
+	c := &ContentPiece{Format: FormatMarkdown, Body: strings.Repeat("word ", 100)}
+	if err := RenderContent(c); err != nil {
+		t.Fatal(err)
+	}
+	if r := []rune(c.Snippet); len(r) != 281 || r[280] != '…' {
+		t.Errorf("snippet not truncated: %q", c.Snippet)
+	}
+}
+
+func TestFirstParagraph(t *testing.T) {
+	tests := []struct {
+		html, want string
+	}{
+		{"", ""},
+		{"<h1>Title</h1><p>First  <em>one</em>\nhere</p><p>Second</p>", "First one here"},
+		{"<p> </p><p></p><p>After empties</p>", "After empties"},
+		{"<blockquote><p>Quoted</p></blockquote><p>Own</p>", "Quoted"},
+		{"Loose text<div>no paragraphs</div>", ""},
+		{"<p>Unclosed", ""},
+	}
+	for _, tt := range tests {
+		if got := FirstParagraph(tt.html); got != tt.want {
+			t.Errorf("FirstParagraph(%q) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
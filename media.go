@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+var (
+	ErrMediaNotFound = errors.New("media not found")
+)
+
+// Media is an uploaded file tracked in the media library. Path is relative to
+// the files directory, as in /files/<path>.
+type Media struct {
+	ID           int64
+	Path         string
+	Size         int64
+	MimeType     string
+	Width        int
+	Height       int
+	Alt          string
+	Checksum     string
+	DateUploaded time.Time
+	ModTime      time.Time `json:"-"`
+	Uses         int
+	PhotoDetails
+}
+
+func (m *Media) URL() string {
+	return "/files" + m.Path
+}
+
+func (m *Media) IsImage() bool {
+	return strings.HasPrefix(m.MimeType, "image/")
+}
+
+func (m *Media) DateString() string {
+	return m.DateUploaded.Format("January 2006 2")
+}
+
+// BrokenReference is a link from a post to a file that doesn't exist.
+type BrokenReference struct {
+	Path      string
+	ContentID Identifier
+	URI       string
+	Title     string
+}
+
+func isMediaFile(name string) bool {
+	base := filepath.Base(name)
+	return !strings.HasPrefix(base, ".") && !legacyThumbnail.MatchString(base)
+}
+
+// InspectMedia reads the size, type, checksum and, for images, dimensions of
+// a file in the store.
+func InspectMedia(files *FileStore, p string) (*Media, error) {
+	full, err := files.Resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := Media{
+		Path:         files.Rel(full),
+		Size:         fi.Size(),
+		DateUploaded: fi.ModTime(),
+		ModTime:      fi.ModTime(),
+	}
+
+	var head bytes.Buffer
+	h := sha256.New()
+	if _, err := io.Copy(h, io.TeeReader(f, &limitedWriter{&head, 1 << 20})); err != nil {
+		return nil, err
+	}
+	m.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	m.MimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(full)))
+	if m.MimeType == "" {
+		m.MimeType = http.DetectContentType(head.Bytes())
+	}
+	if i := strings.Index(m.MimeType, ";"); i >= 0 {
+		m.MimeType = m.MimeType[:i]
+	}
+	if strings.HasPrefix(m.MimeType, "image/") {
+		orientation := 1
+		if m.MimeType == "image/jpeg" {
+			m.PhotoDetails, orientation = ReadExif(bytes.NewReader(head.Bytes()))
+		}
+		if cfg, _, err := image.DecodeConfig(&head); err == nil {
+			m.Width, m.Height = cfg.Width, cfg.Height
+		}
+		// Orientations 5 to 8 turn the photo on its side.
+		if orientation >= 5 {
+			m.Width, m.Height = m.Height, m.Width
+		}
+	}
+	return &m, nil
+}
+
+// limitedWriter keeps the first n bytes written to it and drops the rest.
+type limitedWriter struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if room := w.n - w.buf.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.buf.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+// PutMedia adds a file to the library or updates what changed about it,
+// keeping its alt text unless a new one is given.
+func PutMedia(tx *sql.Tx, m *Media) error {
+	stmt, err := tx.Prepare(`
+INSERT INTO media (
+	path,
+	size,
+	mime_type,
+	width,
+	height,
+	alt,
+	checksum,
+	date_uploaded,
+	mod_time,
+	camera,
+	lens,
+	exposure,
+	taken_at
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (path) DO UPDATE SET
+	size = excluded.size,
+	mime_type = excluded.mime_type,
+	width = excluded.width,
+	height = excluded.height,
+	alt = CASE WHEN excluded.alt != '' THEN excluded.alt ELSE media.alt END,
+	checksum = excluded.checksum,
+	mod_time = excluded.mod_time,
+	camera = excluded.camera,
+	lens = excluded.lens,
+	exposure = excluded.exposure,
+	taken_at = excluded.taken_at`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var takenAt sql.NullTime
+	if !m.TakenAt.IsZero() {
+		takenAt = sql.NullTime{Time: m.TakenAt, Valid: true}
+	}
+	_, err = stmt.Exec(m.Path, m.Size, m.MimeType, m.Width, m.Height, m.Alt, m.Checksum, m.DateUploaded, m.ModTime,
+		m.Camera, m.Lens, m.Exposure, takenAt)
+	return err
+}
+
+// DeleteMedia forgets a file, or every file below it for a directory.
+func DeleteMedia(tx *sql.Tx, p string) error {
+	_, err := tx.Exec(`DELETE FROM media WHERE path = ? OR path LIKE ? ESCAPE '\'`, p, likePrefix(p))
+	return err
+}
+
+func likePrefix(p string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(strings.TrimSuffix(p, "/")) + "/%"
+}
+
+func SetMediaAlt(tx *sql.Tx, id int64, alt string) error {
+	res, err := tx.Exec(`UPDATE media SET alt = ? WHERE id = ?`, alt, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrMediaNotFound
+	}
+	return nil
+}
+
+const mediaColumns = `
+	media.id,
+	media.path,
+	media.size,
+	media.mime_type,
+	media.width,
+	media.height,
+	media.alt,
+	media.checksum,
+	media.date_uploaded,
+	media.mod_time,
+	media.camera,
+	media.lens,
+	media.exposure,
+	media.taken_at`
+
+func scanMedia(rows *sql.Rows) ([]*Media, error) {
+	defer rows.Close()
+	xs := make([]*Media, 0)
+	for rows.Next() {
+		var m Media
+		var takenAt sql.NullTime
+		if err := rows.Scan(&m.ID,
+			&m.Path,
+			&m.Size,
+			&m.MimeType,
+			&m.Width,
+			&m.Height,
+			&m.Alt,
+			&m.Checksum,
+			&m.DateUploaded,
+			&m.ModTime,
+			&m.Camera,
+			&m.Lens,
+			&m.Exposure,
+			&takenAt,
+			&m.Uses); err != nil {
+			return nil, err
+		}
+		m.TakenAt = takenAt.Time
+		xs = append(xs, &m)
+	}
+	return xs, rows.Err()
+}
+
+// GetMedia lists the library, newest first. With unused set only files no
+// post refers to are listed.
+func GetMedia(tx *sql.Tx, unused bool) ([]*Media, error) {
+	q := `
+SELECT` + mediaColumns + `,
+	COUNT(media_usage.content_id)
+FROM media
+LEFT JOIN media_usage ON media_usage.path = media.path
+GROUP BY media.id`
+	if unused {
+		q += `
+HAVING COUNT(media_usage.content_id) = 0`
+	}
+	q += `
+ORDER BY media.date_uploaded DESC`
+	rows, err := tx.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	return scanMedia(rows)
+}
+
+// GetContentPhotos lists the images a content piece shows that have photo
+// details.
+func GetContentPhotos(tx *sql.Tx, id Identifier) ([]*Media, error) {
+	rows, err := tx.Query(`
+SELECT`+mediaColumns+`,
+	(SELECT COUNT(*) FROM media_usage AS u WHERE u.path = media.path)
+FROM media
+JOIN media_usage ON media_usage.path = media.path
+WHERE media_usage.content_id = ?
+AND media.mime_type LIKE 'image/%'
+AND (media.camera != '' OR media.lens != '' OR media.exposure != '' OR media.taken_at IS NOT NULL)
+ORDER BY media.path`, id)
+	if err != nil {
+		return nil, err
+	}
+	return scanMedia(rows)
+}
+
+// GetBrokenReferences lists the links from posts to files that are neither in
+// the library nor on disk.
+func GetBrokenReferences(tx *sql.Tx, files *FileStore) ([]*BrokenReference, error) {
+	rows, err := tx.Query(`
+SELECT
+	media_usage.path,
+	content.id,
+	content.uri,
+	content.title
+FROM media_usage
+JOIN content ON content.id = media_usage.content_id
+LEFT JOIN media ON media.path = media_usage.path
+WHERE media.id IS NULL
+ORDER BY content.date DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*BrokenReference, 0)
+	for rows.Next() {
+		var r BrokenReference
+		if err := rows.Scan(&r.Path, &r.ContentID, &r.URI, &r.Title); err != nil {
+			return nil, err
+		}
+		if full, err := files.Resolve(r.Path); err == nil {
+			if _, err := os.Stat(full); err == nil {
+				continue
+			}
+		}
+		xs = append(xs, &r)
+	}
+	return xs, rows.Err()
+}
+
+// MediaReferences finds the files under /files a body links to or embeds.
+func MediaReferences(body string) []string {
+	var xs []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		u, err := url.Parse(strings.TrimSpace(s))
+		if err != nil || u.Host != "" || !strings.HasPrefix(u.Path, "/files/") {
+			return
+		}
+		p := path.Clean(strings.TrimPrefix(u.Path, "/files"))
+		if !seen[p] {
+			seen[p] = true
+			xs = append(xs, p)
+		}
+	}
+	z := xhtml.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			return xs
+		}
+		if tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+			continue
+		}
+		for _, attr := range z.Token().Attr {
+			switch attr.Key {
+			case "src", "href", "poster":
+				add(attr.Val)
+			case "srcset":
+				for _, candidate := range strings.Split(attr.Val, ",") {
+					if fields := strings.Fields(candidate); len(fields) > 0 {
+						add(fields[0])
+					}
+				}
+			}
+		}
+	}
+}
+
+// UpdateMediaUsage records which files a content piece refers to.
+func UpdateMediaUsage(tx *sql.Tx, c *ContentPiece) error {
+	if err := DeleteMediaUsage(tx, c.ID); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO media_usage (content_id, path) VALUES (?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range MediaReferences(string(c.HTML())) {
+		if _, err := stmt.Exec(c.ID, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteMediaUsage(tx *sql.Tx, id Identifier) error {
+	_, err := tx.Exec(`DELETE FROM media_usage WHERE content_id = ?`, id)
+	return err
+}
+
+// ScanMedia brings the library in line with the files directory and the
+// posts: new or changed files are inspected, removed ones forgotten, and the
+// usage of every post is found again.
+func ScanMedia(db *sql.DB, files *FileStore) error {
+	known := map[string]*Media{}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	xs, err := GetMedia(tx, false)
+	tx.Rollback()
+	if err != nil {
+		return err
+	}
+	for _, m := range xs {
+		known[m.Path] = m
+	}
+
+	// Inspect outside of a transaction, reading files can take a while.
+	var changed []*Media
+	present := map[string]bool{}
+	err = filepath.Walk(files.Root, func(name string, info os.FileInfo, err error) error {
+		// Archived thumbnails of previews aren't yours to manage.
+		if err == nil && info.IsDir() && files.Rel(name) == "/"+ArchiveDir {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() || !isMediaFile(name) {
+			return nil
+		}
+		p := files.Rel(name)
+		present[p] = true
+		if m, ok := known[p]; ok && m.Size == info.Size() && m.ModTime.Equal(info.ModTime()) {
+			return nil
+		}
+		m, err := InspectMedia(files, p)
+		if err != nil {
+			return nil
+		}
+		changed = append(changed, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, m := range changed {
+		if err := PutMedia(tx, m); err != nil {
+			return err
+		}
+	}
+	for p := range known {
+		if !present[p] {
+			if _, err := tx.Exec(`DELETE FROM media WHERE path = ?`, p); err != nil {
+				return err
+			}
+		}
+	}
+
+	rows, err := tx.Query(`SELECT id, body_html FROM content`)
+	if err != nil {
+		return err
+	}
+	var contents []*ContentPiece
+	for rows.Next() {
+		var c ContentPiece
+		if err := rows.Scan(&c.ID, &c.BodyHTML); err != nil {
+			rows.Close()
+			return err
+		}
+		contents = append(contents, &c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, c := range contents {
+		if err := UpdateMediaUsage(tx, c); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddMedia puts a freshly written file into the library.
+func AddMedia(db *sql.DB, files *FileStore, p, alt string) error {
+	m, err := InspectMedia(files, p)
+	if err != nil {
+		return err
+	}
+	m.Alt = strings.TrimSpace(alt)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := PutMedia(tx, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveMedia forgets a deleted file or directory.
+func RemoveMedia(db *sql.DB, p string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := DeleteMedia(tx, p); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending DeliveryStatus = "pending"
+	DeliverySent    DeliveryStatus = "sent"
+	// The target doesn't accept webmentions.
+	DeliveryUnsupported DeliveryStatus = "unsupported"
+	// Gave up after too many attempts or a permanent error.
+	DeliveryFailed DeliveryStatus = "failed"
+)
+
+const (
+	maxDeliveryAttempts = 8
+	deliveryBackoff     = time.Minute
+	maxDeliveryBackoff  = 12 * time.Hour
+)
+
+var (
+	ErrNoEndpoint = errors.New("no webmention endpoint")
+)
+
+// OutgoingWebmention is the delivery state of a mention we send for a link in
+// one of our posts.
+type OutgoingWebmention struct {
+	ID           int64
+	ContentID    Identifier
+	Source       string
+	Target       string
+	Status       DeliveryStatus
+	Removed      bool
+	Endpoint     string
+	Attempts     int
+	NextAttempt  time.Time
+	LastError    string
+	ResponseCode int
+	DateSent     time.Time
+	// Bumped every time the mention is queued.
+	Generation int64
+}
+
+// OutgoingLinks lists the URLs a post should send webmentions to: the URL it
+// responds to and every absolute link in its body that isn't to this site.
+func OutgoingLinks(source string, c *ContentPiece) []string {
+	base, err := url.Parse(source)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var xs []string
+	add := func(s string) {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return
+		}
+		if strings.EqualFold(u.Host, base.Host) {
+			return
+		}
+		u.Fragment = ""
+		s = u.String()
+		if !seen[s] {
+			seen[s] = true
+			xs = append(xs, s)
+		}
+	}
+	if c.ResponseToURL != "" {
+		add(c.ResponseToURL)
+	}
+	z := xhtml.NewTokenizer(strings.NewReader(string(c.HTML())))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			break
+		}
+		if tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+			continue
+		}
+		t := z.Token()
+		if t.Data != "a" {
+			continue
+		}
+		for _, attr := range t.Attr {
+			if attr.Key == "href" {
+				add(ResolveURL(base, attr.Val))
+			}
+		}
+	}
+	return xs
+}
+
+// QueueOutgoingWebmentions schedules a mention to every target for the content
+// piece. Targets that were mentioned before but are no longer linked are sent
+// a mention once more so they notice the link is gone. An empty source keeps
+// the source previously recorded, which is how deleted content is handled.
+// Mentions are held back until notBefore, when the source becomes public.
+func QueueOutgoingWebmentions(tx *sql.Tx, id Identifier, source string, targets []string, notBefore time.Time) error {
+	stmt, err := tx.Prepare(`
+INSERT INTO webmention_outgoing (content_id, source, target, status, removed, attempts, next_attempt, last_error)
+VALUES (?, ?, ?, ?, 0, 0, ?, '')
+ON CONFLICT (content_id, target) DO UPDATE SET
+	source = excluded.source,
+	status = excluded.status,
+	removed = 0,
+	attempts = 0,
+	next_attempt = excluded.next_attempt,
+	last_error = '',
+	generation = generation + 1`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, target := range targets {
+		if _, err := stmt.Exec(id, source, target, DeliveryPending, notBefore); err != nil {
+			return err
+		}
+	}
+
+	// Anything still linked was just reset above, whatever else is left over
+	// was removed from the content.
+	q := `UPDATE webmention_outgoing SET
+	status = ?,
+	removed = 1,
+	attempts = 0,
+	next_attempt = ?,
+	last_error = '',
+	generation = generation + 1`
+	args := []interface{}{DeliveryPending, notBefore}
+	if source != "" {
+		q += `,
+	source = ?`
+		args = append(args, source)
+	}
+	q += `
+	WHERE content_id = ? AND removed = 0`
+	args = append(args, id)
+	if len(targets) > 0 {
+		q += ` AND target NOT IN (?` + strings.Repeat(", ?", len(targets)-1) + `)`
+		for _, target := range targets {
+			args = append(args, target)
+		}
+	}
+	_, err = tx.Exec(q, args...)
+	return err
+}
+
+// QueueContentWebmentions schedules mentions for the links of saved content.
+// Scheduled posts notify their links once they are published. Links of
+// content others can't read are treated as removed.
+func QueueContentWebmentions(tx *sql.Tx, base string, c *ContentPiece) error {
+	source := base + "/post/" + c.URI
+	notBefore := time.Now()
+	if c.Date.After(notBefore) {
+		notBefore = c.Date
+	}
+	var links []string
+	switch c.Visibility {
+	case VisibilityDraft, VisibilityPrivate, VisibilityProtected:
+	default:
+		links = OutgoingLinks(source, c)
+	}
+	return QueueOutgoingWebmentions(tx, c.ID, source, links, notBefore)
+}
+
+const outgoingColumns = `
+	id,
+	content_id,
+	source,
+	target,
+	status,
+	removed,
+	endpoint,
+	attempts,
+	next_attempt,
+	last_error,
+	response_code,
+	date_sent,
+	generation`
+
+func scanOutgoing(scan func(...interface{}) error) (*OutgoingWebmention, error) {
+	var m OutgoingWebmention
+	var sent sql.NullTime
+	if err := scan(&m.ID,
+		&m.ContentID,
+		&m.Source,
+		&m.Target,
+		&m.Status,
+		&m.Removed,
+		&m.Endpoint,
+		&m.Attempts,
+		&m.NextAttempt,
+		&m.LastError,
+		&m.ResponseCode,
+		&sent,
+		&m.Generation); err != nil {
+		return nil, err
+	}
+	m.DateSent = sent.Time
+	return &m, nil
+}
+
+// GetOutgoingWebmentions lists the delivery state of every link of a content
+// piece.
+func GetOutgoingWebmentions(tx *sql.Tx, id Identifier) ([]*OutgoingWebmention, error) {
+	stmt, err := tx.Prepare(`SELECT` + outgoingColumns + ` FROM webmention_outgoing WHERE content_id = ? ORDER BY removed, target`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*OutgoingWebmention, 0)
+	for rows.Next() {
+		m, err := scanOutgoing(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, m)
+	}
+	return xs, rows.Err()
+}
+
+func getDueOutgoing(db *sql.DB, now time.Time, limit int) ([]*OutgoingWebmention, error) {
+	rows, err := db.Query(`SELECT`+outgoingColumns+`
+FROM webmention_outgoing
+WHERE status = ? AND next_attempt <= ?
+ORDER BY next_attempt
+LIMIT ?`, DeliveryPending, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xs []*OutgoingWebmention
+	for rows.Next() {
+		m, err := scanOutgoing(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, m)
+	}
+	return xs, rows.Err()
+}
+
+func nextOutgoingAttempt(db *sql.DB) (time.Time, error) {
+	var t time.Time
+	err := db.QueryRow(`SELECT next_attempt FROM webmention_outgoing WHERE status = ? ORDER BY next_attempt LIMIT 1`, DeliveryPending).Scan(&t)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	return t, err
+}
+
+// recordDelivery saves the outcome of an attempt, unless the mention was
+// queued again while it was being sent.
+func recordDelivery(db *sql.DB, m *OutgoingWebmention) error {
+	var sent interface{}
+	if !m.DateSent.IsZero() {
+		sent = m.DateSent
+	}
+	_, err := db.Exec(`UPDATE webmention_outgoing SET
+	status = ?,
+	endpoint = ?,
+	attempts = ?,
+	next_attempt = ?,
+	last_error = ?,
+	response_code = ?,
+	date_sent = ?
+	WHERE id = ? AND generation = ?`,
+		m.Status, m.Endpoint, m.Attempts, m.NextAttempt, m.LastError, m.ResponseCode, sent,
+		m.ID, m.Generation)
+	return err
+}
+
+// WebmentionSender delivers queued outgoing webmentions in the background,
+// retrying temporary failures with exponential backoff.
+type WebmentionSender struct {
+	DB *sql.DB
+	// Links in posts can point anywhere, endpoints too, so only public
+	// addresses are contacted.
+	Fetcher *Fetcher
+	wake    chan struct{}
+}
+
+func NewWebmentionSender(db *sql.DB, f *Fetcher) *WebmentionSender {
+	return &WebmentionSender{
+		DB:      db,
+		Fetcher: f,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (s *WebmentionSender) Start() {
+	go func() {
+		for {
+			if err := s.SendDue(); err != nil {
+				log.Printf("webmention sender: %s", err)
+			}
+			wait := time.Minute
+			if next, err := nextOutgoingAttempt(s.DB); err == nil && !next.IsZero() {
+				if d := time.Until(next); d < wait {
+					wait = d
+				}
+			}
+			if wait < time.Second {
+				wait = time.Second
+			}
+			select {
+			case <-s.wake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// Wake makes the sender look for due mentions right away.
+func (s *WebmentionSender) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SendDue attempts every mention that is due.
+func (s *WebmentionSender) SendDue() error {
+	for {
+		xs, err := getDueOutgoing(s.DB, time.Now(), 10)
+		if err != nil {
+			return err
+		}
+		if len(xs) == 0 {
+			return nil
+		}
+		for _, m := range xs {
+			s.Deliver(m)
+			if err := recordDelivery(s.DB, m); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Deliver makes a single attempt at sending a mention and updates its state.
+func (s *WebmentionSender) Deliver(m *OutgoingWebmention) {
+	m.Attempts++
+	endpoint, err := DiscoverWebmentionEndpoint(s.Fetcher, m.Target)
+	if err == ErrNoEndpoint {
+		m.Status = DeliveryUnsupported
+		m.LastError = err.Error()
+		return
+	} else if err != nil {
+		s.retry(m, err)
+		return
+	}
+	m.Endpoint = endpoint
+
+	form := url.Values{}
+	form.Set("source", m.Source)
+	form.Set("target", m.Target)
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		m.Status = DeliveryFailed
+		m.LastError = err.Error()
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := s.Fetcher.Do(req, 1<<16)
+	if err == ErrForbiddenAddress || err == ErrUnsupportedScheme {
+		m.Status = DeliveryFailed
+		m.LastError = err.Error()
+		return
+	} else if err != nil {
+		s.retry(m, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	m.ResponseCode = resp.StatusCode
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		m.Status = DeliverySent
+		m.LastError = ""
+		m.DateSent = time.Now()
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		s.retry(m, errors.New(fmt.Sprintf("endpoint responded with %d", resp.StatusCode)))
+	default:
+		m.Status = DeliveryFailed
+		m.LastError = fmt.Sprintf("endpoint responded with %d", resp.StatusCode)
+	}
+}
+
+func (s *WebmentionSender) retry(m *OutgoingWebmention, err error) {
+	m.LastError = err.Error()
+	if m.Attempts >= maxDeliveryAttempts {
+		m.Status = DeliveryFailed
+		return
+	}
+	backoff := deliveryBackoff << uint(m.Attempts-1)
+	if backoff > maxDeliveryBackoff {
+		backoff = maxDeliveryBackoff
+	}
+	m.NextAttempt = time.Now().Add(backoff)
+}
+
+// DiscoverWebmentionEndpoint finds the webmention endpoint of a target as
+// described in https://www.w3.org/TR/webmention/#sender-discovers-receiver-webmention-endpoint
+func DiscoverWebmentionEndpoint(f *Fetcher, target string) (string, error) {
+	xs, err := DiscoverLinks(f, target, "webmention")
+	if err != nil {
+		return "", err
+	}
+	if len(xs) == 0 {
+		return "", ErrNoEndpoint
+	}
+	return xs[0], nil
+}
+
+// DiscoverLinks fetches a page and returns the absolute URLs it links to with
+// the rel, those in the Link header first and then those in the HTML.
+func DiscoverLinks(f *Fetcher, target, rel string) ([]string, error) {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+	resp, err := f.Do(req, maxMentionSourceSize)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return nil, errors.New(fmt.Sprintf("target responded with %d", resp.StatusCode))
+	}
+	base := resp.Request.URL
+
+	var xs []string
+	for _, v := range resp.Header.Values("Link") {
+		for _, link := range ParseLinkHeader(v) {
+			if link.HasRel(rel) {
+				xs = append(xs, ResolveURL(base, link.URL))
+			}
+		}
+	}
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return xs, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	z := xhtml.NewTokenizer(bytes.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == xhtml.ErrorToken {
+			return xs, nil
+		}
+		if tt != xhtml.StartTagToken && tt != xhtml.SelfClosingTagToken {
+			continue
+		}
+		t := z.Token()
+		if t.Data != "link" && t.Data != "a" {
+			continue
+		}
+		var href, rels string
+		var hasHref bool
+		for _, attr := range t.Attr {
+			switch attr.Key {
+			case "href":
+				href, hasHref = attr.Val, true
+			case "rel":
+				rels = attr.Val
+			}
+		}
+		if hasHref && hasRel(rels, rel) {
+			// An empty href links to the page itself.
+			xs = append(xs, ResolveURL(base, href))
+		}
+	}
+}
+
+type HeaderLink struct {
+	URL string
+	Rel string
+}
+
+func (l HeaderLink) HasRel(rel string) bool {
+	return hasRel(l.Rel, rel)
+}
+
+func hasRel(rels, rel string) bool {
+	for _, x := range strings.Fields(rels) {
+		if strings.EqualFold(x, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLinkHeader parses the links of an RFC 8288 Link header value.
+func ParseLinkHeader(s string) []HeaderLink {
+	var xs []HeaderLink
+	for s != "" {
+		start := strings.Index(s, "<")
+		end := strings.Index(s, ">")
+		if start < 0 || end < start {
+			break
+		}
+		link := HeaderLink{URL: s[start+1 : end]}
+		s = s[end+1:]
+		// Parameters run until the next link, commas inside quotes aside.
+		i, quoted := 0, false
+		for ; i < len(s); i++ {
+			if s[i] == '"' {
+				quoted = !quoted
+			} else if s[i] == ',' && !quoted {
+				break
+			}
+		}
+		for _, param := range strings.Split(s[:i], ";") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), "rel") {
+				link.Rel = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+		}
+		xs = append(xs, link)
+		if i < len(s) {
+			i++
+		}
+		s = s[i:]
+	}
+	return xs
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func testFetcher() *Fetcher {
+	f := NewFetcher()
+	f.AllowPrivate = true
+	return f
+}
+
+func TestDiscoverWebmentionEndpoint(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		switch r.URL.Path {
+		case "/header":
+			w.Header().Add("Link", `<https://example.com/other>; rel="other"`)
+			w.Header().Add("Link", `<`+srv.URL+`/endpoint>; rel="webmention"`)
+			fmt.Fprint(w, `<link rel="webmention" href="/not-this-one">`)
+		case "/header-relative":
+			w.Header().Set("Link", `</endpoint?version=1>; rel="webmention other"`)
+		case "/link":
+			fmt.Fprint(w, `<html><head><link rel="stylesheet" href="/style.css"><link href="endpoint" rel="webmention"></head></html>`)
+		case "/a":
+			fmt.Fprint(w, `<p><a href="/a-endpoint" rel="Webmention">endpoint</a></p>`)
+		case "/dir/relative":
+			fmt.Fprint(w, `<link rel="webmention" href="../mention/">`)
+		case "/empty":
+			fmt.Fprint(w, `<link rel="webmention" href="">`)
+		case "/redirect":
+			http.Redirect(w, r, "/dir/relative", http.StatusFound)
+		case "/none":
+			fmt.Fprint(w, `<link rel="me" href="https://example.com/">`)
+		}
+	}))
+	defer srv.Close()
+
+	f := testFetcher()
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/header", srv.URL + "/endpoint"},
+		{"/header-relative", srv.URL + "/endpoint?version=1"},
+		{"/link", srv.URL + "/endpoint"},
+		{"/a", srv.URL + "/a-endpoint"},
+		{"/dir/relative", srv.URL + "/mention/"},
+		// An empty href is the page itself.
+		{"/empty", srv.URL + "/empty"},
+		// Relative to where the redirect ended up.
+		{"/redirect", srv.URL + "/mention/"},
+	}
+	for _, tt := range tests {
+		got, err := DiscoverWebmentionEndpoint(f, srv.URL+tt.path)
+		if err != nil {
+			t.Errorf("%s: %s", tt.path, err)
+		} else if got != tt.want {
+			t.Errorf("%s: endpoint = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	if _, err := DiscoverWebmentionEndpoint(f, srv.URL+"/none"); err != ErrNoEndpoint {
+		t.Errorf("/none: err = %v, want %v", err, ErrNoEndpoint)
+	}
+	if _, err := DiscoverWebmentionEndpoint(NewFetcher(), srv.URL+"/header"); err != ErrForbiddenAddress {
+		t.Errorf("private target: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var source, target string
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/post":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<link rel="webmention" href="/webmention">`)
+		case "/webmention":
+			source, target = r.PostFormValue("source"), r.PostFormValue("target")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer srv.Close()
+
+	s := NewWebmentionSender(nil, testFetcher())
+	m := &OutgoingWebmention{Source: "https://blog.example/post/hi", Target: srv.URL + "/post"}
+	s.Deliver(m)
+	if m.Status != DeliverySent || m.ResponseCode != http.StatusAccepted {
+		t.Errorf("status = %s %d, last error %q", m.Status, m.ResponseCode, m.LastError)
+	}
+	if m.Endpoint != srv.URL+"/webmention" {
+		t.Errorf("endpoint = %q", m.Endpoint)
+	}
+	if source != m.Source || target != m.Target {
+		t.Errorf("endpoint got source %q and target %q", source, target)
+	}
+}
+
+func TestParseLinkHeader(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []HeaderLink
+	}{
+		{"", nil},
+		{`<https://a.example/>; rel="webmention"`, []HeaderLink{{"https://a.example/", "webmention"}}},
+		{`<https://a.example/>; rel=webmention`, []HeaderLink{{"https://a.example/", "webmention"}}},
+		{`</a>; title="x, y"; rel="me webmention", </b>; REL=next`, []HeaderLink{
+			{"/a", "me webmention"},
+			{"/b", "next"},
+		}},
+		{`</a>; type="text/html"`, []HeaderLink{{"/a", ""}}},
+		{`garbage`, nil},
+	}
+	for _, tt := range tests {
+		if got := ParseLinkHeader(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLinkHeader(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	if !(HeaderLink{Rel: "me Webmention"}).HasRel("webmention") {
+		t.Error("HasRel is case sensitive")
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OAuthError is an error response in the shape of OAuth 2.0, used by both
+// Micropub (https://www.w3.org/TR/micropub/#error-response) and IndieAuth.
+type OAuthError struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+func invalidRequest(desc string) *OAuthError {
+	return &OAuthError{Status: 400, Code: "invalid_request", Description: desc}
+}
+
+// MicropubRequest is the JSON form of a request; form encoded requests are
+// converted into it.
+type MicropubRequest struct {
+	Type       []string                 `json:"type"`
+	Properties map[string][]interface{} `json:"properties"`
+	Action     string                   `json:"action"`
+	URL        string                   `json:"url"`
+	Replace    map[string][]interface{} `json:"replace"`
+	Add        map[string][]interface{} `json:"add"`
+	Delete     json.RawMessage          `json:"delete"`
+}
+
+// Form fields which are not properties of the post.
+var micropubReservedFields = map[string]bool{
+	"access_token": true,
+	"h":            true,
+	"action":       true,
+	"url":          true,
+}
+
+func ParseMicropubRequest(c *gin.Context) (*MicropubRequest, error) {
+	var r MicropubRequest
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		if err := json.NewDecoder(io.LimitReader(c.Request.Body, 1<<20)).Decode(&r); err != nil {
+			return nil, invalidRequest("invalid JSON body")
+		}
+		if r.Properties == nil {
+			r.Properties = map[string][]interface{}{}
+		}
+		return &r, nil
+	}
+
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		if _, err := c.MultipartForm(); err != nil {
+			return nil, invalidRequest("invalid multipart body")
+		}
+	} else if err := c.Request.ParseForm(); err != nil {
+		return nil, invalidRequest("invalid form body")
+	}
+	r.Properties = map[string][]interface{}{}
+	if h := c.Request.PostForm.Get("h"); h != "" {
+		r.Type = []string{"h-" + h}
+	}
+	r.Action = c.Request.PostForm.Get("action")
+	r.URL = c.Request.PostForm.Get("url")
+	for k, vs := range c.Request.PostForm {
+		if micropubReservedFields[k] {
+			continue
+		}
+		k = strings.TrimSuffix(k, "[]")
+		for _, v := range vs {
+			r.Properties[k] = append(r.Properties[k], v)
+		}
+	}
+	return &r, nil
+}
+
+func propString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case map[string]interface{}:
+		if s, ok := x["value"].(string); ok {
+			return s
+		}
+		if s, ok := x["html"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func firstProp(props map[string][]interface{}, key string) string {
+	if xs := props[key]; len(xs) > 0 {
+		return strings.TrimSpace(propString(xs[0]))
+	}
+	return ""
+}
+
+// TextToHTML escapes plain text into paragraphs.
+func TextToHTML(s string) string {
+	var xs []string
+	for _, p := range regexp.MustCompile(`\n\s*\n`).Split(strings.TrimSpace(s), -1) {
+		if p = strings.TrimSpace(p); p != "" {
+			xs = append(xs, "<p>"+strings.ReplaceAll(html.EscapeString(p), "\n", "<br>")+"</p>")
+		}
+	}
+	return strings.Join(xs, "\n")
+}
+
+// ApplyProperties maps h-entry properties onto a content piece: like-of makes
+// a heart, repost-of a repost, in-reply-to sets the response URL, category the
+// tags, and notes without a name become statuses.
+func ApplyProperties(c *ContentPiece, props map[string][]interface{}) error {
+	name := firstProp(props, "name")
+
+	// Content is either plain text or an object with html.
+	var text, body string
+	if xs := props["content"]; len(xs) > 0 {
+		switch x := xs[0].(type) {
+		case string:
+			text = strings.TrimSpace(x)
+		case map[string]interface{}:
+			if s, ok := x["html"].(string); ok {
+				body = strings.TrimSpace(s)
+			} else if s, ok := x["value"].(string); ok {
+				text = strings.TrimSpace(s)
+			}
+		}
+	}
+	for _, x := range props["photo"] {
+		src, alt := propString(x), ""
+		if m, ok := x.(map[string]interface{}); ok {
+			alt, _ = m["alt"].(string)
+		}
+		if src == "" {
+			continue
+		}
+		body += `<p><img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `"/></p>`
+	}
+
+	c.ResponseToURL = ""
+	switch {
+	case firstProp(props, "like-of") != "":
+		c.Type = TypeHeart
+		c.ResponseToURL = firstProp(props, "like-of")
+	case firstProp(props, "repost-of") != "":
+		c.Type = TypeRepost
+		c.ResponseToURL = firstProp(props, "repost-of")
+	case name != "":
+		c.Type = TypeDefault
+		c.ResponseToURL = firstProp(props, "in-reply-to")
+	default:
+		c.Type = TypeStatus
+		c.ResponseToURL = firstProp(props, "in-reply-to")
+	}
+
+	if c.Type == TypeStatus {
+		// Statuses keep their text in the title, and only have a body when
+		// there is markup to show.
+		c.Title = text
+		if body != "" {
+			if text != "" {
+				body = TextToHTML(text) + body
+			}
+			c.Title = truncate(StripHTML(body), 140)
+		}
+		c.Body = body
+	} else {
+		c.Title = name
+		c.Body = TextToHTML(text) + body
+	}
+	if c.Type == TypeStatus && c.Title == "" && c.Body == "" {
+		return invalidRequest("missing content")
+	}
+	c.Format = FormatHTML
+
+	c.Snippet = firstProp(props, "summary")
+	c.Tags = nil
+	for _, x := range props["category"] {
+		if s := strings.TrimSpace(propString(x)); s != "" {
+			c.Tags = append(c.Tags, s)
+		}
+	}
+	if s := firstProp(props, "published"); s != "" {
+		d, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			if d, err = time.ParseInLocation("2006-01-02T15:04:05", s, time.Local); err != nil {
+				return invalidRequest("invalid published date")
+			}
+		}
+		c.Date = d
+	}
+	if c.Date.IsZero() {
+		c.Date = time.Now()
+	}
+	switch firstProp(props, "visibility") {
+	case "":
+	case "public":
+		c.Visibility = VisibilityPublished
+	case "unlisted":
+		c.Visibility = VisibilityUnlisted
+	case "private":
+		c.Visibility = VisibilityPrivate
+	default:
+		return invalidRequest("visibility must be public, unlisted or private")
+	}
+	switch firstProp(props, "post-status") {
+	case "":
+	case "draft":
+		c.Visibility = VisibilityDraft
+	case "published":
+		if c.Visibility == VisibilityDraft {
+			c.Visibility = VisibilityPublished
+		}
+	default:
+		return invalidRequest("post-status must be published or draft")
+	}
+	if s := firstProp(props, "mp-slug"); s != "" {
+		c.URI = TitleToURI(s)
+	}
+	if c.URI == "" {
+		if c.Title != "" && c.Type == TypeDefault {
+			c.URI = TitleToURI(c.Title)
+		} else {
+			c.URI = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	}
+	return nil
+}
+
+// ContentProperties is the reverse of ApplyProperties, used for q=source and
+// to apply updates.
+func ContentProperties(base string, c *ContentPiece) map[string][]interface{} {
+	props := map[string][]interface{}{
+		"url":       {base + "/post/" + c.URI},
+		"published": {c.Date.Format(time.RFC3339)},
+		"mp-slug":   {c.URI},
+	}
+	switch c.Type {
+	case TypeHeart:
+		props["like-of"] = []interface{}{c.ResponseToURL}
+	case TypeRepost:
+		props["repost-of"] = []interface{}{c.ResponseToURL}
+	default:
+		if c.ResponseToURL != "" {
+			props["in-reply-to"] = []interface{}{c.ResponseToURL}
+		}
+	}
+	body := strings.TrimSpace(string(c.HTML()))
+	if c.Type == TypeStatus && body == "" {
+		props["content"] = []interface{}{c.Title}
+	} else {
+		if c.Title != "" && c.Type != TypeStatus {
+			props["name"] = []interface{}{c.Title}
+		}
+		if body != "" {
+			props["content"] = []interface{}{map[string]interface{}{"html": body}}
+		}
+	}
+	if c.Snippet != "" {
+		props["summary"] = []interface{}{c.Snippet}
+	}
+	switch c.Visibility {
+	case VisibilityDraft:
+		props["post-status"] = []interface{}{"draft"}
+	case VisibilityUnlisted:
+		props["visibility"] = []interface{}{"unlisted"}
+	case VisibilityPrivate:
+		props["visibility"] = []interface{}{"private"}
+	}
+	if len(c.Tags) > 0 {
+		var tags []interface{}
+		for _, t := range c.Tags {
+			tags = append(tags, t)
+		}
+		props["category"] = tags
+	}
+	return props
+}
+
+// ApplyUpdate applies the replace, add and delete operations of an update
+// request to a set of properties.
+func ApplyUpdate(props map[string][]interface{}, r *MicropubRequest) error {
+	for k, vs := range r.Replace {
+		props[k] = vs
+	}
+	for k, vs := range r.Add {
+		props[k] = append(props[k], vs...)
+	}
+	if len(r.Delete) == 0 {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(r.Delete, &names); err == nil {
+		for _, k := range names {
+			delete(props, k)
+		}
+		return nil
+	}
+	var values map[string][]interface{}
+	if err := json.Unmarshal(r.Delete, &values); err != nil {
+		return invalidRequest("invalid delete")
+	}
+	for k, vs := range values {
+		var keep []interface{}
+		for _, x := range props[k] {
+			removed := false
+			for _, v := range vs {
+				if propString(x) == propString(v) {
+					removed = true
+				}
+			}
+			if !removed {
+				keep = append(keep, x)
+			}
+		}
+		props[k] = keep
+	}
+	return nil
+}
+
+// Micropub implements https://www.w3.org/TR/micropub/ on top of content.
+type Micropub struct {
+	DB        *sql.DB
+	Config    Config
+	Sender    *WebmentionSender
+	Scheduler *Scheduler
+	Previews  *PreviewWorker
+	Files     *FileStore
+}
+
+func (m *Micropub) fail(c *gin.Context, err error) {
+	if e, ok := err.(*OAuthError); ok {
+		c.JSON(e.Status, e)
+		return
+	}
+	switch err {
+	case ErrContentNotFound:
+		c.JSON(404, &OAuthError{Code: "not_found"})
+	case ErrURIUsed, ErrInvalidType, ErrFileType, ErrFileTooLarge, ErrInvalidFilename,
+		ErrForbiddenAddress, ErrUnsupportedScheme, ErrTooManyRedirects,
+		ErrInvalidVisibility, ErrPostPasswordRequired:
+		c.JSON(400, invalidRequest(err.Error()))
+	default:
+		c.JSON(500, &OAuthError{Code: "server_error", Description: err.Error()})
+	}
+}
+
+// Authorize accepts a logged in session or a bearer token with the scopes. Any
+// valid token will do without scopes.
+func (m *Micropub) Authorize(c *gin.Context, scopes ...string) bool {
+	if IsAuthorized(c, scopes...) || (len(scopes) == 0 && CurrentToken(c) != nil) {
+		return true
+	}
+	if CurrentToken(c) == nil {
+		m.fail(c, &OAuthError{Status: 401, Code: "unauthorized", Description: "missing or invalid access token"})
+	} else {
+		m.fail(c, &OAuthError{Status: 403, Code: "insufficient_scope", Scope: strings.Join(scopes, " ")})
+	}
+	return false
+}
+
+func (m *Micropub) HandleQuery(c *gin.Context) {
+	// Queries only read, they need no particular scope, except for the source
+	// of posts others can't read.
+	if !m.Authorize(c) {
+		return
+	}
+	base := GetBaseURL(c, m.Config.BaseURL)
+	switch c.Query("q") {
+	case "config":
+		c.JSON(200, gin.H{
+			"media-endpoint": base + "/micropub/media",
+			"syndicate-to":   []string{},
+			"visibility":     []string{"public", "unlisted", "private"},
+			"post-status":    []string{"published", "draft"},
+			"post-types": []gin.H{
+				{"type": "article", "name": "Post"},
+				{"type": "note", "name": "Status"},
+				{"type": "reply", "name": "Reply"},
+				{"type": "like", "name": "Heart"},
+				{"type": "repost", "name": "Repost"},
+				{"type": "photo", "name": "Photo"},
+			},
+		})
+	case "syndicate-to":
+		c.JSON(200, gin.H{"syndicate-to": []string{}})
+	case "source":
+		uri, err := TargetContentURI(base, c.Query("url"))
+		if err != nil {
+			m.fail(c, invalidRequest("url is not a post of this site"))
+			return
+		}
+		tx, err := m.DB.Begin()
+		if err != nil {
+			m.fail(c, err)
+			return
+		}
+		content, err := GetContent(tx, uri)
+		tx.Rollback()
+		if err != nil {
+			m.fail(c, err)
+			return
+		}
+		// Drafts, private and protected posts are only shown to clients that
+		// write posts.
+		if !CanRead(c, content) && !IsAuthorized(c, "create") && !m.Authorize(c, "update") {
+			return
+		}
+		props := ContentProperties(base, content)
+		if want := c.QueryArray("properties[]"); len(want) > 0 {
+			filtered := map[string][]interface{}{}
+			for _, k := range want {
+				if v, ok := props[k]; ok {
+					filtered[k] = v
+				}
+			}
+			c.JSON(200, gin.H{"properties": filtered})
+			return
+		}
+		c.JSON(200, gin.H{"type": []string{"h-entry"}, "properties": props})
+	default:
+		m.fail(c, invalidRequest("unsupported query"))
+	}
+}
+
+func (m *Micropub) HandlePost(c *gin.Context) {
+	r, err := ParseMicropubRequest(c)
+	if err != nil {
+		m.fail(c, err)
+		return
+	}
+	switch r.Action {
+	case "", "create":
+		m.create(c, r)
+	case "update", "delete", "undelete":
+		if !m.Authorize(c, r.Action) {
+			return
+		}
+		m.modify(c, r)
+	default:
+		m.fail(c, invalidRequest("unsupported action"))
+	}
+}
+
+func (m *Micropub) create(c *gin.Context, r *MicropubRequest) {
+	if !m.Authorize(c, "create") {
+		return
+	}
+	if len(r.Type) > 0 && r.Type[0] != "h-entry" {
+		m.fail(c, invalidRequest("only h-entry is supported"))
+		return
+	}
+	// Photos can be uploaded along with the post.
+	if form := c.Request.MultipartForm; form != nil {
+		for _, k := range []string{"photo", "photo[]"} {
+			for _, h := range form.File[k] {
+				p, err := m.Files.SaveMedia(h)
+				if err := LogFileOperation(m.DB, c, "upload", p, err); err != nil {
+					m.fail(c, err)
+					return
+				}
+				if err == nil {
+					err = AddMedia(m.DB, m.Files, p, "")
+				}
+				if err != nil {
+					m.fail(c, err)
+					return
+				}
+				r.Properties["photo"] = append(r.Properties["photo"], "/files"+p)
+			}
+		}
+	}
+
+	var content ContentPiece
+	if err := ApplyProperties(&content, r.Properties); err != nil {
+		m.fail(c, err)
+		return
+	}
+	base := GetBaseURL(c, m.Config.BaseURL)
+	tx, err := m.DB.Begin()
+	if err != nil {
+		m.fail(c, err)
+		return
+	}
+	if err := CreateContent(tx, &content); err != nil {
+		tx.Rollback()
+		m.fail(c, err)
+		return
+	}
+	if err := QueueContentWebmentions(tx, base, &content); err != nil {
+		tx.Rollback()
+		m.fail(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		m.fail(c, err)
+		return
+	}
+	m.Sender.Wake()
+	m.Scheduler.Wake()
+	m.Previews.Wake()
+	c.Header("Location", base+"/post/"+content.URI)
+	c.Status(201)
+}
+
+func (m *Micropub) modify(c *gin.Context, r *MicropubRequest) {
+	base := GetBaseURL(c, m.Config.BaseURL)
+	uri, err := TargetContentURI(base, r.URL)
+	if err != nil {
+		m.fail(c, invalidRequest("url is not a post of this site"))
+		return
+	}
+	tx, err := m.DB.Begin()
+	if err != nil {
+		m.fail(c, err)
+		return
+	}
+
+	var content *ContentPiece
+	switch r.Action {
+	case "delete":
+		content, err = GetContent(tx, uri)
+		if err == nil {
+			err = DeleteContent(tx, content)
+		}
+		if err == nil {
+			err = QueueOutgoingWebmentions(tx, content.ID, "", nil, time.Now())
+		}
+	case "undelete":
+		var rev *Revision
+		rev, err = GetDeletedRevision(tx, uri)
+		if err == nil {
+			content = &rev.ContentPiece
+			// Revisions saved before they kept the password can't be
+			// protected again, only the author can read them then.
+			if content.Visibility == VisibilityProtected && content.PasswordHash == "" {
+				content.Visibility = VisibilityPrivate
+			}
+			err = CreateContent(tx, content)
+		}
+		if err == nil {
+			err = QueueContentWebmentions(tx, base, content)
+		}
+	case "update":
+		content, err = GetContent(tx, uri)
+		if err == nil {
+			source, format, rendered := content.Body, content.Format, strings.TrimSpace(string(content.HTML()))
+			props := ContentProperties(base, content)
+			if err = ApplyUpdate(props, r); err == nil {
+				err = ApplyProperties(content, props)
+			}
+			// Keep the Markdown source unless the content was changed.
+			if err == nil && format == FormatMarkdown && content.Body == rendered {
+				content.Body, content.Format = source, format
+			}
+			// The URI is only slugified again when a new mp-slug is given, so an
+			// edit can't move a post.
+			if _, ok := r.Replace["mp-slug"]; !ok {
+				content.URI = uri
+			}
+		}
+		if err == nil {
+			err = UpdateContent(tx, content)
+		}
+		if err == nil {
+			err = QueueContentWebmentions(tx, base, content)
+		}
+	}
+	if err == ErrRevisionNotFound {
+		err = ErrContentNotFound
+	}
+	if err != nil {
+		tx.Rollback()
+		m.fail(c, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		m.fail(c, err)
+		return
+	}
+	m.Sender.Wake()
+	m.Scheduler.Wake()
+	m.Previews.Wake()
+	if r.Action != "delete" && content.URI != uri {
+		c.Header("Location", base+"/post/"+content.URI)
+		c.Status(201)
+		return
+	}
+	c.Status(204)
+}
+
+// HandleMedia is the media endpoint, see https://www.w3.org/TR/micropub/#media-endpoint
+func (m *Micropub) HandleMedia(c *gin.Context) {
+	if !m.Authorize(c, "media") {
+		return
+	}
+	h, err := c.FormFile("file")
+	if err != nil {
+		m.fail(c, invalidRequest("missing file"))
+		return
+	}
+	p, err := m.Files.SaveMedia(h)
+	if err := LogFileOperation(m.DB, c, "upload", p, err); err != nil {
+		m.fail(c, err)
+		return
+	}
+	if err == nil {
+		err = AddMedia(m.DB, m.Files, p, "")
+	}
+	if err != nil {
+		m.fail(c, err)
+		return
+	}
+	c.Header("Location", GetBaseURL(c, m.Config.BaseURL)+"/files"+p)
+	c.Status(201)
+}
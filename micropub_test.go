@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-contrib/sessions/cookie"
+	"github.com/gin-gonic/gin"
+)
+
+func TestApplyUpdate(t *testing.T) {
+	props := func() map[string][]interface{} {
+		return map[string][]interface{}{
+			"name":     {"Hello"},
+			"category": {"go", "web", "test"},
+		}
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    map[string][]interface{}
+	}{
+		{"replace", `{"replace": {"name": ["Bye"]}}`, map[string][]interface{}{
+			"name":     {"Bye"},
+			"category": {"go", "web", "test"},
+		}},
+		{"add", `{"add": {"category": ["new"], "summary": ["Hi"]}}`, map[string][]interface{}{
+			"name":     {"Hello"},
+			"category": {"go", "web", "test", "new"},
+			"summary":  {"Hi"},
+		}},
+		{"delete properties", `{"delete": ["category", "missing"]}`, map[string][]interface{}{
+			"name": {"Hello"},
+		}},
+		{"delete values", `{"delete": {"category": ["web", "missing"]}}`, map[string][]interface{}{
+			"name":     {"Hello"},
+			"category": {"go", "test"},
+		}},
+	}
+	for _, tt := range tests {
+		var r MicropubRequest
+		if err := json.Unmarshal([]byte(tt.request), &r); err != nil {
+			t.Fatal(err)
+		}
+		got := props()
+		if err := ApplyUpdate(got, &r); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	r := MicropubRequest{Delete: json.RawMessage(`"name"`)}
+	if err := ApplyUpdate(props(), &r); err == nil {
+		t.Error("invalid delete: no error")
+	}
+}
+
+const testBaseURL = "https://blog.example"
+
+// testMicropub serves Micropub to a client holding a token with the scope.
+func testMicropub(t *testing.T, scope string) (*gin.Engine, *sql.DB) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{BaseURL: testBaseURL}
+	m := &Micropub{
+		DB:        db,
+		Config:    cfg,
+		Sender:    NewWebmentionSender(db, testFetcher()),
+		Scheduler: NewScheduler(db, NewEvents()),
+		Previews:  NewPreviewWorker(db, NewScraper(testFetcher(), nil), nil, time.Hour),
+	}
+	r := gin.New()
+	r.Use(sessions.Sessions("weblog", cookie.NewStore([]byte("secret"))))
+	r.Use(func(c *gin.Context) {
+		if scope != "" {
+			c.Set("token", &AccessToken{Scope: scope})
+		}
+	})
+	r.GET("/micropub", m.HandleQuery)
+	r.POST("/micropub", m.HandlePost)
+	return r, db
+}
+
+func micropubDo(r *gin.Engine, method, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if method == "GET" {
+		req = httptest.NewRequest("GET", "/micropub?"+body, nil)
+	} else {
+		req = httptest.NewRequest("POST", "/micropub", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func testCreate(t *testing.T, db *sql.DB, c *ContentPiece) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := CreateContent(tx, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testGet(t *testing.T, db *sql.DB, uri string) *ContentPiece {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	c, err := GetContent(tx, uri)
+	if err != nil {
+		t.Fatalf("%s: %s", uri, err)
+	}
+	return c
+}
+
+func TestMicropubQueryNeedsAnyToken(t *testing.T) {
+	r, db := testMicropub(t, "profile")
+	testCreate(t, db, &ContentPiece{Title: "Hello", Body: "<p>Hi</p>", Type: TypeDefault, URI: "hello", Date: time.Now()})
+	q := url.Values{"q": {"source"}, "url": {testBaseURL + "/post/hello"}}
+	if w := micropubDo(r, "GET", q.Encode()); w.Code != 200 {
+		t.Errorf("source with a profile token: %d %s", w.Code, w.Body)
+	}
+
+	r, _ = testMicropub(t, "")
+	if w := micropubDo(r, "GET", "q=config"); w.Code != 401 {
+		t.Errorf("config without a token: %d", w.Code)
+	}
+}
+
+func TestMicropubSourceOfHiddenPosts(t *testing.T) {
+	for _, scope := range []string{"media", "profile", "create", "update"} {
+		r, db := testMicropub(t, scope)
+		testCreate(t, db, &ContentPiece{Title: "Diary", Body: "<p>Dear diary</p>", Type: TypeDefault, URI: "diary", Date: time.Now(), Visibility: VisibilityPrivate})
+		secret := &ContentPiece{Title: "Secret", Body: "<p>Psst</p>", Type: TypeDefault, URI: "secret", Date: time.Now(), Visibility: VisibilityProtected}
+		if err := secret.SetPassword("hunter2"); err != nil {
+			t.Fatal(err)
+		}
+		testCreate(t, db, secret)
+
+		for _, uri := range []string{"diary", "secret"} {
+			q := url.Values{"q": {"source"}, "url": {testBaseURL + "/post/" + uri}}
+			w := micropubDo(r, "GET", q.Encode())
+			writer := scope == "create" || scope == "update"
+			if writer && w.Code != 200 {
+				t.Errorf("%s with a %s token: %d %s", uri, scope, w.Code, w.Body)
+			} else if !writer && (w.Code != 403 || strings.Contains(w.Body.String(), "Psst") || strings.Contains(w.Body.String(), "Dear diary")) {
+				t.Errorf("%s with a %s token: %d %s", uri, scope, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestMicropubUpdateKeepsURI(t *testing.T) {
+	r, db := testMicropub(t, "update")
+	// Made before URIs were slugs.
+	testCreate(t, db, &ContentPiece{Title: "Hello", Body: "<p>Hi</p>", Type: TypeDefault, URI: "Hello_World", Date: time.Now()})
+
+	w := micropubDo(r, "POST", `{"action": "update", "url": "`+testBaseURL+`/post/Hello_World", "replace": {"name": ["Hello again"]}}`)
+	if w.Code != 204 {
+		t.Fatalf("update: %d %s", w.Code, w.Body)
+	}
+	if c := testGet(t, db, "Hello_World"); c.Title != "Hello again" {
+		t.Errorf("title = %q", c.Title)
+	}
+
+	w = micropubDo(r, "POST", `{"action": "update", "url": "`+testBaseURL+`/post/Hello_World", "replace": {"mp-slug": ["New Home"]}}`)
+	if w.Code != 201 || w.Header().Get("Location") != testBaseURL+"/post/new-home" {
+		t.Fatalf("rename: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	testGet(t, db, "new-home")
+}
+
+func TestMicropubUndeleteProtected(t *testing.T) {
+	r, db := testMicropub(t, "delete undelete")
+	c := &ContentPiece{Title: "Secret", Body: "<p>Psst</p>", Type: TypeDefault, URI: "secret", Date: time.Now(), Visibility: VisibilityProtected}
+	if err := c.SetPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, db, c)
+
+	post := `"url": "` + testBaseURL + `/post/secret"`
+	if w := micropubDo(r, "POST", `{"action": "delete", `+post+`}`); w.Code != 204 {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	if w := micropubDo(r, "POST", `{"action": "undelete", `+post+`}`); w.Code != 204 {
+		t.Fatalf("undelete: %d %s", w.Code, w.Body)
+	}
+	c = testGet(t, db, "secret")
+	if c.Visibility != VisibilityProtected || c.CheckPassword("hunter2") != nil {
+		t.Errorf("undeleted as %s without its password", c.Visibility)
+	}
+}
+
+func TestMicropubFailVisibility(t *testing.T) {
+	m := &Micropub{}
+	for _, err := range []error{ErrInvalidVisibility, ErrPostPasswordRequired} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		m.fail(c, err)
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "invalid_request") {
+			t.Errorf("%s: %d %s", err, w.Code, w.Body)
+		}
+	}
+}
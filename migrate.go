@@ -0,0 +1,561 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Migration moves the database schema from Version-1 to Version. Migrations
+// must only rely on the schema as it was at their version, never on the
+// current model code, as they are replayed against old databases.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+var (
+	ErrSchemaTooNew = errors.New("database schema is newer than this version of weblog")
+)
+
+// Migrations are applied in order. Only ever append to this list.
+var Migrations = []Migration{
+	{1, "create content, tag and url_preview tables", migrateInitial},
+	{2, "create content search index", migrateSearch},
+	{3, "store content columns as text and type as an integer", migrateContentTypes},
+	{4, "index content uri, content date and tags", migrateIndexes},
+	{5, "create content revision history", migrateRevisions},
+	{6, "create webmention table", migrateWebmentions},
+	{7, "create outgoing webmention table", migrateOutgoingWebmentions},
+	{8, "create IndieAuth code and token tables", migrateIndieAuth},
+	{9, "create settings table", migrateSettings},
+	{10, "create file audit log", migrateFileAudit},
+	{11, "create media library", migrateMedia},
+	{12, "add photo details to media", migratePhotoDetails},
+	{13, "add body format and rendered body to content", migrateContentFormat},
+	{14, "add visibility and password to content", migrateVisibility},
+	{15, "add publish date to content", migrateDatePublished},
+	{16, "add scrape status to url previews", migratePreviewStatus},
+	{17, "add archived copies to url previews and create link check table", migrateArchive},
+	{18, "add scrape strategy to url previews", migratePreviewStrategy},
+	{19, "add deletion date to content revisions", migrateRevisionDeleted},
+	{20, "add password to content revisions", migrateRevisionPassword},
+	{21, "add expiry to access tokens", migrateTokenExpiry},
+	{22, "remove protected posts from the search index", migrateSearchProtected},
+}
+
+// SchemaVersion returns the version of the newest migration applied.
+func SchemaVersion(tx *sql.Tx) (int, error) {
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		date_applied DATETIME
+	)`); err != nil {
+		return 0, err
+	}
+	var version int
+	err := tx.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies every pending migration inside a single transaction. When
+// dryRun is set the transaction is rolled back instead of committed, leaving
+// the database untouched, schema_version included. The migrations that were
+// (or would have been) applied are returned.
+func Migrate(db *sql.DB, dryRun bool) ([]Migration, error) {
+	if _, err := db.Exec(`PRAGMA foreign_keys = ON`); err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	version, err := SchemaVersion(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	latest := Migrations[len(Migrations)-1].Version
+	if version > latest {
+		tx.Rollback()
+		return nil, ErrSchemaTooNew
+	}
+	var pending []Migration
+	for _, m := range Migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	for _, m := range pending {
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_version (version, description, date_applied) VALUES (?, ?, ?)`,
+			m.Version, m.Description, time.Now()); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if dryRun {
+		return pending, tx.Rollback()
+	}
+	return pending, tx.Commit()
+}
+
+func migrateInitial(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS content (
+		title STRING,
+		body  STRING,
+		snippet STRING,
+		date DATETIME,
+		date_created DATETIME,
+		id STRING PRIMARY KEY,
+		response_to STRING,
+		type STRING,
+		uri STRING
+	);
+	CREATE TABLE IF NOT EXISTS tag (
+		id STRING,
+		value STRING
+	);
+	CREATE TABLE IF NOT EXISTS url_preview (
+		url STRING PRIMARY KEY,
+		title STRING,
+		snippet STRING,
+		date_crawled DATETIME,
+		oembed_html STRING,
+		thumbnail_url STRING
+	);`)
+	return err
+}
+
+func migrateSearch(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	DROP TABLE IF EXISTS content_search;
+	CREATE VIRTUAL TABLE content_search USING fts5(
+		id UNINDEXED,
+		title,
+		body,
+		snippet,
+		tags,
+		preview_title,
+		preview_snippet,
+		tokenize = 'porter unicode61'
+	);`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`
+SELECT
+	t1.id,
+	IFNULL(t1.title, ""),
+	IFNULL(t1.body, ""),
+	IFNULL(t1.snippet, ""),
+	(SELECT IFNULL(GROUP_CONCAT(value, " "), "") FROM tag WHERE id = t1.id),
+	IFNULL(t2.title, ""),
+	IFNULL(t2.snippet, "")
+FROM
+	content AS t1
+	LEFT JOIN url_preview AS t2 ON (t1.response_to = t2.url)`)
+	if err != nil {
+		return err
+	}
+	var xs [][]interface{}
+	for rows.Next() {
+		var id, title, body, snippet, tags, previewTitle, previewSnippet string
+		if err := rows.Scan(&id, &title, &body, &snippet, &tags, &previewTitle, &previewSnippet); err != nil {
+			rows.Close()
+			return err
+		}
+		xs = append(xs, []interface{}{id, title, migrateSearchText(body), snippet, tags, previewTitle, previewSnippet})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO content_search (
+	id,
+	title,
+	body,
+	snippet,
+	tags,
+	preview_title,
+	preview_snippet
+) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, args := range xs {
+		if _, err := stmt.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSearchText is StripHTML as it was at version 2.
+func migrateSearchText(s string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case xhtml.StartTagToken:
+			name, _ := z.TagName()
+			if n := string(name); n == "script" || n == "style" {
+				skip++
+			}
+			b.WriteString(" ")
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			if n := string(name); (n == "script" || n == "style") && skip > 0 {
+				skip--
+			}
+			b.WriteString(" ")
+		case xhtml.SelfClosingTagToken:
+			b.WriteString(" ")
+		case xhtml.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+// Columns declared as STRING get NUMERIC affinity in SQLite, so titles and
+// URIs made of digits were stored as numbers. SQLite can't alter column types
+// so the tables are rebuilt.
+func migrateContentTypes(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE content_new (
+		title TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		snippet TEXT NOT NULL DEFAULT '',
+		date DATETIME,
+		date_created DATETIME,
+		id TEXT PRIMARY KEY,
+		response_to TEXT NOT NULL DEFAULT '',
+		type INTEGER NOT NULL DEFAULT 0,
+		uri TEXT NOT NULL DEFAULT ''
+	);
+	INSERT INTO content_new SELECT
+		CAST(IFNULL(title, '') AS TEXT),
+		CAST(IFNULL(body, '') AS TEXT),
+		CAST(IFNULL(snippet, '') AS TEXT),
+		date,
+		date_created,
+		CAST(id AS TEXT),
+		CAST(IFNULL(response_to, '') AS TEXT),
+		CAST(IFNULL(type, 0) AS INTEGER),
+		CAST(IFNULL(uri, '') AS TEXT)
+	FROM content;
+	DROP TABLE content;
+	ALTER TABLE content_new RENAME TO content;
+
+	CREATE TABLE tag_new (
+		id TEXT NOT NULL,
+		value TEXT NOT NULL
+	);
+	INSERT INTO tag_new SELECT CAST(id AS TEXT), CAST(value AS TEXT) FROM tag WHERE id IS NOT NULL AND value IS NOT NULL;
+	DROP TABLE tag;
+	ALTER TABLE tag_new RENAME TO tag;
+
+	CREATE TABLE url_preview_new (
+		url TEXT PRIMARY KEY,
+		title TEXT NOT NULL DEFAULT '',
+		snippet TEXT NOT NULL DEFAULT '',
+		date_crawled DATETIME,
+		oembed_html TEXT NOT NULL DEFAULT '',
+		thumbnail_url TEXT NOT NULL DEFAULT ''
+	);
+	INSERT INTO url_preview_new SELECT
+		CAST(url AS TEXT),
+		CAST(IFNULL(title, '') AS TEXT),
+		CAST(IFNULL(snippet, '') AS TEXT),
+		date_crawled,
+		CAST(IFNULL(oembed_html, '') AS TEXT),
+		CAST(IFNULL(thumbnail_url, '') AS TEXT)
+	FROM url_preview;
+	DROP TABLE url_preview;
+	ALTER TABLE url_preview_new RENAME TO url_preview;`)
+	return err
+}
+
+func migrateIndexes(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE INDEX IF NOT EXISTS content_uri ON content (uri);
+	CREATE INDEX IF NOT EXISTS content_date ON content (date);
+	CREATE INDEX IF NOT EXISTS tag_id_value ON tag (id, value);`)
+	return err
+}
+
+func migrateRevisions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE content_revision (
+		revision INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL,
+		title TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		snippet TEXT NOT NULL DEFAULT '',
+		date DATETIME,
+		type INTEGER NOT NULL DEFAULT 0,
+		response_to TEXT NOT NULL DEFAULT '',
+		uri TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		date_revised DATETIME
+	);
+	CREATE INDEX content_revision_id ON content_revision (id, revision);
+	INSERT INTO content_revision (id, title, body, snippet, date, type, response_to, uri, tags, date_revised)
+	SELECT
+		t1.id,
+		t1.title,
+		t1.body,
+		t1.snippet,
+		t1.date,
+		t1.type,
+		t1.response_to,
+		t1.uri,
+		(SELECT IFNULL(GROUP_CONCAT(value, ","), "") FROM tag WHERE id = t1.id),
+		t1.date_created
+	FROM content AS t1;`)
+	return err
+}
+
+func migrateWebmentions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE webmention (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		source TEXT NOT NULL,
+		target TEXT NOT NULL,
+		content_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		type TEXT NOT NULL DEFAULT 'mention',
+		author_name TEXT NOT NULL DEFAULT '',
+		author_url TEXT NOT NULL DEFAULT '',
+		author_photo TEXT NOT NULL DEFAULT '',
+		content TEXT NOT NULL DEFAULT '',
+		url TEXT NOT NULL DEFAULT '',
+		published DATETIME,
+		error TEXT NOT NULL DEFAULT '',
+		date_received DATETIME NOT NULL,
+		date_verified DATETIME,
+		UNIQUE (source, target)
+	);
+	CREATE INDEX webmention_content_id ON webmention (content_id, status);`)
+	return err
+}
+
+func migrateOutgoingWebmentions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE webmention_outgoing (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		content_id TEXT NOT NULL,
+		source TEXT NOT NULL,
+		target TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		removed INTEGER NOT NULL DEFAULT 0,
+		endpoint TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt DATETIME NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		response_code INTEGER NOT NULL DEFAULT 0,
+		date_sent DATETIME,
+		generation INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (content_id, target)
+	);
+	CREATE INDEX webmention_outgoing_due ON webmention_outgoing (status, next_attempt);`)
+	return err
+}
+
+func migrateIndieAuth(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE auth_code (
+		code TEXT PRIMARY KEY,
+		client_id TEXT NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		scope TEXT NOT NULL DEFAULT '',
+		code_challenge TEXT NOT NULL,
+		me TEXT NOT NULL,
+		expires DATETIME NOT NULL
+	);
+	CREATE TABLE access_token (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT NOT NULL UNIQUE,
+		client_id TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		me TEXT NOT NULL,
+		date_issued DATETIME NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0
+	);`)
+	return err
+}
+
+func migrateSettings(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE setting (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`)
+	return err
+}
+
+func migrateFileAudit(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE file_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		date DATETIME NOT NULL,
+		action TEXT NOT NULL,
+		path TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	)`)
+	return err
+}
+
+func migrateMedia(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE media (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL UNIQUE,
+		size INTEGER NOT NULL,
+		mime_type TEXT NOT NULL,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		alt TEXT NOT NULL DEFAULT '',
+		checksum TEXT NOT NULL,
+		date_uploaded DATETIME NOT NULL,
+		mod_time DATETIME NOT NULL
+	);
+	CREATE TABLE media_usage (
+		content_id TEXT NOT NULL,
+		path TEXT NOT NULL,
+		PRIMARY KEY (content_id, path)
+	);
+	CREATE INDEX media_usage_path ON media_usage (path);`)
+	return err
+}
+
+func migratePhotoDetails(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE media ADD COLUMN camera TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN lens TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN exposure TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN taken_at DATETIME;
+	-- Make the next media scan inspect every file again to read the details.
+	UPDATE media SET mod_time = '1970-01-01 00:00:00+00:00';`)
+	return err
+}
+
+func migrateContentFormat(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE content ADD COLUMN format TEXT NOT NULL DEFAULT 'html';
+	ALTER TABLE content ADD COLUMN body_html TEXT NOT NULL DEFAULT '';
+	UPDATE content SET body_html = body;
+	ALTER TABLE content_revision ADD COLUMN format TEXT NOT NULL DEFAULT 'html';`)
+	return err
+}
+
+func migrateVisibility(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE content ADD COLUMN visibility TEXT NOT NULL DEFAULT 'published';
+	ALTER TABLE content ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';
+	ALTER TABLE content_revision ADD COLUMN visibility TEXT NOT NULL DEFAULT 'published';
+	CREATE INDEX content_visibility_date ON content (visibility, date);`)
+	return err
+}
+
+func migrateDatePublished(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE content ADD COLUMN date_published DATETIME;
+	CREATE INDEX content_unpublished ON content (date) WHERE date_published IS NULL;`)
+	if err != nil {
+		return err
+	}
+	// Content that is already public was published before, only scheduled
+	// posts are left for the scheduler.
+	_, err = tx.Exec(`UPDATE content SET date_published = date
+	WHERE date <= ? AND visibility IN ('published', 'unlisted', 'protected')`, time.Now())
+	return err
+}
+
+func migratePreviewStatus(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE url_preview ADD COLUMN status TEXT NOT NULL DEFAULT 'ok';
+	ALTER TABLE url_preview ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE url_preview ADD COLUMN next_attempt DATETIME;
+	ALTER TABLE url_preview ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+	CREATE INDEX url_preview_next_attempt ON url_preview (status, next_attempt);`)
+	if err != nil {
+		return err
+	}
+	// Queue the URLs responded to that have no preview.
+	_, err = tx.Exec(`INSERT INTO url_preview (url, status, next_attempt)
+	SELECT DISTINCT response_to, 'pending', ? FROM content
+	WHERE response_to != '' AND response_to NOT IN (SELECT url FROM url_preview)`, time.Now())
+	return err
+}
+
+func migrateArchive(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	ALTER TABLE url_preview ADD COLUMN archived_thumbnail TEXT NOT NULL DEFAULT '';
+	ALTER TABLE url_preview ADD COLUMN snapshot TEXT NOT NULL DEFAULT '';
+	CREATE TABLE link_check (
+		url TEXT PRIMARY KEY,
+		status TEXT NOT NULL DEFAULT 'ok',
+		status_code INTEGER NOT NULL DEFAULT 0,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		date_checked DATETIME
+	);
+	CREATE INDEX link_check_date_checked ON link_check (date_checked);`)
+	if err != nil {
+		return err
+	}
+	// Scrape the previews again to archive them.
+	_, err = tx.Exec(`UPDATE url_preview SET status = 'pending', attempts = 0, next_attempt = ?
+	WHERE status = 'ok'`, time.Now())
+	return err
+}
+
+func migratePreviewStrategy(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE url_preview ADD COLUMN strategy TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+func migrateRevisionDeleted(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE content_revision ADD COLUMN date_deleted DATETIME`)
+	return err
+}
+
+func migrateRevisionPassword(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE content_revision ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''`)
+	return err
+}
+
+func migrateTokenExpiry(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE access_token ADD COLUMN expires DATETIME`)
+	if err != nil {
+		return err
+	}
+	// Tokens issued so far get the default lifetime from now on.
+	_, err = tx.Exec(`UPDATE access_token SET expires = ?`, time.Now().Add(90*24*time.Hour))
+	return err
+}
+
+func migrateSearchProtected(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE content_search SET body = '', snippet = ''
+	WHERE id IN (SELECT id FROM content WHERE visibility = 'protected')`)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db := testDB(t)
+	applied, err := Migrate(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("dry run listed %d migrations, want %d", len(applied), len(Migrations))
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("dry run left %d tables behind", count)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := Migrate(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("migrated again: %v", applied)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	version, err := SchemaVersion(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest := Migrations[len(Migrations)-1].Version; version != latest {
+		t.Errorf("SchemaVersion = %d, want %d", version, latest)
+	}
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	// As left behind by a newer weblog.
+	next := Migrations[len(Migrations)-1].Version + 1
+	if _, err := db.Exec(`INSERT INTO schema_version (version, description, date_applied) VALUES (?, 'from the future', ?)`, next, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, dryRun := range []bool{true, false} {
+		if _, err := Migrate(db, dryRun); err != ErrSchemaTooNew {
+			t.Errorf("dry run %v: err = %v, want %v", dryRun, err, ErrSchemaTooNew)
+		}
+	}
+}
+
+func TestMigrateSearchText(t *testing.T) {
+	got := migrateSearchText(`<p>Hello <b>world</b></p><script>alert(1)</script><style>p{}</style>bye`)
+	if want := "Hello world bye"; got != want {
+		t.Errorf("migrateSearchText = %q, want %q", got, want)
+	}
+}
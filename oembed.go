@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoOembed = errors.New("no oEmbed response")
+)
+
+const (
+	// Embeds are asked to fit the content column, see main.css.
+	oembedMaxWidth  = 768
+	oembedMaxHeight = 1024
+	maxOembedSize   = 1 << 20
+)
+
+// OembedProvider is a site with an oEmbed endpoint, in the format of
+// https://oembed.com/providers.json.
+type OembedProvider struct {
+	Name      string           `json:"provider_name"`
+	URL       string           `json:"provider_url"`
+	Endpoints []OembedEndpoint `json:"endpoints"`
+}
+
+type OembedEndpoint struct {
+	// URL patterns the endpoint serves, * matches anything.
+	Schemes []string `json:"schemes"`
+	// May contain {format}, which is replaced by json.
+	URL string `json:"url"`
+}
+
+// DefaultOembedProviders are known without configuration. Other sites are
+// found through discovery.
+var DefaultOembedProviders = []OembedProvider{
+	{"YouTube", "https://www.youtube.com/", []OembedEndpoint{{
+		[]string{
+			"https://*.youtube.com/watch*",
+			"https://*.youtube.com/v/*",
+			"https://*.youtube.com/shorts/*",
+			"https://*.youtube.com/playlist?list=*",
+			"https://youtu.be/*",
+		},
+		"https://www.youtube.com/oembed",
+	}}},
+	{"Vimeo", "https://vimeo.com/", []OembedEndpoint{{
+		[]string{
+			"https://vimeo.com/*",
+			"https://player.vimeo.com/video/*",
+		},
+		"https://vimeo.com/api/oembed.json",
+	}}},
+	{"Mastodon", "https://mastodon.social/", []OembedEndpoint{{
+		[]string{"https://mastodon.social/@*/*"},
+		"https://mastodon.social/api/oembed",
+	}}},
+	{"Flickr", "https://www.flickr.com/", []OembedEndpoint{{
+		[]string{
+			"https://*.flickr.com/photos/*",
+			"https://flic.kr/p/*",
+		},
+		"https://www.flickr.com/services/oembed/",
+	}}},
+	{"SoundCloud", "https://soundcloud.com/", []OembedEndpoint{{
+		[]string{"https://soundcloud.com/*"},
+		"https://soundcloud.com/oembed",
+	}}},
+	{"Spotify", "https://spotify.com/", []OembedEndpoint{{
+		[]string{"https://open.spotify.com/*"},
+		"https://open.spotify.com/oembed",
+	}}},
+	{"Twitter", "https://twitter.com/", []OembedEndpoint{{
+		[]string{
+			"https://twitter.com/*/status/*",
+			"https://x.com/*/status/*",
+		},
+		"https://publish.twitter.com/oembed",
+	}}},
+	{"Dailymotion", "https://www.dailymotion.com/", []OembedEndpoint{{
+		[]string{"https://www.dailymotion.com/video/*"},
+		"https://www.dailymotion.com/services/oembed",
+	}}},
+	{"CodePen", "https://codepen.io/", []OembedEndpoint{{
+		[]string{"https://codepen.io/*"},
+		"https://codepen.io/api/oembed",
+	}}},
+}
+
+// LoadOembedProviders reads providers from a JSON file in the format of
+// https://oembed.com/providers.json.
+func LoadOembedProviders(filename string) ([]OembedProvider, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var xs []OembedProvider
+	if err := json.NewDecoder(f).Decode(&xs); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return xs, nil
+}
+
+type oembedRoute struct {
+	scheme   *regexp.Regexp
+	endpoint string
+}
+
+// OembedRegistry finds the oEmbed endpoint of a URL among its providers, the
+// first to match wins.
+type OembedRegistry struct {
+	routes []oembedRoute
+}
+
+func NewOembedRegistry(providers ...[]OembedProvider) *OembedRegistry {
+	r := &OembedRegistry{}
+	for _, xs := range providers {
+		for _, p := range xs {
+			for _, e := range p.Endpoints {
+				for _, s := range e.Schemes {
+					r.routes = append(r.routes, oembedRoute{oembedScheme(s), e.URL})
+				}
+			}
+		}
+	}
+	return r
+}
+
+// Schemes match the whole URL and * matches anything. http and https are
+// treated the same.
+func oembedScheme(s string) *regexp.Regexp {
+	parts := strings.Split(s, "*")
+	for i, x := range parts {
+		parts[i] = regexp.QuoteMeta(x)
+	}
+	expr := strings.Join(parts, ".*")
+	expr = strings.TrimPrefix(strings.TrimPrefix(expr, "https://"), "http://")
+	return regexp.MustCompile(`^https?://` + expr + `$`)
+}
+
+// Endpoint returns the oEmbed request for a URL, if a provider serves it.
+func (r *OembedRegistry) Endpoint(s string) (string, bool) {
+	for _, x := range r.routes {
+		if x.scheme.MatchString(s) {
+			return OembedRequestURL(x.endpoint, s), true
+		}
+	}
+	return "", false
+}
+
+// OembedRequestURL asks an endpoint for the JSON embed of a URL, sized for the
+// content column.
+func OembedRequestURL(endpoint, s string) string {
+	endpoint = strings.ReplaceAll(endpoint, "{format}", "json")
+	q := url.Values{}
+	q.Set("url", s)
+	q.Set("format", "json")
+	q.Set("maxwidth", strconv.Itoa(oembedMaxWidth))
+	q.Set("maxheight", strconv.Itoa(oembedMaxHeight))
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + q.Encode()
+	}
+	return endpoint + "?" + q.Encode()
+}
+
+// OembedResponse holds the fields of https://oembed.com/#section2.3 that
+// previews use.
+type OembedResponse struct {
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	HTML         string `json:"html"`
+	// The image of a photo.
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// FetchOembed requests an oEmbed endpoint.
+func FetchOembed(f *Fetcher, endpoint string) (*OembedResponse, error) {
+	resp, err := f.Fetch(endpoint, "application/json", maxOembedSize)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, resp.Body)
+		return nil, errors.New(fmt.Sprintf("oEmbed endpoint responded with %d", resp.StatusCode))
+	}
+	var o OembedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return nil, err
+	}
+	if o.HTML == "" && o.URL == "" && o.Title == "" {
+		return nil, ErrNoOembed
+	}
+	return &o, nil
+}
+
+// Apply fills a preview from the response. Photos are embedded as an image.
+func (o *OembedResponse) Apply(p *URLPreview) {
+	p.Title = o.Title
+	if o.AuthorName != "" {
+		p.Snippet = "by " + o.AuthorName
+		if o.ProviderName != "" {
+			p.Snippet += " on " + o.ProviderName
+		}
+	}
+	p.OembedHTML = template.HTML(o.HTML)
+	if o.Type == "photo" && o.HTML == "" && o.URL != "" {
+		p.OembedHTML = template.HTML(`<img src="` + html.EscapeString(o.URL) + `" alt="` + html.EscapeString(o.Title) + `"/>`)
+	}
+	p.ThumbnailURL = o.ThumbnailURL
+	if p.ThumbnailURL == "" && o.Type == "photo" {
+		p.ThumbnailURL = o.URL
+	}
+}
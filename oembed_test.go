@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestOembedRegistryEndpoint(t *testing.T) {
+	r := NewOembedRegistry(DefaultOembedProviders, []OembedProvider{
+		{"Mine", "https://mine.example/", []OembedEndpoint{{
+			[]string{"https://mine.example/v/*"},
+			"https://mine.example/oembed.{format}?key=1",
+		}}},
+	})
+	tests := []struct {
+		url      string
+		endpoint string
+	}{
+		{"https://www.youtube.com/watch?v=abc", "https://www.youtube.com/oembed"},
+		{"https://m.youtube.com/shorts/abc", "https://www.youtube.com/oembed"},
+		// http matches https schemes.
+		{"http://youtu.be/abc", "https://www.youtube.com/oembed"},
+		{"https://vimeo.com/123", "https://vimeo.com/api/oembed.json"},
+		{"https://mine.example/v/1", "https://mine.example/oembed.json"},
+		{"https://www.youtube.com/about", ""},
+		{"https://youtu.be.example/abc", ""},
+		{"ftp://youtu.be/abc", ""},
+		{"https://mine.example/w/1", ""},
+	}
+	for _, tt := range tests {
+		got, ok := r.Endpoint(tt.url)
+		if ok != (tt.endpoint != "") {
+			t.Errorf("%s: found = %v", tt.url, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint := u.Scheme + "://" + u.Host + u.Path; endpoint != tt.endpoint {
+			t.Errorf("%s: endpoint = %s, want %s", tt.url, endpoint, tt.endpoint)
+		}
+		q := u.Query()
+		if q.Get("url") != tt.url || q.Get("format") != "json" || q.Get("maxwidth") == "" {
+			t.Errorf("%s: query = %s", tt.url, u.RawQuery)
+		}
+		// The endpoint's own query is kept.
+		if u.Host == "mine.example" && q.Get("key") != "1" {
+			t.Errorf("%s: query = %s", tt.url, u.RawQuery)
+		}
+	}
+}
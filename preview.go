@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrPreviewNotFound = errors.New("no preview of that URL")
+)
+
+type PreviewStatus string
+
+const (
+	PreviewPending PreviewStatus = "pending"
+	PreviewOK      PreviewStatus = "ok"
+	// Gave up after too many attempts, it's tried again once stale.
+	PreviewFailed PreviewStatus = "failed"
+)
+
+const (
+	maxPreviewAttempts = 6
+	previewBackoff     = 5 * time.Minute
+	maxPreviewBackoff  = 12 * time.Hour
+	// How long a preview is kept before it's scraped again, see -previewMaxAge.
+	DefaultPreviewMaxAge = 7 * 24 * time.Hour
+)
+
+// QueueURLPreview makes the preview worker scrape the URL, unless its preview
+// is stored already. A failed preview, or any with force, is scraped again.
+func QueueURLPreview(tx *sql.Tx, s string, force bool) error {
+	if s == "" {
+		return nil
+	}
+	_, err := tx.Exec(`
+INSERT INTO url_preview (url, status, attempts, next_attempt, last_error)
+VALUES (?, ?, 0, ?, '')
+ON CONFLICT (url) DO UPDATE SET
+	status = excluded.status,
+	attempts = 0,
+	next_attempt = excluded.next_attempt,
+	last_error = ''
+	WHERE ? OR status = ?`, s, PreviewPending, time.Now(), force, PreviewFailed)
+	return err
+}
+
+// PreviewWorker scrapes queued URL previews in the background, retrying
+// failures with exponential backoff, and scrapes previews again once they are
+// older than MaxAge.
+type PreviewWorker struct {
+	DB      *sql.DB
+	Scraper *Scraper
+	// Where thumbnails are archived, see ArchiveThumbnail.
+	Files  *FileStore
+	MaxAge time.Duration
+	wake   chan struct{}
+}
+
+func NewPreviewWorker(db *sql.DB, scraper *Scraper, files *FileStore, maxAge time.Duration) *PreviewWorker {
+	return &PreviewWorker{
+		DB:      db,
+		Scraper: scraper,
+		Files:   files,
+		MaxAge:  maxAge,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (w *PreviewWorker) Start() {
+	go func() {
+		for {
+			if err := w.ScrapeDue(); err != nil {
+				log.Printf("preview worker: %s", err)
+			}
+			wait := time.Minute
+			if next, err := nextPreviewAttempt(w.DB); err == nil && !next.IsZero() {
+				if d := time.Until(next); d < wait {
+					wait = d
+				}
+			}
+			if wait < time.Second {
+				wait = time.Second
+			}
+			select {
+			case <-w.wake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// Wake makes the worker look for queued previews right away.
+func (w *PreviewWorker) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ScrapeDue scrapes every queued or stale preview of a URL that is still
+// responded to.
+func (w *PreviewWorker) ScrapeDue() error {
+	for {
+		xs, err := w.getDue(10)
+		if err != nil {
+			return err
+		}
+		if len(xs) == 0 {
+			return nil
+		}
+		for _, x := range xs {
+			if err := w.Scrape(x.URL, x.Attempts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Scrape makes a single attempt at a preview. Failures are recorded on the
+// preview, which keeps what was scraped before.
+func (w *PreviewWorker) Scrape(s string, attempts int) error {
+	p, err := w.Scraper.Scrape(s)
+	if err == nil {
+		// The preview is still worth having without its thumbnail.
+		if p.ThumbnailURL != "" && w.Files != nil {
+			base, _ := url.Parse(s)
+			if path, err := ArchiveThumbnail(w.Scraper.Fetcher, w.Files, ResolveURL(base, p.ThumbnailURL)); err != nil {
+				log.Printf("preview worker: thumbnail of %s: %s", s, err)
+			} else {
+				p.ArchivedThumbnail = path
+			}
+		}
+		tx, err := w.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := PutURLPreview(tx, *p); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	attempts++
+	status := PreviewPending
+	var next interface{}
+	if attempts >= maxPreviewAttempts {
+		status = PreviewFailed
+		// Without a max age it's only tried again when queued again.
+		if w.MaxAge > 0 {
+			next = time.Now().Add(w.MaxAge)
+		}
+	} else {
+		backoff := previewBackoff << uint(attempts-1)
+		if backoff > maxPreviewBackoff {
+			backoff = maxPreviewBackoff
+		}
+		next = time.Now().Add(backoff)
+	}
+	_, err = w.DB.Exec(`UPDATE url_preview SET
+	status = ?,
+	attempts = ?,
+	next_attempt = ?,
+	last_error = ?
+	WHERE url = ?`, status, attempts, next, err.Error(), s)
+	return err
+}
+
+func (w *PreviewWorker) getDue(limit int) ([]*URLPreview, error) {
+	now := time.Now()
+	// Previews are never stale without a max age.
+	stale := now.Add(-w.MaxAge)
+	if w.MaxAge <= 0 {
+		stale = time.Time{}
+	}
+	rows, err := w.DB.Query(`SELECT url, attempts
+FROM url_preview
+WHERE ((status = ? AND date_crawled <= ?) OR (status != ? AND next_attempt <= ?))
+	AND url IN (SELECT response_to FROM content)
+ORDER BY next_attempt
+LIMIT ?`, PreviewOK, stale, PreviewOK, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xs []*URLPreview
+	for rows.Next() {
+		var p URLPreview
+		if err := rows.Scan(&p.URL, &p.Attempts); err != nil {
+			return nil, err
+		}
+		xs = append(xs, &p)
+	}
+	return xs, rows.Err()
+}
+
+func nextPreviewAttempt(db *sql.DB) (time.Time, error) {
+	var t time.Time
+	err := db.QueryRow(`SELECT next_attempt FROM url_preview WHERE status = ? ORDER BY next_attempt LIMIT 1`, PreviewPending).Scan(&t)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	return t, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreviewWorkerRetries(t *testing.T) {
+	var fail int32 = 1
+	var title atomic.Value
+	title.Store("First")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "<html><head><title>%s</title></head><body><p>Hi</p></body></html>", title.Load())
+	}))
+	defer srv.Close()
+
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	page := srv.URL + "/page"
+	testCreate(t, db, &ContentPiece{Title: "Reply", Body: "<p>Yes</p>", Type: TypeDefault, URI: "reply", Date: time.Now(), ResponseToURL: page})
+	w := NewPreviewWorker(db, NewScraper(localFetcher(srv), NewOembedRegistry()), nil, time.Hour)
+
+	get := func() (*URLPreview, time.Time) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		p, err := GetURLPreview(tx, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var next sql.NullTime
+		if err := tx.QueryRow(`SELECT next_attempt FROM url_preview WHERE url = ?`, page).Scan(&next); err != nil {
+			t.Fatal(err)
+		}
+		return p, next.Time
+	}
+	// Makes the next attempt due, as if the backoff had passed.
+	due := func() {
+		if _, err := db.Exec(`UPDATE url_preview SET next_attempt = ? WHERE url = ?`, time.Now().Add(-time.Second), page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	near := func(got time.Time, want time.Duration) bool {
+		d := time.Until(got) - want
+		return d > -time.Minute && d <= 0
+	}
+
+	backoffs := []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 40 * time.Minute, 80 * time.Minute}
+	for i, backoff := range backoffs {
+		if err := w.ScrapeDue(); err != nil {
+			t.Fatal(err)
+		}
+		p, next := get()
+		if p.Status != PreviewPending || p.Attempts != i+1 || p.LastError == "" || !near(next, backoff) {
+			t.Fatalf("attempt %d: %s, %d attempts, %q, next in %s", i+1, p.Status, p.Attempts, p.LastError, time.Until(next))
+		}
+		// Nothing is tried before its time.
+		if err := w.ScrapeDue(); err != nil {
+			t.Fatal(err)
+		}
+		if p, _ := get(); p.Attempts != i+1 {
+			t.Fatalf("attempt %d tried early", i+1)
+		}
+		due()
+	}
+
+	// The last attempt gives up until the preview is stale.
+	if err := w.ScrapeDue(); err != nil {
+		t.Fatal(err)
+	}
+	p, next := get()
+	if p.Status != PreviewFailed || p.Attempts != maxPreviewAttempts || !near(next, w.MaxAge) {
+		t.Fatalf("gave up: %s, %d attempts, next in %s", p.Status, p.Attempts, time.Until(next))
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	due()
+	if err := w.ScrapeDue(); err != nil {
+		t.Fatal(err)
+	}
+	p, next = get()
+	if p.Status != PreviewOK || p.Attempts != 0 || p.LastError != "" || !next.IsZero() || p.Title != "First" {
+		t.Fatalf("scraped: %s, %d attempts, %q, title %q", p.Status, p.Attempts, p.LastError, p.Title)
+	}
+
+	// Fresh previews are kept, stale ones scraped again.
+	title.Store("Second")
+	if err := w.ScrapeDue(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := get(); p.Title != "First" {
+		t.Errorf("fresh preview scraped again: %q", p.Title)
+	}
+	if _, err := db.Exec(`UPDATE url_preview SET date_crawled = ? WHERE url = ?`, time.Now().Add(-2*time.Hour), page); err != nil {
+		t.Fatal(err)
+	}
+	w.MaxAge = 0
+	if err := w.ScrapeDue(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := get(); p.Title != "First" {
+		t.Errorf("scraped again without a max age: %q", p.Title)
+	}
+	w.MaxAge = time.Hour
+	if err := w.ScrapeDue(); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := get(); p.Status != PreviewOK || p.Title != "Second" || time.Since(p.DateCrawled) > time.Minute {
+		t.Errorf("stale preview: %s, %q, crawled %s", p.Status, p.Title, p.DateCrawled)
+	}
+}
+
+func TestPreviewGivesUpWithoutMaxAge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	w := NewPreviewWorker(db, NewScraper(localFetcher(srv), NewOembedRegistry()), nil, 0)
+	page := srv.URL + "/page"
+	testCreate(t, db, &ContentPiece{Title: "Reply", Body: "<p>Yes</p>", Type: TypeDefault, URI: "reply", Date: time.Now(), ResponseToURL: page})
+
+	// Without a max age a failed preview is only tried again when queued.
+	if err := w.Scrape(page, maxPreviewAttempts-1); err != nil {
+		t.Fatal(err)
+	}
+	var status PreviewStatus
+	var next sql.NullTime
+	if err := db.QueryRow(`SELECT status, next_attempt FROM url_preview WHERE url = ?`, page).Scan(&status, &next); err != nil {
+		t.Fatal(err)
+	}
+	if status != PreviewFailed || next.Valid {
+		t.Errorf("gave up: %s, next %v", status, next.Time)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"html/template"
+	"strings"
+	"time"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+)
+
+// Revision is a snapshot of a content piece as it was saved.
+type Revision struct {
+	ContentPiece
+	Revision    int64
+	DateRevised time.Time
+}
+
+func (r *Revision) DateRevisedString() string {
+	return r.DateRevised.Format("January 2006 2 at 03:04:05PM")
+}
+
+// RevisionDiff holds the rendered differences between two revisions.
+type RevisionDiff struct {
+	From    *Revision
+	To      *Revision
+	Title   template.HTML
+	URI     template.HTML
+	Snippet template.HTML
+	Tags    template.HTML
+	Body    template.HTML
+}
+
+func DiffRevisions(from, to *Revision) *RevisionDiff {
+	return &RevisionDiff{
+		From:    from,
+		To:      to,
+		Title:   DiffHTML(DiffWords(from.Title, to.Title)),
+		URI:     DiffHTML(DiffWords(from.URI, to.URI)),
+		Snippet: DiffHTML(DiffWords(from.Snippet, to.Snippet)),
+		Tags:    DiffHTML(DiffWords(from.TagString(), to.TagString())),
+		Body:    DiffHTML(DiffWords(from.Body, to.Body)),
+	}
+}
+
+func joinTags(xs []string) string {
+	var tags []string
+	for _, x := range xs {
+		if x = strings.TrimSpace(x); x != "" {
+			tags = append(tags, x)
+		}
+	}
+	return strings.Join(tags, ",")
+}
+
+// InsertRevision records the current state of a content piece.
+func InsertRevision(tx *sql.Tx, c *ContentPiece) error {
+	stmt, err := tx.Prepare(`
+INSERT INTO content_revision (
+	id,
+	title,
+	body,
+	format,
+	snippet,
+	date,
+	type,
+	visibility,
+	response_to,
+	uri,
+	tags,
+	password_hash,
+	date_revised
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(c.ID, c.Title, c.Body, c.Format, c.Snippet, c.Date, c.Type, c.Visibility, c.ResponseToURL, c.URI, joinTags(c.Tags), c.PasswordHash, time.Now())
+	return err
+}
+
+const revisionColumns = `
+	revision,
+	id,
+	title,
+	body,
+	format,
+	snippet,
+	date,
+	type,
+	visibility,
+	response_to,
+	uri,
+	tags,
+	password_hash,
+	date_revised`
+
+func scanRevision(scan func(...interface{}) error) (*Revision, error) {
+	var r Revision
+	var tags string
+	if err := scan(&r.Revision,
+		&r.ID,
+		&r.Title,
+		&r.Body,
+		&r.Format,
+		&r.Snippet,
+		&r.Date,
+		&r.Type,
+		&r.Visibility,
+		&r.ResponseToURL,
+		&r.URI,
+		&tags,
+		&r.PasswordHash,
+		&r.DateRevised); err != nil {
+		return nil, err
+	}
+	if tags != "" {
+		r.Tags = strings.Split(tags, ",")
+	}
+	return &r, nil
+}
+
+// GetRevisions lists the revisions of a content piece, newest first.
+func GetRevisions(tx *sql.Tx, id Identifier) ([]*Revision, error) {
+	stmt, err := tx.Prepare(`SELECT` + revisionColumns + `
+FROM content_revision
+WHERE id = ?
+ORDER BY revision DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*Revision, 0)
+	for rows.Next() {
+		r, err := scanRevision(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, r)
+	}
+	return xs, rows.Err()
+}
+
+func GetRevision(tx *sql.Tx, id Identifier, revision int64) (*Revision, error) {
+	stmt, err := tx.Prepare(`SELECT` + revisionColumns + `
+FROM content_revision
+WHERE id = ? AND revision = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	r, err := scanRevision(stmt.QueryRow(id, revision).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrRevisionNotFound
+	}
+	return r, err
+}
+
+// GetDeletedRevision finds the latest revision saved under a URI whose content
+// piece no longer exists.
+func GetDeletedRevision(tx *sql.Tx, uri string) (*Revision, error) {
+	stmt, err := tx.Prepare(`SELECT` + revisionColumns + `
+FROM content_revision
+WHERE uri = ? AND id NOT IN (SELECT id FROM content)
+ORDER BY revision DESC
+LIMIT 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	r, err := scanRevision(stmt.QueryRow(uri).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrRevisionNotFound
+	}
+	return r, err
+}
+
+// MarkRevisionDeleted records when a content piece was deleted on its latest
+// revision.
+func MarkRevisionDeleted(tx *sql.Tx, id Identifier) error {
+	_, err := tx.Exec(`UPDATE content_revision SET date_deleted = ?
+WHERE revision = (SELECT MAX(revision) FROM content_revision WHERE id = ?)`, time.Now(), id)
+	return err
+}
+
+// LastChanged returns when any content piece was last saved or deleted.
+func LastChanged(tx *sql.Tx) (time.Time, error) {
+	var revised, deleted sql.NullTime
+	err := tx.QueryRow(`SELECT date_revised FROM content_revision
+ORDER BY date_revised DESC LIMIT 1`).Scan(&revised)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+	err = tx.QueryRow(`SELECT date_deleted FROM content_revision
+WHERE date_deleted IS NOT NULL
+ORDER BY date_deleted DESC LIMIT 1`).Scan(&deleted)
+	if err != nil && err != sql.ErrNoRows {
+		return time.Time{}, err
+	}
+	if deleted.Time.After(revised.Time) {
+		return deleted.Time, nil
+	}
+	return revised.Time, nil
+}
+
+// RestoreRevision saves a revision over its content piece. The restore is a
+// regular update so it becomes the newest revision itself, and the links it
+// adds or removes get their webmentions queued.
+func RestoreRevision(tx *sql.Tx, base string, r *Revision) (*ContentPiece, error) {
+	c := r.ContentPiece
+	// A password changed since the revision stays changed.
+	var current string
+	err := tx.QueryRow(`SELECT password_hash FROM content WHERE id = ?`, c.ID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if current != "" {
+		c.PasswordHash = current
+	}
+	if err := UpdateContent(tx, &c); err != nil {
+		return nil, err
+	}
+	if err := QueueContentWebmentions(tx, base, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
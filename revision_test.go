@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreRevisionQueuesWebmentions(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	c := &ContentPiece{Title: "Links", Body: `<p><a href="https://a.example/">A</a></p>`, Type: TypeDefault, URI: "links", Date: time.Now()}
+	testCreate(t, db, c)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	c.Body = `<p><a href="https://b.example/">B</a></p>`
+	if err := UpdateContent(tx, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueContentWebmentions(tx, testBaseURL, c); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := GetRevisions(tx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var first *Revision
+	for _, r := range revisions {
+		if strings.Contains(r.Body, "a.example") {
+			first = r
+		}
+	}
+	if first == nil {
+		t.Fatalf("no revision linking to a.example in %d revisions", len(revisions))
+	}
+	if _, err := RestoreRevision(tx, testBaseURL, first); err != nil {
+		t.Fatal(err)
+	}
+
+	xs, err := GetOutgoingWebmentions(tx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := map[string]bool{}
+	for _, m := range xs {
+		removed[m.Target] = m.Removed
+	}
+	if r, ok := removed["https://a.example/"]; !ok || r {
+		t.Errorf("restored link: queued %v, removed %v", ok, r)
+	}
+	if r, ok := removed["https://b.example/"]; !ok || !r {
+		t.Errorf("link gone with the restore: queued %v, removed %v", ok, r)
+	}
+}
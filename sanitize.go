@@ -0,0 +1,133 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	xhtml "golang.org/x/net/html"
+)
+
+// EmbedProviders are the players that may be embedded with a plain iframe, as
+// a host and path prefix.
+var EmbedProviders = []string{
+	"www.youtube.com/embed/",
+	"www.youtube-nocookie.com/embed/",
+	"player.vimeo.com/video/",
+	"w.soundcloud.com/player/",
+	"open.spotify.com/embed/",
+	"bandcamp.com/EmbeddedPlayer/",
+	"www.dailymotion.com/embed/",
+	"player.twitch.tv/",
+	"codepen.io/",
+}
+
+// Sanitizer cleans HTML that ends up in our pages. Embeds scraped from other
+// sites are always cleaned, post bodies only when Bodies is set.
+type Sanitizer struct {
+	Bodies bool
+
+	iframes *regexp.Regexp
+	embed   *bluemonday.Policy
+	body    *bluemonday.Policy
+}
+
+// NewSanitizer allows iframes from EmbedProviders and any extra ones, given
+// comma separated in the same form. A provider without a trailing slash ends
+// there, so example.com doesn't allow example.com.evil.com.
+func NewSanitizer(bodies bool, providers string) *Sanitizer {
+	var xs []string
+	for _, x := range append(append([]string{}, EmbedProviders...), strings.Split(providers, ",")...) {
+		x = strings.TrimPrefix(strings.TrimSpace(x), "https://")
+		switch {
+		case x == "":
+		case strings.HasSuffix(x, "/"):
+			xs = append(xs, regexp.QuoteMeta(x))
+		default:
+			xs = append(xs, regexp.QuoteMeta(x)+`([/?#]|$)`)
+		}
+	}
+	s := &Sanitizer{
+		Bodies:  bodies,
+		iframes: regexp.MustCompile(`^https://(` + strings.Join(xs, "|") + `)`),
+	}
+	s.embed = s.policy()
+	s.body = s.policy()
+	// Authors may style their posts.
+	s.body.AllowStyling()
+	return s
+}
+
+func (s *Sanitizer) policy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowElements("iframe", "picture", "source", "figure", "figcaption", "video", "audio")
+	p.AllowAttrs("src").Matching(s.iframes).OnElements("iframe")
+	p.AllowAttrs("width", "height", "title", "allow", "allowfullscreen", "frameborder", "loading").OnElements("iframe")
+	p.AllowAttrs("src", "srcset", "sizes", "type", "media").OnElements("source")
+	p.AllowAttrs("src", "controls", "poster", "width", "height", "preload", "loop", "muted").OnElements("video", "audio")
+	return p
+}
+
+// needsSandbox tells if an embed does more than the policy allows, such as
+// running a script or framing an unknown site.
+func (s *Sanitizer) needsSandbox(embed string) bool {
+	z := xhtml.NewTokenizer(strings.NewReader(embed))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return false
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "script", "style", "object", "embed", "form", "link", "meta", "base":
+				return true
+			case "iframe":
+				src := ""
+				for _, attr := range t.Attr {
+					if attr.Key == "src" {
+						src = attr.Val
+					}
+				}
+				if !s.iframes.MatchString(src) {
+					return true
+				}
+			}
+		}
+	}
+}
+
+// Embed cleans oEmbed HTML. Embeds that need scripts, like most social media
+// posts, are put in a sandboxed iframe of their own, where they can't reach
+// our pages or cookies.
+func (s *Sanitizer) Embed(embed template.HTML) template.HTML {
+	if strings.TrimSpace(string(embed)) == "" {
+		return ""
+	}
+	if s.needsSandbox(string(embed)) {
+		return template.HTML(`<iframe sandbox="allow-scripts allow-popups allow-popups-to-escape-sandbox" referrerpolicy="no-referrer" loading="lazy" class="embed" srcdoc="` +
+			html.EscapeString(string(embed)) + `"></iframe>`)
+	}
+	return template.HTML(s.embed.Sanitize(string(embed)))
+}
+
+// Policy names how bodies are cleaned, empty when they aren't, so bodies
+// rendered under another policy can be told apart.
+func (s *Sanitizer) Policy() string {
+	if !s.Bodies {
+		return ""
+	}
+	return s.iframes.String()
+}
+
+// Body cleans the HTML of a post body if configured to.
+func (s *Sanitizer) Body(body string) string {
+	if !s.Bodies {
+		return body
+	}
+	return s.body.Sanitize(body)
+}
+
+// sanitizer is replaced by StartServer with the configured one.
+var sanitizer = NewSanitizer(false, "")
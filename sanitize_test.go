@@ -0,0 +1,122 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeedsSandbox(t *testing.T) {
+	s := NewSanitizer(false, "example.com, https://media.example.org/player/")
+	tests := []struct {
+		embed string
+		want  bool
+	}{
+		{"", false},
+		{`<p>Just <a href="https://example.net">text</a></p>`, false},
+		{`<iframe src="https://www.youtube.com/embed/abc"></iframe>`, false},
+		{`<iframe src="https://player.vimeo.com/video/123?h=x"></iframe>`, false},
+		{`<iframe src="https://media.example.org/player/1"></iframe>`, false},
+		{`<iframe src="https://example.com"></iframe>`, false},
+		{`<iframe src="https://example.com/video/1"></iframe>`, false},
+		{`<iframe src="https://example.com?v=1"></iframe>`, false},
+		{`<blockquote class="post">Hi</blockquote><script async src="https://social.example/embed.js"></script>`, true},
+		{`<style>body { display: none }</style>`, true},
+		{`<object data="x.swf"></object>`, true},
+		{`<iframe src="https://evil.com/"></iframe>`, true},
+		{`<iframe></iframe>`, true},
+		{`<iframe src="http://www.youtube.com/embed/abc"></iframe>`, true},
+		{`<iframe src="https://www.youtube.com/watch?v=abc"></iframe>`, true},
+		{`<iframe src="https://www.youtube.com.evil.com/embed/abc"></iframe>`, true},
+		{`<iframe src="https://example.com.evil.com/"></iframe>`, true},
+		{`<iframe src="https://example.comevil.com/"></iframe>`, true},
+		{`<iframe src="https://example.com@evil.com/"></iframe>`, true},
+		{`<iframe src="https://media.example.org/other/1"></iframe>`, true},
+	}
+	for _, tt := range tests {
+		if got := s.needsSandbox(tt.embed); got != tt.want {
+			t.Errorf("needsSandbox(%q) = %v, want %v", tt.embed, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizerEmbed(t *testing.T) {
+	s := NewSanitizer(false, "example.com")
+	tests := []struct {
+		embed string
+		want  []string
+		not   []string
+	}{
+		{"  ", nil, []string{"<"}},
+		{
+			`<iframe src="https://www.youtube.com/embed/abc" width="560" allowfullscreen onload="alert(1)"></iframe>`,
+			[]string{`<iframe src="https://www.youtube.com/embed/abc" width="560" allowfullscreen`},
+			[]string{"onload", "srcdoc"},
+		},
+		{
+			`<iframe src="https://player.vimeo.com/video/123"></iframe><p onclick="x()">Caption</p>`,
+			[]string{`<iframe src="https://player.vimeo.com/video/123">`, "<p>Caption</p>"},
+			[]string{"onclick", "srcdoc"},
+		},
+		{
+			`<blockquote>Hi</blockquote><script src="https://social.example/embed.js"></script>`,
+			[]string{`<iframe sandbox="allow-scripts allow-popups allow-popups-to-escape-sandbox"`,
+				`srcdoc="&lt;blockquote&gt;Hi&lt;/blockquote&gt;&lt;script src=&#34;https://social.example/embed.js&#34;&gt;&lt;/script&gt;"`},
+			[]string{"<script", "allow-same-origin"},
+		},
+		{
+			`<iframe src="https://example.com.evil.com/"></iframe>`,
+			[]string{`srcdoc="&lt;iframe src=&#34;https://example.com.evil.com/&#34;`},
+			[]string{`<iframe src=`},
+		},
+	}
+	for _, tt := range tests {
+		got := string(s.Embed(template.HTML(tt.embed)))
+		for _, want := range tt.want {
+			if !strings.Contains(got, want) {
+				t.Errorf("Embed(%q) = %s, missing %s", tt.embed, got, want)
+			}
+		}
+		for _, not := range tt.not {
+			if strings.Contains(got, not) {
+				t.Errorf("Embed(%q) = %s, has %s", tt.embed, got, not)
+			}
+		}
+	}
+}
+
+func TestRenderBodies(t *testing.T) {
+	old := sanitizer
+	t.Cleanup(func() { sanitizer = old })
+	sanitizer = NewSanitizer(false, "")
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	body := `<p onclick="x()">Hi</p><script>alert(1)</script>`
+	testCreate(t, db, &ContentPiece{URI: "a", Type: TypeDefault, Date: time.Now(), Body: body})
+	if n, err := RenderBodies(db); n != 0 || err != nil {
+		t.Fatalf("nothing changed, rendered %d: %v", n, err)
+	}
+	if got := string(testGet(t, db, "a").HTML()); got != body {
+		t.Errorf("unsanitized %s", got)
+	}
+
+	sanitizer = NewSanitizer(true, "")
+	if n, err := RenderBodies(db); n != 1 || err != nil {
+		t.Fatalf("rendered %d: %v", n, err)
+	}
+	if got := string(testGet(t, db, "a").HTML()); got != "<p>Hi</p>" {
+		t.Errorf("sanitized %s", got)
+	}
+	if n, err := RenderBodies(db); n != 0 || err != nil {
+		t.Errorf("rendered %d again: %v", n, err)
+	}
+
+	// Saved after, the body is sanitized right away.
+	testCreate(t, db, &ContentPiece{URI: "b", Type: TypeDefault, Date: time.Now(), Format: FormatMarkdown, Body: "Hey <script>alert(1)</script>"})
+	if got := testGet(t, db, "b").BodyHTML; got != "<p>Hey </p>\n" {
+		t.Errorf("saved %q", got)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	// A post became visible to visitors, right away when saved or at its
+	// scheduled date.
+	EventPublish EventType = "publish"
+)
+
+type Event struct {
+	Type    EventType
+	Content *ContentPiece
+	Date    time.Time
+}
+
+// Events lets other parts of weblog react to what happens to content, e.g.
+// to ping a service when a post is published.
+type Events struct {
+	mu          sync.RWMutex
+	subscribers map[EventType][]func(Event)
+}
+
+func NewEvents() *Events {
+	return &Events{subscribers: map[EventType][]func(Event){}}
+}
+
+// Subscribe calls fn for every event of the type. Subscribers run one after
+// the other in the goroutine emitting the event, so they must not block.
+func (e *Events) Subscribe(t EventType, fn func(Event)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.subscribers[t] = append(e.subscribers[t], fn)
+}
+
+func (e *Events) Emit(ev Event) {
+	e.mu.RLock()
+	xs := e.subscribers[ev.Type]
+	e.mu.RUnlock()
+	for _, fn := range xs {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("%s subscriber: %v", ev.Type, err)
+				}
+			}()
+			fn(ev)
+		}()
+	}
+}
+
+// PublicVisibilities are the ones a post is published with once its date has
+// come.
+var PublicVisibilities = []Visibility{VisibilityPublished, VisibilityUnlisted, VisibilityProtected}
+
+func publicVisibilityArgs() (string, []interface{}) {
+	args := make([]interface{}, len(PublicVisibilities))
+	for i, v := range PublicVisibilities {
+		args[i] = v
+	}
+	return "visibility IN (?" + strings.Repeat(", ?", len(args)-1) + ")", args
+}
+
+// Scheduler publishes content once its date has come and emits EventPublish
+// for it. Content is published when date_published is set, which is cleared
+// again when a post is turned into a draft or moved to the future. As the
+// state is in the database nothing is lost on restart, posts that came due
+// while weblog was down are published when it starts.
+type Scheduler struct {
+	DB     *sql.DB
+	Events *Events
+	wake   chan struct{}
+}
+
+func NewScheduler(db *sql.DB, events *Events) *Scheduler {
+	return &Scheduler{
+		DB:     db,
+		Events: events,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			if err := s.PublishDue(); err != nil {
+				log.Printf("scheduler: %s", err)
+			}
+			wait := time.Minute
+			if next, err := nextScheduled(s.DB); err == nil && !next.IsZero() {
+				if d := time.Until(next); d < wait {
+					wait = d
+				}
+			}
+			if wait < time.Second {
+				wait = time.Second
+			}
+			select {
+			case <-s.wake:
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// Wake makes the scheduler look at saved content right away.
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// PublishDue publishes every post whose date has come.
+func (s *Scheduler) PublishDue() error {
+	in, args := publicVisibilityArgs()
+	rows, err := s.DB.Query(`SELECT uri FROM content
+WHERE date_published IS NULL AND date <= ? AND `+in+`
+ORDER BY date`, append([]interface{}{time.Now()}, args...)...)
+	if err != nil {
+		return err
+	}
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err := rows.Scan(&uri); err != nil {
+			rows.Close()
+			return err
+		}
+		uris = append(uris, uri)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, uri := range uris {
+		if err := s.publish(uri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) publish(uri string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	c, err := GetContent(tx, uri)
+	if err == ErrContentNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	// Skip it if it was changed since it was found due.
+	res, err := tx.Exec(`UPDATE content SET date_published = ? WHERE id = ? AND date_published IS NULL AND date <= ?`, now, c.ID, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.Events.Emit(Event{Type: EventPublish, Content: c, Date: now})
+	return nil
+}
+
+func nextScheduled(db *sql.DB) (time.Time, error) {
+	var t time.Time
+	in, args := publicVisibilityArgs()
+	err := db.QueryRow(`SELECT date FROM content WHERE date_published IS NULL AND `+in+` ORDER BY date LIMIT 1`, args...).Scan(&t)
+	if err == sql.ErrNoRows {
+		return t, nil
+	}
+	return t, err
+}
+
+// GetScheduled lists the posts waiting for their date to be published, the
+// next one first.
+func GetScheduled(tx *sql.Tx) ([]*ContentPiece, error) {
+	in, args := publicVisibilityArgs()
+	rows, err := tx.Query(`SELECT
+	uri,
+	title,
+	type,
+	date,
+	visibility
+FROM content
+WHERE date_published IS NULL AND date > ? AND `+in+`
+ORDER BY date`, append([]interface{}{time.Now()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*ContentPiece, 0)
+	for rows.Next() {
+		var c ContentPiece
+		if err := rows.Scan(&c.URI, &c.Title, &c.Type, &c.Date, &c.Visibility); err != nil {
+			return nil, err
+		}
+		xs = append(xs, &c)
+	}
+	return xs, rows.Err()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func testScheduler(t *testing.T) (*Scheduler, *sql.DB, chan string) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	published := make(chan string, 10)
+	events := NewEvents()
+	events.Subscribe(EventPublish, func(e Event) { published <- e.Content.URI })
+	return NewScheduler(db, events), db, published
+}
+
+func isPublished(t *testing.T, db *sql.DB, uri string) bool {
+	var ok bool
+	if err := db.QueryRow(`SELECT date_published IS NOT NULL FROM content WHERE uri = ?`, uri).Scan(&ok); err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestSchedulerPublishesOnce(t *testing.T) {
+	s, db, published := testScheduler(t)
+	testCreate(t, db, &ContentPiece{Title: "Later", Body: "<p>Hi</p>", Type: TypeDefault, URI: "later", Date: time.Now().Add(time.Hour)})
+	testCreate(t, db, &ContentPiece{Title: "Draft", Body: "<p>Hi</p>", Type: TypeDefault, URI: "draft", Date: time.Now().Add(-time.Hour), Visibility: VisibilityDraft})
+
+	if err := s.PublishDue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 0 || isPublished(t, db, "later") || isPublished(t, db, "draft") {
+		t.Fatal("published before its date")
+	}
+
+	// Its date comes.
+	if _, err := db.Exec(`UPDATE content SET date = ? WHERE uri = 'later'`, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.PublishDue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(published) != 1 || <-published != "later" {
+		t.Error("not published exactly once")
+	}
+	if !isPublished(t, db, "later") {
+		t.Error("date_published not set")
+	}
+	if isPublished(t, db, "draft") {
+		t.Error("draft published")
+	}
+}
+
+func TestSchedulerSkipsEdited(t *testing.T) {
+	s, db, published := testScheduler(t)
+	testCreate(t, db, &ContentPiece{Title: "Now", Body: "<p>Hi</p>", Type: TypeDefault, URI: "now", Date: time.Now().Add(-time.Minute)})
+
+	// Found due, then moved to the future before it's published.
+	c := testGet(t, db, "now")
+	c.Date = time.Now().Add(time.Hour)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateContent(tx, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publish("now"); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 0 || isPublished(t, db, "now") {
+		t.Error("published a post moved to the future")
+	}
+
+	if err := s.publish("gone"); err != nil {
+		t.Errorf("deleted post: %s", err)
+	}
+}
+
+func TestSchedulerPublishesAtStart(t *testing.T) {
+	s, db, published := testScheduler(t)
+	// Both came due while weblog was down.
+	testCreate(t, db, &ContentPiece{Title: "One", Body: "<p>Hi</p>", Type: TypeDefault, URI: "one", Date: time.Now().Add(-2 * time.Hour)})
+	testCreate(t, db, &ContentPiece{Title: "Two", Body: "<p>Hi</p>", Type: TypeDefault, URI: "two", Date: time.Now().Add(-time.Hour)})
+
+	s.Start()
+	for _, want := range []string{"one", "two"} {
+		select {
+		case uri := <-published:
+			if uri != want {
+				t.Errorf("published %s, want %s", uri, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not published at start", want)
+		}
+	}
+}
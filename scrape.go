@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// PreviewStrategy records where the contents of a preview came from.
+type PreviewStrategy string
+
+const (
+	// The endpoint of a known or configured provider.
+	StrategyOembed PreviewStrategy = "oembed"
+	// The endpoint a page links to with rel=alternate.
+	StrategyOembedDiscovery PreviewStrategy = "oembed-discovery"
+	StrategyOpenGraph       PreviewStrategy = "opengraph"
+	StrategyTwitterCard     PreviewStrategy = "twitter"
+	// The <title> and description of the page.
+	StrategyHTML PreviewStrategy = "html"
+	// The URL is an image, it's its own thumbnail.
+	StrategyImage PreviewStrategy = "image"
+	// Nothing could be read, e.g. the page asks not to be indexed.
+	StrategyNone PreviewStrategy = "none"
+)
+
+// Scraper reads the preview of a URL. It asks the oEmbed provider of the URL
+// first, then the oEmbed endpoint the page links to, then falls back to the
+// OpenGraph and Twitter card tags and finally to the title of the page.
+type Scraper struct {
+	Fetcher *Fetcher
+	Oembed  *OembedRegistry
+}
+
+func NewScraper(f *Fetcher, oembed *OembedRegistry) *Scraper {
+	return &Scraper{Fetcher: f, Oembed: oembed}
+}
+
+// Scrape fetches a page and reads its preview. Pages that aren't HTML or ask
+// not to be indexed get a preview with only their URL.
+func (sc *Scraper) Scrape(s string) (*URLPreview, error) {
+	p := URLPreview{
+		URL:         s,
+		DateCrawled: time.Now(),
+		Strategy:    StrategyNone,
+	}
+	if sc.Oembed != nil {
+		if endpoint, ok := sc.Oembed.Endpoint(s); ok {
+			if o, err := FetchOembed(sc.Fetcher, endpoint); err != nil {
+				log.Printf("scraper: oEmbed of %s: %s", s, err)
+			} else {
+				o.Apply(&p)
+				p.Strategy = StrategyOembed
+			}
+		}
+	}
+
+	body, err := sc.page(s, &p)
+	if err != nil {
+		// The page is only needed for the snapshot then.
+		if p.Strategy == StrategyOembed {
+			return &p, nil
+		}
+		return nil, err
+	}
+	if body == nil {
+		return &p, nil
+	}
+	p.Snapshot = ReadableText(body)
+	if p.Strategy == StrategyOembed {
+		return &p, nil
+	}
+
+	meta := ReadPageMeta(body)
+	base, _ := url.Parse(s)
+	if meta.OembedURL != "" {
+		endpoint := ResolveURL(base, meta.OembedURL)
+		if o, err := FetchOembed(sc.Fetcher, endpoint); err != nil {
+			log.Printf("scraper: discovered oEmbed of %s: %s", s, err)
+		} else {
+			o.Apply(&p)
+			p.Strategy = StrategyOembedDiscovery
+		}
+	}
+	strategy := meta.Apply(&p)
+	if p.Strategy == StrategyNone {
+		p.Strategy = strategy
+	}
+	return &p, nil
+}
+
+// page fetches the HTML of a page. No body and no error means the page can't
+// be previewed beyond what p already has.
+func (sc *Scraper) page(s string, p *URLPreview) ([]byte, error) {
+	resp, err := sc.Fetcher.Get(s)
+	if err == ErrDisallowedByRobots {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.New(fmt.Sprintf("%s responded with %d", resp.Request.URL.Host, resp.StatusCode))
+	}
+	if IsNoIndex(resp.Header.Get("X-Robots-Tag")) {
+		return nil, nil
+	}
+	if t := resp.Header.Get("Content-Type"); strings.HasPrefix(t, "image/") {
+		if p.Strategy == StrategyNone {
+			p.ThumbnailURL = s
+			p.Strategy = StrategyImage
+		}
+		return nil, nil
+	} else if !strings.Contains(t, "html") {
+		return nil, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if HasNoIndexMeta(body) {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// PageMeta is what the <head> of a page says about it.
+type PageMeta struct {
+	Title       string
+	Description string
+	OpenGraph   map[string]string
+	TwitterCard map[string]string
+	// The first JSON oEmbed endpoint linked with rel=alternate.
+	OembedURL string
+}
+
+func ReadPageMeta(doc []byte) *PageMeta {
+	m := &PageMeta{OpenGraph: map[string]string{}, TwitterCard: map[string]string{}}
+	var title strings.Builder
+	inTitle := false
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			m.Title = strings.Join(strings.Fields(title.String()), " ")
+			return m
+		case xhtml.TextToken:
+			if inTitle {
+				title.Write(z.Text())
+			}
+		case xhtml.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "title" {
+				inTitle = false
+			} else if string(name) == "head" {
+				m.Title = strings.Join(strings.Fields(title.String()), " ")
+				return m
+			}
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			t := z.Token()
+			attrs := map[string]string{}
+			for _, attr := range t.Attr {
+				attrs[attr.Key] = strings.TrimSpace(attr.Val)
+			}
+			switch t.Data {
+			case "body":
+				m.Title = strings.Join(strings.Fields(title.String()), " ")
+				return m
+			case "title":
+				inTitle = t.Type == xhtml.StartTagToken
+			case "meta":
+				// Sites mix up name and property for both.
+				key := strings.ToLower(attrs["property"])
+				if key == "" {
+					key = strings.ToLower(attrs["name"])
+				}
+				content := attrs["content"]
+				switch {
+				case content == "":
+				case strings.HasPrefix(key, "og:"):
+					if _, ok := m.OpenGraph[key[3:]]; !ok {
+						m.OpenGraph[key[3:]] = content
+					}
+				case strings.HasPrefix(key, "twitter:"):
+					if _, ok := m.TwitterCard[key[8:]]; !ok {
+						m.TwitterCard[key[8:]] = content
+					}
+				case key == "description" && m.Description == "":
+					m.Description = content
+				}
+			case "link":
+				rel := strings.Fields(strings.ToLower(attrs["rel"]))
+				if m.OembedURL == "" && attrs["href"] != "" &&
+					strings.ToLower(attrs["type"]) == "application/json+oembed" &&
+					len(rel) > 0 && rel[0] == "alternate" {
+					m.OembedURL = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+// Apply fills in what the preview is missing, preferring OpenGraph over the
+// Twitter card over the plain page, and returns the first strategy that filled
+// in anything.
+func (m *PageMeta) Apply(p *URLPreview) PreviewStrategy {
+	strategy := StrategyNone
+	sources := []struct {
+		strategy                  PreviewStrategy
+		title, description, image string
+	}{
+		{StrategyOpenGraph, m.OpenGraph["title"], m.OpenGraph["description"], m.OpenGraph["image"]},
+		{StrategyTwitterCard, m.TwitterCard["title"], m.TwitterCard["description"], m.TwitterCard["image"]},
+		{StrategyHTML, m.Title, m.Description, ""},
+	}
+	for _, x := range sources {
+		used := false
+		if p.Title == "" && x.title != "" {
+			p.Title, used = x.title, true
+		}
+		if p.Snippet == "" && x.description != "" {
+			p.Snippet, used = x.description, true
+		}
+		if p.ThumbnailURL == "" && x.image != "" {
+			p.ThumbnailURL, used = x.image, true
+		}
+		if used && strategy == StrategyNone {
+			strategy = x.strategy
+		}
+	}
+	return strategy
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrape(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		og := `<meta property="og:title" content="OG title">
+<meta property="og:description" content="OG description">
+<meta property="og:image" content="https://img.example/a.jpg">`
+		switch r.URL.Path {
+		case "/oembed":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"type": "video", "title": "Video of %s", "author_name": "Ann", "provider_name": "Tube", "html": "<iframe></iframe>"}`, r.URL.Query().Get("url"))
+		case "/video/1":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><title>Page title</title>`+og+`</head><body><p>Watch this</p></body></html>`)
+		case "/discover":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><title>Page title</title>
+<link rel="alternate" type="text/xml+oembed" href="/xml">
+<link rel="alternate" type="application/json+oembed" href="/oembed?url=discovered">`+og+`</head></html>`)
+		case "/broken-discovery":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><link rel="alternate" type="application/json+oembed" href="/missing">`+og+`</head></html>`)
+		case "/opengraph":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><title>Page title</title><meta name="description" content="Plain description">`+og+`</head></html>`)
+		case "/twitter":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><title>Page title</title><meta name="twitter:title" content="Card title"></head></html>`)
+		case "/plain":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<html><head><title> Page
+	title </title></head><body><title>Not this</title></body></html>`)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+		case "/noindex":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("X-Robots-Tag", "noindex")
+			fmt.Fprint(w, `<html><head><title>Page title</title>`+og+`</head></html>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	registry := NewOembedRegistry([]OembedProvider{{"Tube", srv.URL, []OembedEndpoint{{
+		[]string{srv.URL + "/video/*"},
+		srv.URL + "/oembed",
+	}}}})
+	sc := NewScraper(localFetcher(srv), registry)
+	tests := []struct {
+		path      string
+		strategy  PreviewStrategy
+		title     string
+		snippet   string
+		thumbnail string
+	}{
+		{"/video/1", StrategyOembed, "Video of " + srv.URL + "/video/1", "by Ann on Tube", ""},
+		{"/discover", StrategyOembedDiscovery, "Video of discovered", "by Ann on Tube", "https://img.example/a.jpg"},
+		{"/broken-discovery", StrategyOpenGraph, "OG title", "OG description", "https://img.example/a.jpg"},
+		{"/opengraph", StrategyOpenGraph, "OG title", "OG description", "https://img.example/a.jpg"},
+		{"/twitter", StrategyTwitterCard, "Card title", "", ""},
+		{"/plain", StrategyHTML, "Page title", "", ""},
+		{"/image.png", StrategyImage, "", "", srv.URL + "/image.png"},
+		{"/noindex", StrategyNone, "", "", ""},
+	}
+	for _, tt := range tests {
+		p, err := sc.Scrape(srv.URL + tt.path)
+		if err != nil {
+			t.Errorf("%s: %s", tt.path, err)
+			continue
+		}
+		if p.Strategy != tt.strategy || p.Title != tt.title || p.Snippet != tt.snippet || p.ThumbnailURL != tt.thumbnail {
+			t.Errorf("%s: got %s %q %q %q, want %s %q %q %q", tt.path,
+				p.Strategy, p.Title, p.Snippet, p.ThumbnailURL,
+				tt.strategy, tt.title, tt.snippet, tt.thumbnail)
+		}
+	}
+	if p, _ := sc.Scrape(srv.URL + "/video/1"); p.OembedHTML != "<iframe></iframe>" || p.Snapshot == "" {
+		t.Errorf("embed %q, snapshot %q", p.OembedHTML, p.Snapshot)
+	}
+	if _, err := sc.Scrape(srv.URL + "/gone"); err == nil {
+		t.Error("404: no error")
+	}
+	if _, err := NewScraper(NewFetcher(), registry).Scrape(srv.URL + "/video/1"); err != ErrForbiddenAddress {
+		t.Errorf("private address: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+}
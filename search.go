@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"html/template"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Markers placed around matched terms by the FTS5 snippet function. They are
+// swapped for <mark> once the excerpt has been escaped.
+const (
+	searchMarkOpen  = "\x02"
+	searchMarkClose = "\x03"
+)
+
+// StripHTML returns the readable text of an HTML fragment.
+func StripHTML(s string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(s))
+	skip := 0
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case xhtml.StartTagToken:
+			name, _ := z.TagName()
+			if n := string(name); n == "script" || n == "style" {
+				skip++
+			}
+			b.WriteString(" ")
+		case xhtml.EndTagToken:
+			name, _ := z.TagName()
+			if n := string(name); (n == "script" || n == "style") && skip > 0 {
+				skip--
+			}
+			b.WriteString(" ")
+		case xhtml.SelfClosingTagToken:
+			b.WriteString(" ")
+		case xhtml.TextToken:
+			if skip == 0 {
+				b.Write(z.Text())
+			}
+		}
+	}
+}
+
+// SearchQuery turns user input into an FTS5 query matching every word. Words
+// are quoted so FTS5 syntax can't cause errors, a trailing * is kept for
+// prefix searches.
+func SearchQuery(q string) string {
+	var xs []string
+	for _, word := range strings.Fields(q) {
+		prefix := strings.HasSuffix(word, "*")
+		word = strings.Trim(word, "*")
+		if word == "" {
+			continue
+		}
+		s := `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+		if prefix {
+			s += "*"
+		}
+		xs = append(xs, s)
+	}
+	return strings.Join(xs, " ")
+}
+
+// SearchExcerpt escapes an FTS5 snippet and highlights its matches.
+func SearchExcerpt(s string) template.HTML {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, searchMarkOpen, "<mark>")
+	s = strings.ReplaceAll(s, searchMarkClose, "</mark>")
+	return template.HTML(s)
+}
+
+// IndexContent replaces the search index entry of a content piece. Only the
+// title and tags of protected posts are indexed, so that searching can't guess
+// at what their password hides.
+func IndexContent(tx *sql.Tx, c *ContentPiece) error {
+	if err := UnindexContent(tx, c.ID); err != nil {
+		return err
+	}
+	body, snippet := StripHTML(string(c.HTML())), c.Snippet
+	if c.IsProtected() {
+		body, snippet = "", ""
+	}
+	var previewTitle, previewSnippet string
+	if c.ResponseToURL != "" {
+		if p, err := GetURLPreview(tx, c.ResponseToURL); err == nil {
+			previewTitle = p.Title
+			previewSnippet = p.Snippet
+		} else if err != sql.ErrNoRows {
+			return err
+		}
+	}
+	stmt, err := tx.Prepare(`INSERT INTO content_search (
+	id,
+	title,
+	body,
+	snippet,
+	tags,
+	preview_title,
+	preview_snippet
+) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(c.ID, c.Title, body, snippet, strings.Join(c.Tags, " "), previewTitle, previewSnippet)
+	return err
+}
+
+func UnindexContent(tx *sql.Tx, id Identifier) error {
+	stmt, err := tx.Prepare(`DELETE FROM content_search WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(id)
+	return err
+}
+
+// IndexURLPreview updates the preview columns of every content piece responding
+// to the preview's URL.
+func IndexURLPreview(tx *sql.Tx, p URLPreview) error {
+	stmt, err := tx.Prepare(`UPDATE content_search SET
+	preview_title = ?,
+	preview_snippet = ?
+	WHERE id IN (SELECT id FROM content WHERE response_to = ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(p.Title, p.Snippet, p.URL)
+	return err
+}
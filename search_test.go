@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"golang", `"golang"`},
+		{"  go   web ", `"go" "web"`},
+		{"gol*", `"gol"*`},
+		{"*", ""},
+		{"*go", `"go"`},
+		{`say "hi"`, `"say" """hi"""`},
+		{"a OR b NOT c", `"a" "OR" "b" "NOT" "c"`},
+		{"title:go (x)", `"title:go" "(x)"`},
+	}
+	for _, tt := range tests {
+		if got := SearchQuery(tt.in); got != tt.want {
+			t.Errorf("SearchQuery(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripHTML(t *testing.T) {
+	in := `<p>Hello <b>big</b><br/>world</p><script>alert("x")</script><style>p {}</style> &amp; more`
+	if got, want := StripHTML(in), "Hello big world & more"; got != want {
+		t.Errorf("StripHTML = %q, want %q", got, want)
+	}
+}
+
+func TestSearchExcerpt(t *testing.T) {
+	got := SearchExcerpt("a <b> " + searchMarkOpen + "match" + searchMarkClose + " &")
+	if want := "a &lt;b&gt; <mark>match</mark> &amp;"; string(got) != want {
+		t.Errorf("SearchExcerpt = %q, want %q", got, want)
+	}
+}
+
+func TestSearchSkipsProtectedBodies(t *testing.T) {
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	c := &ContentPiece{Title: "Hello", Body: "<p>The treasure is buried</p>", Snippet: "treasure map", Type: TypeDefault, URI: "hello", Date: time.Now(), Visibility: VisibilityProtected}
+	if err := c.SetPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	testCreate(t, db, c)
+
+	for _, q := range []string{"treasure", "buried", "hello"} {
+		page := PageInfo{Current: 1, ItemLimit: 10, PostType: TypeAll, Query: q}
+		xs, err := GetContents(db, &page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := q == "hello"; (len(xs) == 1) != want {
+			t.Errorf("%q: %d results", q, len(xs))
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/disintegration/imaging"
-	"io"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -29,10 +31,41 @@ type ContentPayload struct {
 	Password        string
 	Rescrape        string
 	TagString       string
+	PostPassword    string
+}
+
+// Config holds the settings the server is started with.
+type Config struct {
+	Port              int
+	TemplateGlob      string
+	AssetsDir         string
+	MaxUploadSize     int64
+	Extensions        string
+	Key               string
+	Cert              string
+	Title             string
+	BaseURL           string
+	Me                string
+	SessionLifetime   time.Duration
+	TokenLifetime     time.Duration
+	CacheDir          string
+	CacheSize         int64
+	KeepMetadata      bool
+	SanitizeBodies    bool
+	EmbedProviders    string
+	CodeTheme         string
+	PreviewMaxAge     time.Duration
+	LinkCheckInterval time.Duration
+	ArchiveFallback   bool
+	OembedProviders   string
+	// Comma separated addresses or ranges of reverse proxies whose
+	// X-Forwarded-* headers are believed.
+	TrustedProxies string
 }
 
 var (
-	ErrNoAuth = errors.New("not authorized")
+	ErrNoAuth       = errors.New("not authorized")
+	ErrPageNotFound = errors.New("page not found")
 )
 
 func parseQueryInt(v string, d, min int) int {
@@ -70,22 +103,100 @@ func GetPage(c *gin.Context) PageInfo {
 	}
 
 	page.Tag = c.Query("tag")
+	page.Query = strings.TrimSpace(c.Query("q"))
 	page.DateFilter = time.Now()
+	page.Visibilities = ListedVisibilities
+	// The author sees everything, scheduled and hidden posts included.
 	if IsAuthorized(c) {
-		page.DateFilter = time.Now().AddDate(999, 1, 1)
+		page.DateFilter = time.Time{}
+		page.Visibilities = nil
 	}
 
 	return page
 }
 
-func IsAuthorized(c *gin.Context) bool {
+// LocalRedirect only lets through paths on this site, so login can't be used
+// to send someone elsewhere.
+func LocalRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "./"
+	}
+	return next
+}
+
+// The reverse proxies of -trustedProxies, see IsTrustedProxy.
+var trustedProxies []*net.IPNet
+
+// SplitList splits a comma separated flag, dropping empty items.
+func SplitList(s string) []string {
+	var xs []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
+// ParseTrustedProxies reads addresses and CIDR ranges, e.g.
+// "127.0.0.1,10.0.0.0/8".
+func ParseTrustedProxies(s string) ([]*net.IPNet, error) {
+	var xs []*net.IPNet
+	for _, x := range SplitList(s) {
+		if !strings.Contains(x, "/") {
+			if ip := net.ParseIP(x); ip != nil && ip.To4() != nil {
+				x += "/32"
+			} else {
+				x += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(x)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, n)
+	}
+	return xs, nil
+}
+
+// IsTrustedProxy tells if the request came through one of the trusted
+// reverse proxies, whose X-Forwarded-* headers can be believed.
+func IsTrustedProxy(c *gin.Context) bool {
+	ip := net.ParseIP(c.RemoteIP())
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAuthorized reports whether the request comes from the logged in author, or
+// carries an access token with all of the scopes. Without scopes only the
+// session counts.
+func IsAuthorized(c *gin.Context, scopes ...string) bool {
 	s := sessions.Default(c)
 	val := s.Get("authed")
 	authed, ok := val.(bool)
-	return authed && ok
+	if authed && ok {
+		return true
+	}
+	t := CurrentToken(c)
+	if t == nil || len(scopes) == 0 {
+		return false
+	}
+	for _, scope := range scopes {
+		if !t.HasScope(scope) {
+			return false
+		}
+	}
+	return true
 }
 
-func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, cert string) {
+func StartServer(db *sql.DB, cfg Config) {
 
 	//gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
@@ -93,48 +204,219 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 
 	r.Use(gin.Logger())
 	r.Use(gin.Recovery())
-	r.LoadHTMLGlob(templateGlob)
+	// Without trusted proxies ClientIP is the address of the connection, so
+	// X-Forwarded-For can't be used to dodge the login lockout.
+	proxies, err := ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		panic(err)
+	}
+	trustedProxies = proxies
+	if err := r.SetTrustedProxies(SplitList(cfg.TrustedProxies)); err != nil {
+		panic(err)
+	}
+	sanitizer = NewSanitizer(cfg.SanitizeBodies, cfg.EmbedProviders)
+	// Bodies are sanitized as they are saved, so saved ones must follow a
+	// change of the flags before anything is served.
+	rendered, err := RenderBodies(db)
+	if err != nil {
+		panic(err)
+	}
+	if rendered > 0 {
+		log.Printf("rendered %d post bodies for the new sanitizer policy", rendered)
+	}
+	if _, err := CodeCSS(cfg.CodeTheme); err != nil {
+		panic(err)
+	}
+
+	renderer, err := NewRenderer(cfg.TemplateGlob, template.FuncMap{
+		"srcset":   Srcset,
+		"pictures": Pictures,
+	})
+	if err != nil {
+		panic(err)
+	}
+	r.Use(renderer.Attach)
 
-	store := cookie.NewStore([]byte(password))
+	secret, err := SessionSecret(db)
+	if err != nil {
+		panic(err)
+	}
+	store := cookie.NewStore(secret)
+	store.Options(sessions.Options{
+		Path:     "/",
+		MaxAge:   int(cfg.SessionLifetime.Seconds()),
+		Secure:   cfg.Cert != "",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 	r.Use(sessions.Sessions("weblog", store))
+	r.Use(SessionAuth(db, cfg.SessionLifetime))
+	r.Use(TokenAuth(db))
+	r.Use(CSRF())
+
+	fetcher := NewFetcher()
+	mentions := NewWebmentionReceiver(db, fetcher)
+	mentions.Start()
+	sender := NewWebmentionSender(db, fetcher)
+	sender.Start()
+
+	events := NewEvents()
+	events.Subscribe(EventPublish, func(e Event) {
+		log.Printf("published %s", e.Content.URI)
+		// Mentions of a scheduled post are due now.
+		sender.Wake()
+	})
+	scheduler := NewScheduler(db, events)
+	scheduler.Start()
+
+	files, err := NewFileStore(cfg.AssetsDir, cfg.MaxUploadSize, cfg.Extensions)
+	if err != nil {
+		panic(err)
+	}
+
+	var providers []OembedProvider
+	if cfg.OembedProviders != "" {
+		if providers, err = LoadOembedProviders(cfg.OembedProviders); err != nil {
+			panic(err)
+		}
+	}
+	// Configured providers go first so they can take over built-in ones.
+	scraper := NewScraper(fetcher, NewOembedRegistry(providers, DefaultOembedProviders))
+	previews := NewPreviewWorker(db, scraper, files, cfg.PreviewMaxAge)
+	previews.Start()
+	NewLinkChecker(db, fetcher, cfg.LinkCheckInterval).Start()
+
+	cache, err := NewImageCache(cfg.CacheDir, cfg.CacheSize)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		if err := ScanMedia(db, files); err != nil {
+			log.Printf("media scan: %s", err)
+		}
+	}()
+
+	micropub := &Micropub{
+		DB:        db,
+		Config:    cfg,
+		Sender:    sender,
+		Scheduler: scheduler,
+		Previews:  previews,
+		Files:     files,
+	}
+	api := &API{
+		DB:        db,
+		Config:    cfg,
+		Sender:    sender,
+		Scheduler: scheduler,
+		Previews:  previews,
+		Files:     files,
+		Cache:     cache,
+	}
+	auth := &IndieAuth{
+		DB:      db,
+		Config:  cfg,
+		Fetcher: fetcher,
+	}
 
 	r.NoRoute(func(c *gin.Context) {
-		c.HTML(404, "error.html", M{
+		if IsReqAPI(c) || IsReqJSON(c) {
+			HandleError(c, ErrPageNotFound)
+			return
+		}
+		HTML(c, 404, "error.html", M{
 			"Error": "Page not found.",
 		})
 	})
 
 	r.GET("/login", func(c *gin.Context) {
+		next := LocalRedirect(c.Query("next"))
 		if IsAuthorized(c) {
-			c.Redirect(302, "./")
+			c.Redirect(302, next)
 			return
 		}
-		c.HTML(200, "login.html", nil)
+		HTML(c, 200, "login.html", M{
+			"Next": next,
+		})
 	})
 
+	limiter := NewLoginLimiter()
 	r.POST("/login", func(c *gin.Context) {
 		var payload struct {
 			Password string
+			Next     string
 		}
 		if err := c.Bind(&payload); err != nil {
-			c.HTML(500, "login.html", M{
+			HTML(c, 500, "login.html", M{
 				"Error": "issue reading payload",
 			})
 			return
 		}
-		if payload.Password != password {
-			c.HTML(500, "login.html", M{
-				"Error": "invalid password",
+		ip := c.ClientIP()
+		if wait := limiter.Wait(ip); wait > 0 {
+			HTML(c, 429, "login.html", M{
+				"Error": fmt.Sprintf("too many failed logins, try again in %s", wait.Round(time.Second)),
+				"Next":  payload.Next,
+			})
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		defer tx.Rollback()
+		if err := CheckPassword(tx, payload.Password); err != nil {
+			if err == ErrInvalidPassword {
+				limiter.Fail(ip)
+			}
+			HTML(c, ErrorStatus(err), "login.html", M{
+				"Error": err.Error(),
+				"Next":  payload.Next,
 			})
 			return
 		}
+		limiter.Succeed(ip)
+		gen, err := SessionGeneration(tx)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err := Login(c, gen); err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Redirect(302, LocalRedirect(payload.Next))
+	})
+
+	r.POST("/logout", func(c *gin.Context) {
 		s := sessions.Default(c)
-		s.Set("authed", true)
+		s.Clear()
 		s.Save()
 		c.Redirect(302, "./")
 	})
 
-	r.GET("/logout", func(c *gin.Context) {
+	// Log out every session, on every device
+	r.POST("/logout/all", func(c *gin.Context) {
+		if !IsAuthorized(c) {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err := LogoutEverywhere(tx); err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			HandleError(c, err)
+			return
+		}
 		s := sessions.Default(c)
 		s.Clear()
 		s.Save()
@@ -148,6 +430,11 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 			HandleError(c, err)
 			return
 		}
+		for _, x := range xs {
+			if !CanRead(c, x) {
+				x.Hide()
+			}
+		}
 		scope := M{
 			"Items": xs,
 			"Page":  &page,
@@ -159,7 +446,39 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 			return
 		}
 		scope["Authorized"] = IsAuthorized(c)
-		c.HTML(200, "all.html", scope)
+		HTML(c, 200, "all.html", scope)
+	})
+
+	r.GET("/feed.rss", func(c *gin.Context) {
+		ServeFeed(c, db, cfg, FeedRSS)
+	})
+
+	r.GET("/feed.atom", func(c *gin.Context) {
+		ServeFeed(c, db, cfg, FeedAtom)
+	})
+
+	r.GET("/feed.json", func(c *gin.Context) {
+		ServeFeed(c, db, cfg, FeedJSON)
+	})
+
+	r.GET("/sitemap.xml", func(c *gin.Context) {
+		b, err := Sitemap(db, GetBaseURL(c, cfg.BaseURL))
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Data(200, "application/xml; charset=utf-8", b)
+	})
+
+	// Styles for highlighted code, ?theme= picks another one than configured
+	r.GET("/highlight.css", func(c *gin.Context) {
+		theme := c.DefaultQuery("theme", cfg.CodeTheme)
+		css, err := CodeCSS(theme)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Data(200, "text/css; charset=utf-8", css)
 	})
 
 	r.GET("/new", func(c *gin.Context) {
@@ -181,7 +500,7 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 		default:
 			editor = "editor"
 		}
-		c.HTML(500, editor+".html", &sample)
+		HTML(c, 500, editor+".html", &sample)
 	})
 
 	r.GET("/post/:contentUri", func(c *gin.Context) {
@@ -192,31 +511,223 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 		}
 		content, err := GetContent(tx, c.Params.ByName("contentUri"))
 		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		mentions, err := GetWebmentions(tx, content.ID, IsAuthorized(c))
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		var sent []*OutgoingWebmention
+		if IsAuthorized(c) {
+			if sent, err = GetOutgoingWebmentions(tx, content.ID); err != nil {
+				tx.Rollback()
+				HandleError(c, err)
+				return
+			}
+		}
+		photos, err := GetContentPhotos(tx, content.ID)
+		if err != nil {
+			tx.Rollback()
 			HandleError(c, err)
 			return
 		}
 		tx.Commit()
 		if _, ok := c.GetQuery("edit"); ok && IsAuthorized(c) {
-			c.HTML(200, "editor.html", content)
+			HTML(c, 200, "editor.html", content)
 			return
 		}
-		if !IsAuthorized(c) && time.Now().Before(content.Date) {
+		if !IsAuthorized(c) && !content.IsPublic() {
 			HandleError(c, ErrContentNotFound)
 			return
 		}
+		if !CanRead(c, content) {
+			if IsReqJSON(c) {
+				c.JSON(401, M{"Error": ErrPostPasswordRequired.Error()})
+				return
+			}
+			HTML(c, 401, "password.html", M{"Post": content})
+			return
+		}
+		c.Header("Link", "<"+GetBaseURL(c, cfg.BaseURL)+"/webmention>; rel=\"webmention\"")
 		if IsReqJSON(c) {
 			c.JSON(200, content)
 			return
 		}
-		c.HTML(200, "post.html", M{
-			"Authorized": IsAuthorized(c),
-			"Post":       content,
+		HTML(c, 200, "post.html", M{
+			"Authorized":      IsAuthorized(c),
+			"Post":            content,
+			"Mentions":        mentions,
+			"Sent":            sent,
+			"Photos":          photos,
+			"ArchiveFallback": cfg.ArchiveFallback,
 		})
 	})
 
+	// Unlock a password protected post for the session
+	postLimiter := NewLoginLimiter()
+	r.POST("/post/:contentUri/unlock", func(c *gin.Context) {
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		content, err := GetContent(tx, c.Params.ByName("contentUri"))
+		tx.Rollback()
+		if err == nil && !content.IsPublic() {
+			err = ErrContentNotFound
+		}
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		ip := c.ClientIP()
+		if wait := postLimiter.Wait(ip); wait > 0 {
+			HTML(c, 429, "password.html", M{
+				"Post":  content,
+				"Error": fmt.Sprintf("too many wrong passwords, try again in %s", wait.Round(time.Second)),
+			})
+			return
+		}
+		if err := content.CheckPassword(c.PostForm("Password")); err != nil {
+			postLimiter.Fail(ip)
+			HTML(c, 401, "password.html", M{
+				"Post":  content,
+				"Error": err.Error(),
+			})
+			return
+		}
+		postLimiter.Succeed(ip)
+		if err := UnlockContent(c, content.ID); err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Redirect(302, "/post/"+content.URI)
+	})
+
+	r.GET("/post/:contentUri/revisions", func(c *gin.Context) {
+		if !IsAuthorized(c) {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		defer tx.Rollback()
+		content, err := GetContent(tx, c.Params.ByName("contentUri"))
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		revisions, err := GetRevisions(tx, content.ID)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+
+		// Compare the requested revisions, or the latest change by default.
+		var from, to *Revision
+		if c.Query("from") != "" && c.Query("to") != "" {
+			a, err := strconv.ParseInt(c.Query("from"), 10, 64)
+			if err != nil {
+				HandleError(c, ErrRevisionNotFound)
+				return
+			}
+			b, err := strconv.ParseInt(c.Query("to"), 10, 64)
+			if err != nil {
+				HandleError(c, ErrRevisionNotFound)
+				return
+			}
+			if from, err = GetRevision(tx, content.ID, a); err != nil {
+				HandleError(c, err)
+				return
+			}
+			if to, err = GetRevision(tx, content.ID, b); err != nil {
+				HandleError(c, err)
+				return
+			}
+		} else if len(revisions) > 1 {
+			from, to = revisions[1], revisions[0]
+		}
+		scope := M{
+			"Post":      content,
+			"Revisions": revisions,
+		}
+		if from != nil && to != nil {
+			scope["Diff"] = DiffRevisions(from, to)
+		}
+		if IsReqJSON(c) {
+			c.JSON(200, scope)
+			return
+		}
+		HTML(c, 200, "revisions.html", scope)
+	})
+
+	// Restore a revision, which is saved as a new revision
+	r.POST("/post/:contentUri/revisions", func(c *gin.Context) {
+		if !IsAuthorized(c, "update") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		var payload struct {
+			Revision int64
+		}
+		if err := c.ShouldBind(&payload); err != nil {
+			HandleError(c, err)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		content, err := GetContent(tx, c.Params.ByName("contentUri"))
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		revision, err := GetRevision(tx, content.ID, payload.Revision)
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		restored, err := RestoreRevision(tx, GetBaseURL(c, cfg.BaseURL), revision)
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			HandleError(c, err)
+			return
+		}
+		sender.Wake()
+		scheduler.Wake()
+		previews.Wake()
+		if IsReqJSON(c) {
+			c.JSON(200, restored)
+			return
+		}
+		c.Redirect(302, "/post/"+restored.URI)
+	})
+
 	// Create, update, or delete an author's content
 	r.POST("/post", func(c *gin.Context) {
-		if !IsAuthorized(c) {
+		scope := "create"
+		switch c.PostForm("TransactionType") {
+		case "DELETE":
+			scope = "delete"
+		case "UPDATE":
+			scope = "update"
+		}
+		if !IsAuthorized(c, scope) {
 			HandleError(c, ErrNoAuth)
 			return
 		}
@@ -230,15 +741,22 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 		if res.DateString == "" || res.TimeString == "" {
 			res.Date = time.Now()
 		} else if d, err := time.Parse("2006-01-02 15:04", res.DateString+" "+res.TimeString); err != nil {
-			HandleError(c, err)
+			HandleError(c, ErrInvalidDate)
+			return
 		} else {
 			res.Date = d
 		}
 
 		res.Tags = strings.Split(res.TagString, ",")
+		if res.PostPassword != "" {
+			if err := res.SetPassword(res.PostPassword); err != nil {
+				HandleError(c, err)
+				return
+			}
+		}
 
 		if res.ResponseToURL == "" && (res.Type == TypeHeart || res.Type == TypeRepost) {
-			HandleError(c, errors.New("missing response url"))
+			HandleError(c, ErrResponseURLRequired)
 			return
 		}
 
@@ -259,15 +777,24 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 		switch res.TransactionType {
 		case "DELETE":
 			err = DeleteContent(tx, &res.ContentPiece)
+			if err == nil {
+				err = QueueOutgoingWebmentions(tx, res.ID, "", nil, time.Now())
+			}
 			loc = "./"
 			break
 		case "UPDATE":
-			err = UpdateContent(tx, &res.ContentPiece, res.Rescrape == "on")
+			err = UpdateContent(tx, &res.ContentPiece)
+			if err == nil && res.Rescrape == "on" {
+				err = QueueURLPreview(tx, res.ResponseToURL, true)
+			}
 			break
 		default:
 			err = CreateContent(tx, &res.ContentPiece)
 			break
 		}
+		if err == nil && res.TransactionType != "DELETE" {
+			err = QueueContentWebmentions(tx, GetBaseURL(c, cfg.BaseURL), &res.ContentPiece)
+		}
 		if err != nil {
 			tx.Rollback() // Log it?
 			HandleError(c, err)
@@ -277,20 +804,149 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 			HandleError(c, err)
 			return
 		}
-		if _, ok := c.GetQuery("json"); ok {
+		sender.Wake()
+		scheduler.Wake()
+		previews.Wake()
+		if IsReqJSON(c) {
 			c.JSON(201, res.ContentPiece)
 			return
 		}
 		c.Redirect(302, loc)
 	})
 
+	// Receive a webmention, see https://www.w3.org/TR/webmention/
+	r.POST("/webmention", func(c *gin.Context) {
+		source := c.PostForm("source")
+		target := c.PostForm("target")
+		if !IsValidSource(source) {
+			c.String(400, ErrInvalidSource.Error())
+			return
+		}
+		uri, err := TargetContentURI(GetBaseURL(c, cfg.BaseURL), target)
+		if err != nil || SameURL(source, target) {
+			c.String(400, ErrInvalidTarget.Error())
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		content, err := GetContent(tx, uri)
+		if err == ErrContentNotFound || (err == nil && !content.IsPublic()) {
+			tx.Rollback()
+			c.String(400, ErrInvalidTarget.Error())
+			return
+		} else if err != nil {
+			tx.Rollback()
+			c.String(500, err.Error())
+			return
+		}
+		_, err = QueueWebmention(tx, source, target, content.ID)
+		if err != nil {
+			tx.Rollback()
+			c.String(500, err.Error())
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		mentions.Wake()
+		c.String(202, "Webmention queued for verification.")
+	})
+
+	// Moderate a received webmention
+	r.POST("/webmention/:id", func(c *gin.Context) {
+		if !IsAuthorized(c) {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		id, err := strconv.ParseInt(c.Params.ByName("id"), 10, 64)
+		if err != nil {
+			HandleError(c, ErrMentionNotFound)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		m, err := GetWebmention(tx, id)
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		switch c.PostForm("Action") {
+		case "approve":
+			err = SetWebmentionStatus(tx, id, MentionApproved)
+		case "hide":
+			err = SetWebmentionStatus(tx, id, MentionHidden)
+		case "delete":
+			err = DeleteWebmention(tx, id)
+		default:
+			err = errors.New("unknown action")
+		}
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		uri, err := GetContentURI(tx, m.ContentID)
+		if err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Redirect(302, "/post/"+uri)
+	})
+
+	// IndieAuth, see https://indieauth.spec.indieweb.org/
+	r.GET("/.well-known/oauth-authorization-server", auth.HandleMetadata)
+	r.GET("/auth", auth.HandleAuthorize)
+	r.POST("/auth", auth.HandleApprove)
+	r.GET("/token", auth.HandleToken)
+	r.POST("/token", auth.HandleToken)
+	r.POST("/token/introspect", auth.HandleIntrospect)
+	r.POST("/token/revoke", auth.HandleRevoke)
+
+	// Micropub, see https://www.w3.org/TR/micropub/
+	r.GET("/micropub", micropub.HandleQuery)
+	r.POST("/micropub", micropub.HandlePost)
+	r.POST("/micropub/media", micropub.HandleMedia)
+
+	// JSON API, see the README
+	v1 := r.Group("/api/v1")
+	v1.GET("/posts", api.HandlePosts)
+	v1.POST("/posts", api.HandleCreatePost)
+	v1.GET("/posts/:id", api.HandlePost)
+	v1.PUT("/posts/:id", api.HandleUpdatePost)
+	v1.PATCH("/posts/:id", api.HandleUpdatePost)
+	v1.DELETE("/posts/:id", api.HandleDeletePost)
+	v1.GET("/tags", api.HandleTags)
+	v1.GET("/files/*path", api.HandleFiles)
+	v1.POST("/files", api.HandleUpload)
+	v1.DELETE("/files/*path", api.HandleDeleteFile)
+	v1.GET("/previews", api.HandlePreview)
+	v1.POST("/previews", api.HandleRescrape)
+
 	// Alias "page/my-page" for assets directory file finding of "assets/my-page.html"
 	r.GET("/page/:filename", func(c *gin.Context) {
-		c.File(filepath.Join(assetsDir, "pages", c.Params.ByName("filename") + ".html"))
+		filename, err := files.Resolve(path.Join("pages", c.Params.ByName("filename")+".html"))
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.File(filename)
 	})
 
 	r.POST("/files", func(c *gin.Context) {
-		if !IsAuthorized(c) {
+		if !IsAuthorized(c, "media") {
 			HandleError(c, ErrNoAuth)
 			return
 		}
@@ -301,155 +957,392 @@ func StartServer(db *sql.DB, port int, templateGlob, assetsDir, password, key, c
 			HandleError(c, err)
 			return
 		}
-		src, err := h.Open()
+		if err := CheckUpload(c, h.Filename); err != nil {
+			HandleError(c, err)
+			return
+		}
+		p, err := files.Save(dir, h)
+		if err := LogFileOperation(db, c, "upload", path.Join("/", dir, h.Filename), err); err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if full, err := files.Resolve(p); err == nil {
+			cache.Invalidate(full)
+			// Turn photos upright and strip them right away rather than
+			// on the first visit.
+			if !cfg.KeepMetadata && isJPEG(full) {
+				if _, err := cache.Stripped(full); err != nil {
+					log.Printf("strip %s: %s", p, err)
+				}
+			}
+		}
+		if err := AddMedia(db, files, p, c.PostForm("Alt")); err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Redirect(302, path.Join("/files", path.Dir(p)))
+	})
+
+	r.POST("/files/delete", func(c *gin.Context) {
+		if !IsAuthorized(c, "media") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		p := path.Join("/", c.PostForm("Path"))
+		if full, err := files.Resolve(p); err == nil {
+			cache.Invalidate(full)
+		}
+		err := files.Delete(c.PostForm("Path"))
+		if err := LogFileOperation(db, c, "delete", p, err); err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err := RemoveMedia(db, p); err != nil {
+			HandleError(c, err)
+			return
+		}
+		HTML(c, 200, "notice.html", map[string]string{
+			"Message":   fmt.Sprintf("Deleted file %s", p),
+			"ReturnURL": path.Join("/files", path.Dir(p)),
+		})
+	})
+
+	// Action is purge, which also removes thumbnails older versions left in
+	// the files directory, or prewarm
+	r.POST("/files/cache", func(c *gin.Context) {
+		if !IsAuthorized(c, "media") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		var msg string
+		switch c.PostForm("Action") {
+		case "purge":
+			if err := cache.Purge(); err != nil {
+				HandleError(c, err)
+				return
+			}
+			n, err := PurgeLegacyThumbnails(files)
+			if err != nil {
+				HandleError(c, err)
+				return
+			}
+			msg = fmt.Sprintf("Emptied the image cache and removed %d old thumbnails", n)
+		case "prewarm":
+			go func() {
+				n, err := cache.Prewarm(db, files)
+				if err != nil {
+					log.Printf("prewarm: %s", err)
+				}
+				log.Printf("prewarm: %d images ready", n)
+			}()
+			msg = "Generating images in the background"
+		default:
+			HandleError(c, ErrUnknownCacheAction)
+			return
+		}
+		HTML(c, 200, "notice.html", map[string]string{
+			"Message":   msg,
+			"ReturnURL": "/files/",
+		})
+	})
+
+	// The archived copy of a page a post responds to
+	r.GET("/archive", func(c *gin.Context) {
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		defer tx.Rollback()
+		if ok, err := CanReadArchive(c, tx, c.Query("url")); err != nil {
+			HandleError(c, err)
+			return
+		} else if !ok {
+			HandleError(c, ErrArchiveNotFound)
+			return
+		}
+		archive, err := GetArchive(tx, c.Query("url"))
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if IsReqJSON(c) {
+			c.JSON(200, archive)
+			return
+		}
+		HTML(c, 200, "archive.html", M{
+			"Archive": archive,
+		})
+	})
+
+	// Links of posts that failed their last check
+	r.GET("/links", func(c *gin.Context) {
+		if !IsAuthorized(c) {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		defer tx.Rollback()
+		xs, err := GetBrokenLinks(tx)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if IsReqJSON(c) {
+			c.JSON(200, xs)
+			return
+		}
+		HTML(c, 200, "links.html", M{
+			"Links": xs,
+		})
+	})
+
+	// The queue of posts waiting for their date
+	r.GET("/scheduled", func(c *gin.Context) {
+		if !IsAuthorized(c) {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		defer tx.Rollback()
+		xs, err := GetScheduled(tx)
 		if err != nil {
 			HandleError(c, err)
 			return
 		}
-		defer src.Close()
-		if err := os.MkdirAll(path.Join(assetsDir, dir), 0755); err != nil {
+		if IsReqJSON(c) {
+			c.JSON(200, xs)
+			return
+		}
+		HTML(c, 200, "scheduled.html", M{
+			"Items": xs,
+		})
+	})
+
+	// The media library, ?filter=unused or ?filter=broken narrow it down
+	r.GET("/media", func(c *gin.Context) {
+		if !IsAuthorized(c, "media") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
 			HandleError(c, err)
 			return
 		}
-		dst, err := os.OpenFile(path.Join(assetsDir, dir, h.Filename), os.O_RDWR|os.O_TRUNC|os.O_CREATE,0755)
+		defer tx.Rollback()
+		filter := c.Query("filter")
+		payload := M{
+			"Filter": filter,
+		}
+		if filter == "broken" {
+			payload["Broken"], err = GetBrokenReferences(tx, files)
+		} else {
+			payload["Media"], err = GetMedia(tx, filter == "unused")
+		}
 		if err != nil {
 			HandleError(c, err)
 			return
 		}
-		defer dst.Close()
-		if _, err := io.Copy(dst, src); err != nil {
+		if IsReqJSON(c) {
+			c.JSON(200, payload)
+		} else {
+			HTML(c, 200, "media.html", payload)
+		}
+	})
+
+	r.POST("/media/scan", func(c *gin.Context) {
+		if !IsAuthorized(c, "media") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		if err := ScanMedia(db, files); err != nil {
 			HandleError(c, err)
 			return
 		}
-		c.Redirect(302, filepath.Join("/files", dir))
+		c.Redirect(302, "/media")
+	})
+
+	r.POST("/media/:id", func(c *gin.Context) {
+		if !IsAuthorized(c, "media") {
+			HandleError(c, ErrNoAuth)
+			return
+		}
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			HandleError(c, ErrMediaNotFound)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		if err := SetMediaAlt(tx, id, c.PostForm("Alt")); err != nil {
+			tx.Rollback()
+			HandleError(c, err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Redirect(302, "/media?filter="+url.QueryEscape(c.PostForm("Filter")))
 	})
 
 	r.GET("/files/*path", func(c *gin.Context) {
 		p := c.Params.ByName("path")
-		filename := path.Join(assetsDir, p)
+		filename, err := files.Resolve(p)
+		if err != nil {
+			HandleError(c, err)
+			return
+		}
+		c.Header("X-Content-Type-Options", "nosniff")
 		fi, err := os.Stat(filename)
 		if err != nil {
 			HandleError(c, err)
 			return
 		}
-		if _, ok := c.GetQuery("delete"); ok {
-			if err := os.RemoveAll(filename); err != nil {
+		if IsImage(fi) && HasImageOptions(c.Request.URL.Query()) {
+			o, err := ParseImageOptions(c.Request.URL.Query(), filename)
+			if err != nil {
 				HandleError(c, err)
 				return
 			}
-			c.HTML(200, "notice.html", map[string]string{
-				"Message": fmt.Sprintf("Deleted file %s", p),
-				"ReturnURL": filepath.Join("/files", filepath.Dir(p)),
-			})
+			f, err := cache.Open(filename, o)
+			if err != nil {
+				HandleError(c, err)
+				return
+			}
+			ServeFile(c, f)
 			return
 		}
-		if q, ok := c.GetQuery("size"); ok && IsImage(fi) {
-			ServeImageCache(c, filename, q)
+		if !cfg.KeepMetadata && !fi.IsDir() && isJPEG(filename) {
+			f, err := cache.OpenStripped(filename)
+			if err == ErrNotJPEG {
+				// Nothing to strip from whatever it is.
+				f, err = os.Open(filename)
+			}
+			if err != nil {
+				HandleError(c, err)
+				return
+			}
+			ServeFile(c, f)
 			return
 		}
 		if fi.IsDir() {
-			if !IsAuthorized(c) {
+			if !IsAuthorized(c, "media") {
 				HandleError(c, ErrNoAuth)
 				return
 			}
-
-			var files []FileItem
-			if err := filepath.Walk(filename, func(path string, info os.FileInfo, err error) error {
-				if path == filename {
-					return nil
-				}
-				if err != nil {
-					return nil
-				}
-				var f FileItem
-				f.Path = filepath.Join(p, path[len(filename):])
-				f.Filename = info.Name()
-				f.IsDirectory = info.IsDir()
-				files = append(files, f)
-				return nil
-			}); err != nil {
+			list, err := files.List(p)
+			if err != nil {
+				HandleError(c, err)
+				return
+			}
+			log, err := GetFileOperations(db, 20)
+			if err != nil {
 				HandleError(c, err)
 				return
 			}
+			count, size := cache.Size()
 			payload := M{
-				"Directory": p,
-				"Files":     files,
+				"Directory":  files.Rel(filename),
+				"Files":      list,
+				"Log":        log,
+				"CacheCount": count,
+				"CacheSize":  size,
 			}
 			if IsReqJSON(c) {
 				c.JSON(200, payload)
 			} else {
-				c.HTML(200, "files.html", payload)
+				HTML(c, 200, "files.html", payload)
 			}
 			return
 		}
+		// Uploaded HTML and scripts are downloaded, never run on the blog's
+		// origin. Pages are served from /page.
+		if IsActiveFile(filename) {
+			c.Header("Content-Security-Policy", "sandbox")
+			c.FileAttachment(filename, path.Base(filename))
+			return
+		}
 		c.File(filename)
 	})
 
-	if key != "" && cert != "" {
-		r.RunTLS(":" + strconv.Itoa(port), cert, key)
+	if cfg.Key != "" && cfg.Cert != "" {
+		r.RunTLS(":"+strconv.Itoa(cfg.Port), cfg.Cert, cfg.Key)
 	} else {
-		r.Run(":" + strconv.Itoa(port))
+		r.Run(":" + strconv.Itoa(cfg.Port))
 	}
 }
 
-type FileItem struct {
-	Filename    string
-	Path        string
-	URI         string
-	IsDirectory bool
+// ErrorStatus is the HTTP status code an error is reported with.
+func ErrorStatus(err error) int {
+	switch err {
+	case ErrNoAuth, ErrInvalidPassword, ErrInvalidPostPassword:
+		return 401
+	case ErrContentNotFound, ErrMediaNotFound, ErrArchiveNotFound, ErrPreviewNotFound,
+		ErrRevisionNotFound, ErrMentionNotFound, ErrPageNotFound:
+		return 404
+	case ErrCSRF, ErrPathEscapes, ErrActiveFile:
+		return 403
+	case ErrURIUsed:
+		return 409
+	case ErrInvalidFilename, ErrFileType, ErrFileTooLarge, ErrDeleteRoot,
+		ErrImageSize, ErrImageMode, ErrImageAnchor, ErrImageQuality, ErrImageFormat,
+		ErrUnknownCacheAction, ErrUnknownTheme, ErrInvalidVisibility, ErrPostPasswordRequired,
+		ErrForbiddenAddress, ErrUnsupportedScheme, ErrTooManyRedirects,
+		ErrInvalidID, ErrInvalidType, ErrInvalidCursor, ErrInvalidDate, ErrResponseURLRequired:
+		return 400
+	}
+	if os.IsNotExist(err) {
+		return 404
+	}
+	return 500
 }
 
 func HandleError(c *gin.Context, err error) {
+	if IsReqAPI(c) {
+		FailAPI(c, err)
+		return
+	}
 	w := map[string]string{"Error": err.Error()}
-	if _, ok := c.GetQuery("json"); ok {
-		c.JSON(500, w)
+	code := ErrorStatus(err)
+	if IsReqJSON(c) {
+		c.JSON(code, w)
 		return
 	}
-	c.HTML(500, "error.html", w)
+	HTML(c, code, "error.html", w)
 }
 
+// IsReqJSON tells if the client asked for JSON in its Accept header, or with
+// the json query parameter older clients use.
 func IsReqJSON(c *gin.Context) bool {
 	if _, ok := c.GetQuery("json"); ok {
 		return true
 	}
-	return false
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
 }
 
-func IsImage(info os.FileInfo) bool {
-	ext := strings.ToLower(filepath.Ext(info.Name()))
-	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+// IsReqAPI tells if the request is for the JSON API, which always answers
+// with JSON.
+func IsReqAPI(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/api/")
 }
-
-func ServeImageCache(c *gin.Context, filename, size string) {
-	s, err := strconv.Atoi(size)
-	if err != nil {
-		HandleError(c, errors.New(fmt.Sprintf("invalid image size '%s'", size)))
-		return
-	}
-	dir := filepath.Dir(filename)
-	base := filepath.Base(filename)
-	ext := filepath.Ext(filename)
-	name := base[:len(base)-len(ext)]
-	cached := filepath.Join(dir, fmt.Sprintf("%s_%s_%s", name, size, ext))
-	info, err := os.Stat(cached)
-	if os.IsNotExist(err) {
-		img, err := imaging.Open(filename)
-		if err != nil {
-			HandleError(c, err)
-			return
-		}
-		img = imaging.Fit(img, s, s, imaging.Lanczos)
-		if err := imaging.Save(img, cached); err != nil {
-			HandleError(c, err)
-			return
-		}
-		c.File(cached)
-	} else if err != nil {
-		HandleError(c, err)
-		return
-	} else if info.IsDir() {
-		HandleError(c, errors.New("cached image file is a directory"))
-		return
-	}
-	c.File(cached)
-}
\ No newline at end of file
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gin-contrib/sessions"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Visibility decides who can see a content piece.
+type Visibility string
+
+const (
+	// Listed on the blog, in feeds and in the sitemap.
+	VisibilityPublished Visibility = "published"
+	// Only the author can see it.
+	VisibilityDraft Visibility = "draft"
+	// Anyone with the link can see it, but it isn't listed anywhere.
+	VisibilityUnlisted Visibility = "unlisted"
+	// Only the author can see it, unlike a draft it is considered finished.
+	VisibilityPrivate Visibility = "private"
+	// Listed, but the body is only shown to those who know its password.
+	VisibilityProtected Visibility = "protected"
+)
+
+var Visibilities = []Visibility{
+	VisibilityPublished,
+	VisibilityDraft,
+	VisibilityUnlisted,
+	VisibilityPrivate,
+	VisibilityProtected,
+}
+
+// ListedVisibilities are shown to visitors on the blog and in search.
+var ListedVisibilities = []Visibility{VisibilityPublished, VisibilityProtected}
+
+var (
+	ErrInvalidVisibility    = errors.New("visibility must be published, draft, unlisted, private or protected")
+	ErrPostPasswordRequired = errors.New("a password protected post needs a password")
+	ErrInvalidPostPassword  = errors.New("wrong password")
+)
+
+func IsValidVisibility(v Visibility) bool {
+	for _, x := range Visibilities {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVisibility defaults the visibility to published and makes sure a
+// protected post has a password, keeping the one it had when saved without
+// a new one.
+func CheckVisibility(tx *sql.Tx, c *ContentPiece) error {
+	if c.Visibility == "" {
+		c.Visibility = VisibilityPublished
+	}
+	if !IsValidVisibility(c.Visibility) {
+		return ErrInvalidVisibility
+	}
+	if c.Visibility != VisibilityProtected {
+		c.PasswordHash = ""
+		return nil
+	}
+	if c.PasswordHash == "" && c.ID != "" {
+		err := tx.QueryRow(`SELECT password_hash FROM content WHERE id = ?`, c.ID).Scan(&c.PasswordHash)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	if c.PasswordHash == "" {
+		return ErrPostPasswordRequired
+	}
+	return nil
+}
+
+// SetPassword protects a content piece with a password.
+func (c *ContentPiece) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	c.PasswordHash = string(hash)
+	return nil
+}
+
+func (c *ContentPiece) CheckPassword(password string) error {
+	if c.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) != nil {
+		return ErrInvalidPostPassword
+	}
+	return nil
+}
+
+// IsPublic tells if visitors can reach the content piece by its URI. Protected
+// ones still ask for the password.
+func (c *ContentPiece) IsPublic() bool {
+	switch c.Visibility {
+	case VisibilityDraft, VisibilityPrivate:
+		return false
+	}
+	return !time.Now().Before(c.Date)
+}
+
+func (c *ContentPiece) IsProtected() bool {
+	return c.Visibility == VisibilityProtected
+}
+
+// Hide removes what a protected content piece only shows with its password.
+func (c *ContentPiece) Hide() {
+	c.Body = ""
+	c.BodyHTML = ""
+	c.Snippet = ""
+	c.Excerpt = ""
+}
+
+// Only the latest unlocked posts are remembered, to keep the cookie small.
+const maxUnlocked = 20
+
+// UnlockContent remembers in the session that the visitor knows the password
+// of a content piece.
+func UnlockContent(c *gin.Context, id Identifier) error {
+	s := sessions.Default(c)
+	xs, _ := s.Get("unlocked").([]string)
+	for _, x := range xs {
+		if x == string(id) {
+			return nil
+		}
+	}
+	xs = append(xs, string(id))
+	if len(xs) > maxUnlocked {
+		xs = xs[len(xs)-maxUnlocked:]
+	}
+	s.Set("unlocked", xs)
+	return s.Save()
+}
+
+// CanRead tells if the body of a content piece can be shown to the visitor.
+func CanRead(c *gin.Context, content *ContentPiece) bool {
+	if IsAuthorized(c) {
+		return true
+	}
+	if !content.IsPublic() {
+		return false
+	}
+	if !content.IsProtected() {
+		return true
+	}
+	xs, _ := sessions.Default(c).Get("unlocked").([]string)
+	for _, x := range xs {
+		if x == string(content.ID) {
+			return true
+		}
+	}
+	return false
+}
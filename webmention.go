@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	xhtml "golang.org/x/net/html"
+	"willnorris.com/go/microformats"
+)
+
+type MentionStatus string
+
+const (
+	// Queued for verification.
+	MentionPending MentionStatus = "pending"
+	// Verified and waiting for the author to approve it.
+	MentionReview   MentionStatus = "review"
+	MentionApproved MentionStatus = "approved"
+	MentionHidden   MentionStatus = "hidden"
+	// The source doesn't exist or doesn't link to the target.
+	MentionInvalid MentionStatus = "invalid"
+)
+
+type MentionType string
+
+const (
+	MentionTypeMention MentionType = "mention"
+	MentionTypeReply   MentionType = "reply"
+	MentionTypeLike    MentionType = "like"
+	MentionTypeRepost  MentionType = "repost"
+)
+
+var (
+	ErrInvalidSource   = errors.New("invalid source url")
+	ErrInvalidTarget   = errors.New("invalid target url")
+	ErrMentionNotFound = errors.New("webmention not found")
+	ErrNoLinkToTarget  = errors.New("source does not link to target")
+)
+
+// The most we read of a source document.
+const maxMentionSourceSize = 1 << 20
+
+type Webmention struct {
+	ID           int64
+	Source       string
+	Target       string
+	ContentID    Identifier
+	Status       MentionStatus
+	Type         MentionType
+	AuthorName   string
+	AuthorURL    string
+	AuthorPhoto  string
+	Content      string
+	URL          string
+	Published    time.Time
+	Error        string
+	DateReceived time.Time
+	DateVerified time.Time
+}
+
+func (m *Webmention) DateString() string {
+	d := m.Published
+	if d.IsZero() {
+		d = m.DateReceived
+	}
+	return d.Format("January 2006 2 at 03:04PM")
+}
+
+// Link is the URL the mention should link to, the h-entry's url if it has one.
+func (m *Webmention) Link() string {
+	if m.URL != "" {
+		return m.URL
+	}
+	return m.Source
+}
+
+// TargetContentURI returns the URI of the post a webmention target points to,
+// as long as it's on this site.
+func TargetContentURI(base, target string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	t, err := url.Parse(target)
+	if err != nil || (t.Scheme != "http" && t.Scheme != "https") {
+		return "", ErrInvalidTarget
+	}
+	if !strings.EqualFold(t.Host, b.Host) {
+		return "", ErrInvalidTarget
+	}
+	p := strings.TrimSuffix(t.Path, "/")
+	if !strings.HasPrefix(p, "/post/") {
+		return "", ErrInvalidTarget
+	}
+	uri := strings.TrimPrefix(p, "/post/")
+	if uri == "" || strings.Contains(uri, "/") {
+		return "", ErrInvalidTarget
+	}
+	return uri, nil
+}
+
+func IsValidSource(source string) bool {
+	u, err := url.Parse(source)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// QueueWebmention stores a received webmention as pending. A mention already
+// known for the source and target is verified again, as senders re-send
+// mentions when their post changes, but one the author approved or hid keeps
+// its status: only its content is updated.
+func QueueWebmention(tx *sql.Tx, source, target string, id Identifier) (int64, error) {
+	stmt, err := tx.Prepare(`
+INSERT INTO webmention (source, target, content_id, status, date_received)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (source, target) DO UPDATE SET
+	content_id = excluded.content_id,
+	status = CASE WHEN status IN (?, ?) THEN status ELSE excluded.status END,
+	date_received = excluded.date_received`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(source, target, id, MentionPending, time.Now(), MentionApproved, MentionHidden); err != nil {
+		return 0, err
+	}
+	var mid int64
+	err = tx.QueryRow(`SELECT id FROM webmention WHERE source = ? AND target = ?`, source, target).Scan(&mid)
+	return mid, err
+}
+
+const webmentionColumns = `
+	id,
+	source,
+	target,
+	content_id,
+	status,
+	type,
+	author_name,
+	author_url,
+	author_photo,
+	content,
+	url,
+	published,
+	error,
+	date_received,
+	date_verified`
+
+func scanWebmention(scan func(...interface{}) error) (*Webmention, error) {
+	var m Webmention
+	var published, verified sql.NullTime
+	if err := scan(&m.ID,
+		&m.Source,
+		&m.Target,
+		&m.ContentID,
+		&m.Status,
+		&m.Type,
+		&m.AuthorName,
+		&m.AuthorURL,
+		&m.AuthorPhoto,
+		&m.Content,
+		&m.URL,
+		&published,
+		&m.Error,
+		&m.DateReceived,
+		&verified); err != nil {
+		return nil, err
+	}
+	m.Published = published.Time
+	m.DateVerified = verified.Time
+	return &m, nil
+}
+
+func GetWebmention(tx *sql.Tx, id int64) (*Webmention, error) {
+	stmt, err := tx.Prepare(`SELECT` + webmentionColumns + ` FROM webmention WHERE id = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	m, err := scanWebmention(stmt.QueryRow(id).Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrMentionNotFound
+	}
+	return m, err
+}
+
+// GetWebmentions lists the mentions of a content piece, oldest first. Only
+// approved mentions are included unless all is set.
+func GetWebmentions(tx *sql.Tx, id Identifier, all bool) ([]*Webmention, error) {
+	q := `SELECT` + webmentionColumns + ` FROM webmention WHERE content_id = ?`
+	args := []interface{}{id}
+	if all {
+		q += ` AND status != ?`
+		args = append(args, MentionInvalid)
+	} else {
+		q += ` AND status = ?`
+		args = append(args, MentionApproved)
+	}
+	q += ` ORDER BY date_received ASC`
+	stmt, err := tx.Prepare(q)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xs := make([]*Webmention, 0)
+	for rows.Next() {
+		m, err := scanWebmention(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, m)
+	}
+	return xs, rows.Err()
+}
+
+// GetPendingWebmentions returns the ids of mentions waiting for verification:
+// new ones and those received again since they were last verified.
+func GetPendingWebmentions(db *sql.DB) ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM webmention
+WHERE status = ? OR date_verified IS NULL OR date_verified < date_received
+ORDER BY date_received`, MentionPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		xs = append(xs, id)
+	}
+	return xs, rows.Err()
+}
+
+func UpdateWebmention(tx *sql.Tx, m *Webmention) error {
+	stmt, err := tx.Prepare(`UPDATE webmention SET
+	status = ?,
+	type = ?,
+	author_name = ?,
+	author_url = ?,
+	author_photo = ?,
+	content = ?,
+	url = ?,
+	published = ?,
+	error = ?,
+	date_verified = ?
+	WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var published interface{}
+	if !m.Published.IsZero() {
+		published = m.Published
+	}
+	res, err := stmt.Exec(m.Status, m.Type, m.AuthorName, m.AuthorURL, m.AuthorPhoto, m.Content, m.URL, published, m.Error, m.DateVerified, m.ID)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count != 1 {
+		return ErrMentionNotFound
+	}
+	return nil
+}
+
+func SetWebmentionStatus(tx *sql.Tx, id int64, status MentionStatus) error {
+	res, err := tx.Exec(`UPDATE webmention SET status = ? WHERE id = ?`, status, id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count != 1 {
+		return ErrMentionNotFound
+	}
+	return nil
+}
+
+func DeleteWebmention(tx *sql.Tx, id int64) error {
+	res, err := tx.Exec(`DELETE FROM webmention WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil {
+		return err
+	} else if count != 1 {
+		return ErrMentionNotFound
+	}
+	return nil
+}
+
+// WebmentionReceiver verifies queued webmentions in the background.
+type WebmentionReceiver struct {
+	DB *sql.DB
+	// Anyone can send a mention, so sources are only fetched from public
+	// addresses.
+	Fetcher *Fetcher
+	wake    chan struct{}
+}
+
+func NewWebmentionReceiver(db *sql.DB, f *Fetcher) *WebmentionReceiver {
+	return &WebmentionReceiver{
+		DB:      db,
+		Fetcher: f,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start verifies pending mentions, those left by a previous run included, and
+// looks for new ones every minute or when woken.
+func (w *WebmentionReceiver) Start() {
+	go func() {
+		for {
+			if err := w.VerifyPending(); err != nil {
+				log.Printf("webmention receiver: %s", err)
+			}
+			select {
+			case <-w.wake:
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// Wake makes the receiver look for pending mentions right away.
+func (w *WebmentionReceiver) Wake() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// VerifyPending verifies every pending mention once. A mention that fails
+// with an error of its own is marked invalid, so it isn't tried again until
+// it's received again.
+func (w *WebmentionReceiver) VerifyPending() error {
+	ids, err := GetPendingWebmentions(w.DB)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := w.Verify(id); err != nil {
+			log.Printf("webmention %d: %s", id, err)
+		}
+	}
+	return nil
+}
+
+// Verify fetches the source of a mention, checks it links to the target and
+// reads the h-entry it is part of. New mentions go to review, approved and
+// hidden ones keep their status unless the source stopped linking to the
+// target.
+func (w *WebmentionReceiver) Verify(id int64) error {
+	tx, err := w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	m, err := GetWebmention(tx, id)
+	tx.Rollback()
+	if err != nil {
+		return err
+	}
+	status := m.Status
+
+	// Fetch outside of a transaction, sources can be slow. A mention received
+	// again meanwhile is verified once more, as it was received after this.
+	m.DateVerified = time.Now()
+	verr := w.fetchAndParse(m)
+	if verr != nil {
+		m.Status = MentionInvalid
+		m.Error = verr.Error()
+	} else {
+		m.Error = ""
+		if m.Status == MentionPending {
+			m.Status = MentionReview
+		}
+	}
+
+	tx, err = w.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// The mention could have been moderated while we were fetching.
+	current, err := GetWebmention(tx, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if current.Status != status {
+		m.Status = current.Status
+	}
+	if err := UpdateWebmention(tx, m); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return verr
+}
+
+func (w *WebmentionReceiver) fetchAndParse(m *Webmention) error {
+	req, err := http.NewRequest("GET", m.Source, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/html, */*;q=0.5")
+	resp, err := w.Fetcher.Do(req, maxMentionSourceSize)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errors.New("source was deleted")
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("source responded with %d", resp.StatusCode))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	base := resp.Request.URL
+
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		if !bytes.Contains(body, []byte(m.Target)) {
+			return ErrNoLinkToTarget
+		}
+		m.Type = MentionTypeMention
+		return nil
+	}
+	if !LinksTo(body, base, m.Target) {
+		return ErrNoLinkToTarget
+	}
+	ParseMention(m, body, base)
+	return nil
+}
+
+// LinksTo reports whether an HTML document links to target in any of its
+// href or src attributes.
+func LinksTo(doc []byte, base *url.URL, target string) bool {
+	z := xhtml.NewTokenizer(bytes.NewReader(doc))
+	for {
+		switch z.Next() {
+		case xhtml.ErrorToken:
+			return false
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			for _, attr := range z.Token().Attr {
+				if attr.Key != "href" && attr.Key != "src" {
+					continue
+				}
+				if SameURL(ResolveURL(base, attr.Val), target) {
+					return true
+				}
+			}
+		}
+	}
+}
+
+func ResolveURL(base *url.URL, s string) string {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return ""
+	}
+	if base == nil {
+		return u.String()
+	}
+	return base.ResolveReference(u).String()
+}
+
+// SameURL compares URLs ignoring fragments and trailing slashes.
+func SameURL(a, b string) bool {
+	norm := func(s string) string {
+		if i := strings.Index(s, "#"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSuffix(s, "/")
+	}
+	return a != "" && norm(a) == norm(b)
+}
+
+// ParseMention fills in the type, author and content of a mention from the
+// first h-entry of the source that refers to the target.
+func ParseMention(m *Webmention, doc []byte, base *url.URL) {
+	m.Type = MentionTypeMention
+	data := microformats.Parse(bytes.NewReader(doc), base)
+	if data == nil {
+		return
+	}
+	entry := findEntry(data.Items, m.Target)
+	if entry == nil {
+		return
+	}
+	switch {
+	case mfRefersTo(entry, "in-reply-to", m.Target):
+		m.Type = MentionTypeReply
+	case mfRefersTo(entry, "like-of", m.Target):
+		m.Type = MentionTypeLike
+	case mfRefersTo(entry, "repost-of", m.Target):
+		m.Type = MentionTypeRepost
+	}
+	m.URL = mfString(entry, "url")
+	if t, err := time.Parse(time.RFC3339, mfString(entry, "published")); err == nil {
+		m.Published = t
+	}
+	if xs := entry.Properties["content"]; len(xs) > 0 {
+		m.Content = truncate(mfValue(xs[0]), 500)
+	} else {
+		m.Content = truncate(mfString(entry, "summary"), 500)
+	}
+	if xs := entry.Properties["author"]; len(xs) > 0 {
+		if card, ok := xs[0].(*microformats.Microformat); ok {
+			m.AuthorName = mfString(card, "name")
+			m.AuthorURL = mfString(card, "url")
+			m.AuthorPhoto = mfString(card, "photo")
+		} else {
+			m.AuthorName = mfValue(xs[0])
+		}
+	}
+}
+
+// findEntry prefers an h-entry that refers to the target, falling back to the
+// first h-entry found.
+func findEntry(items []*microformats.Microformat, target string) *microformats.Microformat {
+	var first *microformats.Microformat
+	var walk func([]*microformats.Microformat) *microformats.Microformat
+	walk = func(xs []*microformats.Microformat) *microformats.Microformat {
+		for _, x := range xs {
+			if hasType(x, "h-entry") {
+				if first == nil {
+					first = x
+				}
+				for _, prop := range []string{"in-reply-to", "like-of", "repost-of"} {
+					if mfRefersTo(x, prop, target) {
+						return x
+					}
+				}
+			}
+			if found := walk(x.Children); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	if found := walk(items); found != nil {
+		return found
+	}
+	return first
+}
+
+func hasType(mf *microformats.Microformat, t string) bool {
+	for _, x := range mf.Type {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+func mfRefersTo(mf *microformats.Microformat, prop, target string) bool {
+	for _, x := range mf.Properties[prop] {
+		if SameURL(mfValue(x), target) {
+			return true
+		}
+		if nested, ok := x.(*microformats.Microformat); ok && SameURL(mfString(nested, "url"), target) {
+			return true
+		}
+	}
+	return false
+}
+
+func mfString(mf *microformats.Microformat, prop string) string {
+	if xs := mf.Properties[prop]; len(xs) > 0 {
+		return mfValue(xs[0])
+	}
+	return ""
+}
+
+// mfValue returns the plain value of a microformats property value, which can
+// be a string, an embedded microformat or a map for e-* and u-* with alt.
+func mfValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case *microformats.Microformat:
+		return x.Value
+	case map[string]string:
+		return x["value"]
+	case map[string]interface{}:
+		if s, ok := x["value"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+func truncate(s string, n int) string {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n]) + "…"
+}
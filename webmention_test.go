@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchMentionSource(t *testing.T) {
+	target := "https://blog.example/post/hello"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/plain":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "I liked %s", target)
+		case "/unrelated":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<p><a href="https://elsewhere.example/">elsewhere</a></p>`)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+	defer srv.Close()
+
+	// Sources on private addresses are never fetched, whoever asks.
+	w := NewWebmentionReceiver(nil, NewFetcher())
+	m := &Webmention{Source: srv.URL + "/plain", Target: target}
+	if err := w.fetchAndParse(m); err != ErrForbiddenAddress {
+		t.Errorf("private source: err = %v, want %v", err, ErrForbiddenAddress)
+	}
+
+	f := NewFetcher()
+	f.AllowPrivate = true
+	w = NewWebmentionReceiver(nil, f)
+	m = &Webmention{Source: srv.URL + "/plain", Target: target}
+	if err := w.fetchAndParse(m); err != nil {
+		t.Errorf("plain source: %s", err)
+	} else if m.Type != MentionTypeMention {
+		t.Errorf("plain source: type = %q", m.Type)
+	}
+	m = &Webmention{Source: srv.URL + "/unrelated", Target: target}
+	if err := w.fetchAndParse(m); err != ErrNoLinkToTarget {
+		t.Errorf("unrelated source: err = %v, want %v", err, ErrNoLinkToTarget)
+	}
+	m = &Webmention{Source: srv.URL + "/gone", Target: target}
+	if err := w.fetchAndParse(m); err == nil {
+		t.Error("deleted source: no error")
+	}
+}
+
+func TestReceivedAgainKeepsModeration(t *testing.T) {
+	target := testBaseURL + "/post/hello"
+	linked := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		if linked {
+			fmt.Fprintf(w, "I liked %s", target)
+		}
+	}))
+	defer srv.Close()
+
+	db := testDB(t)
+	if _, err := Migrate(db, false); err != nil {
+		t.Fatal(err)
+	}
+	c := &ContentPiece{Title: "Hello", Body: "<p>Hi</p>", Type: TypeDefault, URI: "hello", Date: time.Now()}
+	testCreate(t, db, c)
+	w := NewWebmentionReceiver(db, testFetcher())
+	receive := func(source string) int64 {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		id, err := QueueWebmention(tx, source, target, c.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.VerifyPending(); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	status := func(id int64) MentionStatus {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		m, err := GetWebmention(tx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.Status
+	}
+	moderate := func(id int64, s MentionStatus) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := SetWebmentionStatus(tx, id, s); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	approved := receive(srv.URL + "/approved")
+	hidden := receive(srv.URL + "/hidden")
+	if s := status(approved); s != MentionReview {
+		t.Fatalf("new mention is %s", s)
+	}
+	moderate(approved, MentionApproved)
+	moderate(hidden, MentionHidden)
+	if ids, _ := GetPendingWebmentions(db); len(ids) != 0 {
+		t.Errorf("moderated mentions are pending: %v", ids)
+	}
+
+	receive(srv.URL + "/approved")
+	receive(srv.URL + "/hidden")
+	if s := status(approved); s != MentionApproved {
+		t.Errorf("approved mention received again is %s", s)
+	}
+	if s := status(hidden); s != MentionHidden {
+		t.Errorf("hidden mention received again is %s", s)
+	}
+	if ids, _ := GetPendingWebmentions(db); len(ids) != 0 {
+		t.Errorf("verified mentions are pending: %v", ids)
+	}
+
+	// A source that no longer links to the post takes the mention down.
+	linked = false
+	receive(srv.URL + "/approved")
+	if s := status(approved); s != MentionInvalid {
+		t.Errorf("unlinked mention is %s", s)
+	}
+}